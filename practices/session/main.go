@@ -1,62 +1,153 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
+	"time"
 
 	//此处使用相对路径，正式项目应该用绝对路径为佳
 	"github.com/hq-cml/GoHttpWeb/practices/session/session"
-	_ "github.com/hq-cml/GoHttpWeb/practices/session/session/storages"
+	"github.com/hq-cml/GoHttpWeb/practices/session/session/storages"
 	//"./session"
 )
 
 //全局的session管理器
 var g_sessions *session.SessionManager
 
+//登录的用户名，类型在声明时就确定了
+var g_username = session.NewKey[string]("username")
+
 //包初始化函数
 func init() {
 	fmt.Println("Main init")
 	//g_sessions, _ = session.NewManager("memory", "GOSESSID", 3600)
-	g_sessions, _ = session.NewManager("redis", "GOSESSID", 3600)
-	go g_sessions.GC() //开启GC线程~
+	//g_sessions, _ = session.NewManager("file", "GOSESSID", 3600)
+	//g_sessions, _ = session.NewManager("redis", "GOSESSID", 3600)
+	//延迟写回：一个请求里的修改由Middleware在请求结束时一次写回redis，没有修改时不写
+	var err error
+	g_sessions, err = session.New(storages.NewRedisStorage(storages.RedisOptions{}),
+		session.WithCookieName("GOSESSID"),
+		session.WithIdleTimeout(time.Hour),
+		session.WithDeferredWrites(),
+	)
+	if err != nil {
+		log.Fatal("session.New: ", err)
+	}
+	g_sessions.SetStrictMode(true) //不接受客户端自带的未知sid，防止session fixation
+	//审计session的生命周期
+	g_sessions.OnRegenerate(func(ctx context.Context, old_sid, new_sid string) {
+		log.Printf("session regenerated: %s -> %s", old_sid, new_sid)
+	})
+	g_sessions.OnExpire(func(sid string) {
+		log.Printf("session expired: %s", sid)
+	})
+	g_sessions.GCRunner().Start(context.Background()) //开启GC线程~
 }
 
-//每当有客户访问login，就会有SessionStart，开始了奇幻之旅~
+//每当有客户访问login，就会从context中取出session，开始了奇幻之旅~
 func login(w http.ResponseWriter, r *http.Request) {
-	sess := g_sessions.SessionStart(w, r)
+	sess, err := session.FromContext(r.Context())
+	if err != nil {
+		//存储出错，响应已经由manager写好了
+		log.Printf("Login FromContext: %v", err)
+		return
+	}
 	r.ParseForm()
 	//如果是从表单提交过来的访问，method应该是post，如果是直接浏览器访问，则是get
 	if r.Method == "GET" {
 		fmt.Println("First com")
+		//上一次登录失败时留下的提示
+		errs, err := session.Flashes(sess, "error")
+		if err != nil {
+			log.Printf("Login Flashes: %v", err)
+		}
 		t, _ := template.ParseFiles("login.gtpl")
 		w.Header().Set("Content-Type", "text/html")
-		t.Execute(w, sess.Get("username"))
-		fmt.Printf("Login Session: %+v\n", sess.Get("username"))
+		t.Execute(w, errs)
+		name, _, _ := g_username.Get(sess)
+		fmt.Printf("Login Session: %s\n", name)
 	} else {
 		fmt.Println("Not First")
-		sess.Set("username", r.Form["username"])
-		fmt.Printf("Set SESSION:%+v\n", r.Form["username"])
+		if r.Form.Get("username") == "" {
+			session.AddFlash(sess, "error", "请输入用户名")
+			http.Redirect(w, r, "/login", 302)
+			return
+		}
+		//登录成功之后更换sid，登录前的sid即使被他人知道也没有用了
+		sess, err = g_sessions.SessionRegenerate(w, r)
+		if err != nil {
+			log.Printf("Login SessionRegenerate: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		g_username.Set(sess, r.Form.Get("username"))
+		//关联到用户上，之后可以一次性让这个用户的所有设备下线
+		if err := g_sessions.BindUser(sess, r.Form.Get("username")); err != nil {
+			log.Printf("Login BindUser: %v", err)
+		}
+		fmt.Printf("Set SESSION:%s\n", r.Form.Get("username"))
+		session.AddFlash(sess, "info", "登录成功")
 		http.Redirect(w, r, "/", 302)
 	}
 }
 
 func hello(w http.ResponseWriter, r *http.Request) {
-	sess := g_sessions.SessionStart(w, r)
-	if sess.Get("username") == nil {
+	sess, err := session.FromContext(r.Context())
+	if err != nil {
+		log.Printf("Hello FromContext: %v", err)
+		return
+	}
+	name, ok, err := g_username.Get(sess)
+	if err != nil {
+		log.Printf("Hello username: %v", err)
+	}
+	if !ok || err != nil {
 		fmt.Println("AAAAAAAAAAAAAAA")
 		http.Redirect(w, r, "/login", 302)
 		return
 	}
-	fmt.Printf("Hello Session: %+v\n", sess.Get("username"))
-	fmt.Fprintf(w, "Hello %+v!", sess.Get("username")) //这个写入到w的是输出到客户端的
+	fmt.Printf("Hello Session: %s\n", name)
+	infos, err := session.Flashes(sess, "info")
+	if err != nil {
+		log.Printf("Hello Flashes: %v", err)
+	}
+	for _, info := range infos {
+		fmt.Fprintln(w, info)
+	}
+	fmt.Fprintf(w, "Hello %s!", name) //这个写入到w的是输出到客户端的
+}
+
+//退出当前用户所有设备上的登录
+func logoutAll(w http.ResponseWriter, r *http.Request) {
+	sess, err := session.FromContext(r.Context())
+	if err != nil {
+		log.Printf("LogoutAll FromContext: %v", err)
+		return
+	}
+	//登录时当前session绑定到了用户上，DestroyUserSessions会把它一起销毁，
+	//再调用SessionDestroy的话OnDestroy会对同一个sid触发两次；没有登录或者销毁失败时才单独销毁当前session
+	destroyed := false
+	if name, ok, _ := g_username.Get(sess); ok {
+		n, err := g_sessions.DestroyUserSessions(r.Context(), name)
+		fmt.Printf("LogoutAll %s: %d sessions, err: %v\n", name, n, err)
+		destroyed = err == nil && n > 0
+	}
+	if !destroyed {
+		g_sessions.SessionDestroy(w, r)
+	}
+	http.Redirect(w, r, "/login", 302)
 }
 
 func main() {
-	http.HandleFunc("/login", login)         //设置访问的路由
-	http.HandleFunc("/", hello)              //设置访问的路由
-	err := http.ListenAndServe(":9527", nil) //设置监听的端口
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", login) //设置访问的路由
+	mux.HandleFunc("/logout_all", logoutAll)
+	mux.HandleFunc("/", hello) //设置访问的路由
+	//Middleware负责加载session并放进请求的context，handler用session.FromContext取出
+	err := http.ListenAndServe(":9527", g_sessions.Middleware(mux)) //设置监听的端口
 	if err != nil {
 		log.Fatal("ListenAndServe: ", err)
 	}
@@ -0,0 +1,77 @@
+package session_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/hq-cml/GoHttpWeb/practices/session/session"
+	"github.com/hq-cml/GoHttpWeb/practices/session/session/storages"
+)
+
+/*
+ * SessionStart在高并发下的吞吐，memory存储：
+ *   go test -bench SessionStart -cpu 1,4,16 ./session/
+ */
+
+func newBenchManager(b *testing.B) *session.SessionManager {
+	b.Helper()
+	manager, err := session.New(storages.NewMemStorage(storages.MemOptions{}))
+	if err != nil {
+		b.Fatal(err)
+	}
+	return manager
+}
+
+//每个请求都没有cookie，都要新建session
+func BenchmarkSessionStartNew(b *testing.B) {
+	manager := newBenchManager(b)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			w := httptest.NewRecorder()
+			if _, err := manager.SessionStart(w, httptest.NewRequest("GET", "/", nil)); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+//每个goroutine反复访问自己已经存在的session，不同的sid之间不应当互相等待
+func BenchmarkSessionStartExisting(b *testing.B) {
+	manager := newBenchManager(b)
+	var next int64
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		sid := "bench-" + strconv.FormatInt(atomic.AddInt64(&next, 1), 10)
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: "GOSESSID", Value: sid})
+		for pb.Next() {
+			sess, err := manager.SessionStart(httptest.NewRecorder(), r)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			sess.Get("username")
+		}
+	})
+}
+
+//所有goroutine访问同一个session，同一个sid的请求是互斥的，作为对照
+func BenchmarkSessionStartSameSid(b *testing.B) {
+	manager := newBenchManager(b)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: "GOSESSID", Value: "bench-shared"})
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := manager.SessionStart(httptest.NewRecorder(), r); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
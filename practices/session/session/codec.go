@@ -0,0 +1,167 @@
+package session
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+/*
+ * 值的序列化接口
+ * 需要把值落到外部存储（redis等）的storage，用Codec把任意Go值和[]byte互相转换
+ * Decode不知道目标类型，所以编码结果中需要自带类型信息
+ *
+ * manager上设置的Codec会下发给实现了CodecAware的storage（见SetCodec），
+ * 所以不管用哪种storage，同一个值存进去、取出来的类型都是一样的
+ */
+type Codec interface {
+	Encode(value interface{}) ([]byte, error)
+	Decode(data []byte) (interface{}, error)
+}
+
+/*
+ * 可选接口：需要序列化值的storage实现这个接口，使用manager统一设置的Codec
+ */
+type CodecAware interface {
+	SetCodec(codec Codec)
+}
+
+/*
+ * 类型注册表
+ * gob、JSON和二进制编码都需要按名字找回具体类型，自定义类型（struct等）存入session之前必须先用RegisterType注册
+ * 常用的基本类型、切片和map已经预先注册好了
+ */
+var (
+	g_types_lock sync.RWMutex
+	g_types      = make(map[string]reflect.Type)
+)
+
+func init() {
+	for _, v := range []interface{}{
+		false, "", []byte(nil),
+		int(0), int8(0), int16(0), int32(0), int64(0),
+		uint(0), uint8(0), uint16(0), uint32(0), uint64(0),
+		float32(0), float64(0),
+		[]string(nil), []int(nil), []int64(nil), []float64(nil), []interface{}(nil),
+		map[string]string(nil), map[string]int(nil), map[string]interface{}(nil), map[string][]string(nil),
+	} {
+		RegisterType(v)
+	}
+}
+
+//注册一个可以存入session的类型，value是该类型的任意一个值（通常是零值）
+//同时注册到gob，所以不需要再单独调用gob.Register
+func RegisterType(value interface{}) {
+	t := reflect.TypeOf(value)
+	if t == nil {
+		panic("session: RegisterType of nil")
+	}
+	gob.Register(value)
+	g_types_lock.Lock()
+	defer g_types_lock.Unlock()
+	g_types[typeName(t)] = t
+}
+
+//类型的名字：有名字的类型带上包路径，避免不同包里的同名类型冲突
+func typeName(t reflect.Type) string {
+	if t.Kind() == reflect.Ptr {
+		return "*" + typeName(t.Elem())
+	}
+	if t.Name() != "" && t.PkgPath() != "" {
+		return t.PkgPath() + "." + t.Name()
+	}
+	return t.String()
+}
+
+func lookupType(name string) (reflect.Type, error) {
+	g_types_lock.RLock()
+	defer g_types_lock.RUnlock()
+	t, ok := g_types[name]
+	if !ok {
+		return nil, fmt.Errorf("session: type %q not registered (forgotten RegisterType?)", name)
+	}
+	return t, nil
+}
+
+/*
+ * 基于encoding/gob的Codec，默认使用
+ * 基本类型及其切片可以直接使用；自定义的struct等类型需要先用RegisterType注册，否则Encode报错
+ * 注意：空的[]byte解码之后是nil
+ */
+type GobCodec struct{}
+
+//gob不能直接编码nil，也需要interface才能保留类型信息，所以套一层struct
+type gobBox struct {
+	V interface{}
+}
+
+func (GobCodec) Encode(value interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&gobBox{V: value}); err != nil {
+		return nil, fmt.Errorf("session: gob encode %T: %w", value, err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Decode(data []byte) (interface{}, error) {
+	var box gobBox
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&box); err != nil {
+		return nil, fmt.Errorf("session: gob decode: %w", err)
+	}
+	return box.V, nil
+}
+
+/*
+ * 基于encoding/json的Codec，存储中的数据可读，方便和其他语言的程序共享
+ * 编码结果是{"t":类型名,"v":值}，解码时按类型名从注册表中找回具体类型，所以int不会变成float64
+ * 类型需要能被encoding/json正确处理（比如struct只有导出的字段会被保存）；
+ * []interface{}、map[string]interface{}内部的数字没有类型信息，解码之后是float64
+ */
+type JSONCodec struct{}
+
+type jsonBox struct {
+	T string          `json:"t"`
+	V json.RawMessage `json:"v,omitempty"`
+}
+
+func (JSONCodec) Encode(value interface{}) ([]byte, error) {
+	if value == nil {
+		return json.Marshal(jsonBox{})
+	}
+	t := reflect.TypeOf(value)
+	if _, err := lookupType(typeName(t)); err != nil {
+		return nil, err
+	}
+	v, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("session: json encode %T: %w", value, err)
+	}
+	return json.Marshal(jsonBox{T: typeName(t), V: v})
+}
+
+func (JSONCodec) Decode(data []byte) (interface{}, error) {
+	var box jsonBox
+	if err := json.Unmarshal(data, &box); err != nil {
+		return nil, fmt.Errorf("session: json decode: %w", err)
+	}
+	if box.T == "" {
+		return nil, nil
+	}
+	return decodeJSONAs(box.T, box.V)
+}
+
+//按类型名把JSON解码成对应类型的值
+func decodeJSONAs(name string, data []byte) (interface{}, error) {
+	t, err := lookupType(name)
+	if err != nil {
+		return nil, err
+	}
+	ptr := reflect.New(t)
+	if err := json.Unmarshal(data, ptr.Interface()); err != nil {
+		return nil, fmt.Errorf("session: json decode %s: %w", name, err)
+	}
+	return ptr.Elem().Interface(), nil
+}
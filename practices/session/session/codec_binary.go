@@ -0,0 +1,315 @@
+package session
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+)
+
+/*
+ * 紧凑的二进制Codec，思路和msgpack类似：每个值先写一个字节的类型标记，再写内容
+ * 整数用varint，字符串和切片先写长度，session里最常见的小值只占几个字节
+ * 基本类型、[]string、[]interface{}、map[string]interface{}直接编码；
+ * 其他用RegisterType注册过的类型作为扩展类型，内容是类型名加JSON
+ */
+type BinaryCodec struct{}
+
+const (
+	bin_nil byte = iota
+	bin_false
+	bin_true
+	bin_int
+	bin_int8
+	bin_int16
+	bin_int32
+	bin_int64
+	bin_uint
+	bin_uint8
+	bin_uint16
+	bin_uint32
+	bin_uint64
+	bin_float32
+	bin_float64
+	bin_string
+	bin_bytes
+	bin_strings
+	bin_array
+	bin_map
+	bin_ext
+)
+
+var errBinaryCorrupt = errors.New("session: binary decode: corrupt data")
+
+func (BinaryCodec) Encode(value interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := binaryEncode(&buf, value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (BinaryCodec) Decode(data []byte) (interface{}, error) {
+	r := bytes.NewReader(data)
+	v, err := binaryDecode(r)
+	if err != nil {
+		return nil, err
+	}
+	if r.Len() != 0 {
+		return nil, errBinaryCorrupt
+	}
+	return v, nil
+}
+
+func binaryPutUvarint(buf *bytes.Buffer, x uint64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutUvarint(b[:], x)])
+}
+
+func binaryPutVarint(buf *bytes.Buffer, x int64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutVarint(b[:], x)])
+}
+
+func binaryPutString(buf *bytes.Buffer, s string) {
+	binaryPutUvarint(buf, uint64(len(s)))
+	buf.WriteString(s)
+}
+
+func binaryEncode(buf *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteByte(bin_nil)
+	case bool:
+		if v {
+			buf.WriteByte(bin_true)
+		} else {
+			buf.WriteByte(bin_false)
+		}
+	case int:
+		buf.WriteByte(bin_int)
+		binaryPutVarint(buf, int64(v))
+	case int8:
+		buf.WriteByte(bin_int8)
+		binaryPutVarint(buf, int64(v))
+	case int16:
+		buf.WriteByte(bin_int16)
+		binaryPutVarint(buf, int64(v))
+	case int32:
+		buf.WriteByte(bin_int32)
+		binaryPutVarint(buf, int64(v))
+	case int64:
+		buf.WriteByte(bin_int64)
+		binaryPutVarint(buf, v)
+	case uint:
+		buf.WriteByte(bin_uint)
+		binaryPutUvarint(buf, uint64(v))
+	case uint8:
+		buf.WriteByte(bin_uint8)
+		binaryPutUvarint(buf, uint64(v))
+	case uint16:
+		buf.WriteByte(bin_uint16)
+		binaryPutUvarint(buf, uint64(v))
+	case uint32:
+		buf.WriteByte(bin_uint32)
+		binaryPutUvarint(buf, uint64(v))
+	case uint64:
+		buf.WriteByte(bin_uint64)
+		binaryPutUvarint(buf, v)
+	case float32:
+		buf.WriteByte(bin_float32)
+		binary.Write(buf, binary.BigEndian, math.Float32bits(v))
+	case float64:
+		buf.WriteByte(bin_float64)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(v))
+	case string:
+		buf.WriteByte(bin_string)
+		binaryPutString(buf, v)
+	case []byte:
+		buf.WriteByte(bin_bytes)
+		binaryPutUvarint(buf, uint64(len(v)))
+		buf.Write(v)
+	case []string:
+		buf.WriteByte(bin_strings)
+		binaryPutUvarint(buf, uint64(len(v)))
+		for _, s := range v {
+			binaryPutString(buf, s)
+		}
+	case []interface{}:
+		buf.WriteByte(bin_array)
+		binaryPutUvarint(buf, uint64(len(v)))
+		for _, e := range v {
+			if err := binaryEncode(buf, e); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		buf.WriteByte(bin_map)
+		binaryPutUvarint(buf, uint64(len(v)))
+		for k, e := range v {
+			binaryPutString(buf, k)
+			if err := binaryEncode(buf, e); err != nil {
+				return err
+			}
+		}
+	default:
+		name := typeName(reflect.TypeOf(value))
+		if _, err := lookupType(name); err != nil {
+			return err
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("session: binary encode %T: %w", value, err)
+		}
+		buf.WriteByte(bin_ext)
+		binaryPutString(buf, name)
+		binaryPutUvarint(buf, uint64(len(data)))
+		buf.Write(data)
+	}
+	return nil
+}
+
+func binaryReadBytes(r *bytes.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, errBinaryCorrupt
+	}
+	if n > uint64(r.Len()) {
+		return nil, errBinaryCorrupt
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, errBinaryCorrupt
+	}
+	return b, nil
+}
+
+func binaryReadCount(r *bytes.Reader) (int, error) {
+	n, err := binary.ReadUvarint(r)
+	//每个元素至少占一个字节，超过剩余长度的一定是坏数据，避免按错误的长度分配大块内存
+	if err != nil || n > uint64(r.Len()) {
+		return 0, errBinaryCorrupt
+	}
+	return int(n), nil
+}
+
+func binaryDecode(r *bytes.Reader) (interface{}, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return nil, errBinaryCorrupt
+	}
+	switch tag {
+	case bin_nil:
+		return nil, nil
+	case bin_false:
+		return false, nil
+	case bin_true:
+		return true, nil
+	case bin_int, bin_int8, bin_int16, bin_int32, bin_int64:
+		x, err := binary.ReadVarint(r)
+		if err != nil {
+			return nil, errBinaryCorrupt
+		}
+		switch tag {
+		case bin_int:
+			return int(x), nil
+		case bin_int8:
+			return int8(x), nil
+		case bin_int16:
+			return int16(x), nil
+		case bin_int32:
+			return int32(x), nil
+		}
+		return x, nil
+	case bin_uint, bin_uint8, bin_uint16, bin_uint32, bin_uint64:
+		x, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, errBinaryCorrupt
+		}
+		switch tag {
+		case bin_uint:
+			return uint(x), nil
+		case bin_uint8:
+			return uint8(x), nil
+		case bin_uint16:
+			return uint16(x), nil
+		case bin_uint32:
+			return uint32(x), nil
+		}
+		return x, nil
+	case bin_float32:
+		var bits uint32
+		if err := binary.Read(r, binary.BigEndian, &bits); err != nil {
+			return nil, errBinaryCorrupt
+		}
+		return math.Float32frombits(bits), nil
+	case bin_float64:
+		var bits uint64
+		if err := binary.Read(r, binary.BigEndian, &bits); err != nil {
+			return nil, errBinaryCorrupt
+		}
+		return math.Float64frombits(bits), nil
+	case bin_string:
+		b, err := binaryReadBytes(r)
+		return string(b), err
+	case bin_bytes:
+		return binaryReadBytes(r)
+	case bin_strings:
+		n, err := binaryReadCount(r)
+		if err != nil {
+			return nil, err
+		}
+		v := make([]string, n)
+		for i := range v {
+			b, err := binaryReadBytes(r)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = string(b)
+		}
+		return v, nil
+	case bin_array:
+		n, err := binaryReadCount(r)
+		if err != nil {
+			return nil, err
+		}
+		v := make([]interface{}, n)
+		for i := range v {
+			if v[i], err = binaryDecode(r); err != nil {
+				return nil, err
+			}
+		}
+		return v, nil
+	case bin_map:
+		n, err := binaryReadCount(r)
+		if err != nil {
+			return nil, err
+		}
+		v := make(map[string]interface{}, n)
+		for i := 0; i < n; i++ {
+			k, err := binaryReadBytes(r)
+			if err != nil {
+				return nil, err
+			}
+			if v[string(k)], err = binaryDecode(r); err != nil {
+				return nil, err
+			}
+		}
+		return v, nil
+	case bin_ext:
+		name, err := binaryReadBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		data, err := binaryReadBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		return decodeJSONAs(string(name), data)
+	}
+	return nil, errBinaryCorrupt
+}
@@ -0,0 +1,80 @@
+package session
+
+import (
+	"reflect"
+	"testing"
+)
+
+type codecUser struct {
+	Name  string
+	Age   int
+	Roles []string
+}
+
+type codecUnregistered struct {
+	X int
+}
+
+func init() {
+	RegisterType(codecUser{})
+}
+
+var codecs = map[string]Codec{
+	"gob":    GobCodec{},
+	"json":   JSONCodec{},
+	"binary": BinaryCodec{},
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	values := []interface{}{
+		nil,
+		"",
+		"tom",
+		"中文",
+		[]string{"a", "b"},
+		[]int{1, 2, 3},
+		[]byte("raw"),
+		42,
+		int64(-7),
+		uint8(255),
+		3.5,
+		true,
+		map[string]string{"k": "v"},
+		map[string][]string{"error": {"密码错误"}},
+		codecUser{Name: "tom", Age: 18, Roles: []string{"admin"}},
+	}
+	for name, codec := range codecs {
+		for _, value := range values {
+			data, err := codec.Encode(value)
+			if err != nil {
+				t.Errorf("%s: Encode(%#v): %v", name, value, err)
+				continue
+			}
+			got, err := codec.Decode(data)
+			if err != nil {
+				t.Errorf("%s: Decode(%#v): %v", name, value, err)
+				continue
+			}
+			//类型也要一致，int不能变成float64
+			if !reflect.DeepEqual(got, value) {
+				t.Errorf("%s: round trip %#v (%T), got %#v (%T)", name, value, value, got, got)
+			}
+		}
+	}
+}
+
+func TestCodecUnregisteredType(t *testing.T) {
+	for name, codec := range codecs {
+		if _, err := codec.Encode(codecUnregistered{X: 1}); err == nil {
+			t.Errorf("%s: encoding an unregistered type succeeded", name)
+		}
+	}
+}
+
+func TestCodecCorruptData(t *testing.T) {
+	for name, codec := range codecs {
+		if _, err := codec.Decode([]byte{0xff, 0x00, 0x13}); err == nil {
+			t.Errorf("%s: decoding garbage succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package session
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/*
+ * cookie的属性，下发、刷新和删除cookie时都用同一份配置，否则浏览器会把它们当成不同的cookie
+ * 零值不是合理的默认值（Path为空、没有HttpOnly），请从DefaultCookieOptions()开始修改
+ *
+ * 名字带__Host-前缀的cookie要求Secure、Path为"/"、没有Domain；带__Secure-前缀的要求Secure
+ * 浏览器会拒绝不满足要求的cookie，所以NewManager时就检查，不让错误的配置上线
+ */
+type CookieOptions struct {
+	Path        string        //默认"/"
+	Domain      string        //为空则只对当前host有效
+	Secure      bool          //只通过https发送
+	HttpOnly    bool          //脚本不能读取，默认true
+	SameSite    http.SameSite //默认Lax
+	SessionOnly bool          //不设置MaxAge，浏览器关闭后cookie即失效（服务端的有效期不变）
+}
+
+//默认的cookie属性
+func DefaultCookieOptions() CookieOptions {
+	return CookieOptions{Path: "/", HttpOnly: true, SameSite: http.SameSiteLaxMode}
+}
+
+//检查cookie名的前缀要求
+func (self CookieOptions) Validate(name string) error {
+	switch {
+	case strings.HasPrefix(name, "__Host-"):
+		if !self.Secure || self.Path != "/" || self.Domain != "" {
+			return fmt.Errorf("session: cookie %q requires Secure, Path \"/\" and no Domain", name)
+		}
+	case strings.HasPrefix(name, "__Secure-"):
+		if !self.Secure {
+			return fmt.Errorf("session: cookie %q requires Secure", name)
+		}
+	}
+	if self.SameSite == http.SameSiteNoneMode && !self.Secure {
+		return fmt.Errorf("session: cookie %q with SameSite=None requires Secure", name)
+	}
+	return nil
+}
+
+//按配置生成cookie，max_age<0表示删除
+func (self CookieOptions) Cookie(name, value string, max_age int) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     self.Path,
+		Domain:   self.Domain,
+		Secure:   self.Secure,
+		HttpOnly: self.HttpOnly,
+		SameSite: self.SameSite,
+	}
+	if max_age < 0 {
+		// MaxAge<0 means delete cookie now, equivalently 'Max-Age: 0'
+		cookie.MaxAge = -1
+		cookie.Expires = time.Unix(1, 0)
+	} else if !self.SessionOnly {
+		cookie.MaxAge = max_age
+	}
+	return cookie
+}
@@ -0,0 +1,153 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+/*
+ * 延迟写回：开启WithDeferredWrites之后，handler对session的修改先记在内存里，请求结束时一次性写回存储
+ * 1. 加载一次：第一次Get时用SessionValues读出全部的值，之后的Get都不再访问存储
+ * 2. 脏跟踪：Set/Delete只记录修改了哪些key，Set时就用manager的Codec编码，类型不支持等错误马上返回
+ * 3. 一次提交：Middleware在响应头写出之前（或者handler返回之后）调用Commit，没有用Middleware时调用session.Save(sess)；
+ *    SessionCommit把全部修改原子地写回，没有任何修改时什么都不写
+ * 没有提交的修改在请求结束之后就丢失了，所以不用Middleware的handler一定要调用Save
+ */
+type deferredSession struct {
+	session SessionV2    //storage返回的session，只用来取sid
+	storage BatchStorage //读写都直接通过storage进行
+	codec   Codec
+
+	lock   sync.Mutex
+	values map[string][]byte   //从存储中读出的值（编码后），nil表示还没有加载
+	set    map[string][]byte   //修改过的值（编码后）
+	del    map[string]struct{} //删除的key
+}
+
+//开启了延迟写回并且storage支持时，包装storage返回的session
+func (manager *SessionManager) deferWrites(sess SessionV2) SessionV2 {
+	if !manager.deferred {
+		return sess
+	}
+	batch, ok := manager.storager.(BatchStorage)
+	if !ok {
+		return sess
+	}
+	return &deferredSession{
+		session: sess,
+		storage: batch,
+		codec:   manager.codec,
+		set:     make(map[string][]byte),
+		del:     make(map[string]struct{}),
+	}
+}
+
+func deferredKey(key interface{}) (string, error) {
+	k, ok := key.(string)
+	if !ok {
+		return "", fmt.Errorf("%w: deferred session key must be string, got %T", ErrInvalidKey, key)
+	}
+	return k, nil
+}
+
+func (self *deferredSession) Set(ctx context.Context, key, value interface{}) error {
+	k, err := deferredKey(key)
+	if err != nil {
+		return err
+	}
+	data, err := self.codec.Encode(value)
+	if err != nil {
+		return err
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.set[k] = data
+	delete(self.del, k)
+	return nil
+}
+
+func (self *deferredSession) Get(ctx context.Context, key interface{}) (interface{}, error) {
+	k, err := deferredKey(key)
+	if err != nil {
+		return nil, err
+	}
+	self.lock.Lock()
+	data, ok := self.set[k]
+	if !ok {
+		if _, deleted := self.del[k]; deleted {
+			self.lock.Unlock()
+			return nil, nil
+		}
+		if self.values == nil {
+			//持有锁加载，同一个session的并发Get只加载一次
+			if self.values, err = self.storage.SessionValues(ctx, self.session.SessionID()); err != nil {
+				self.lock.Unlock()
+				return nil, err
+			}
+		}
+		data, ok = self.values[k]
+	}
+	self.lock.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	//每次都解码出新的值，和直接读存储的行为一致，修改取出来的值不会影响session
+	return self.codec.Decode(data)
+}
+
+func (self *deferredSession) Delete(ctx context.Context, key interface{}) error {
+	k, err := deferredKey(key)
+	if err != nil {
+		return err
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.set, k)
+	self.del[k] = struct{}{}
+	return nil
+}
+
+func (self *deferredSession) SessionID() string {
+	return self.session.SessionID()
+}
+
+//实现Committer：把攒下的修改一次写回，没有修改时什么都不做；失败时修改保留，可以再次提交
+func (self *deferredSession) Commit(ctx context.Context) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if len(self.set) == 0 && len(self.del) == 0 {
+		return nil
+	}
+	del := make([]string, 0, len(self.del))
+	for k := range self.del {
+		del = append(del, k)
+	}
+	if err := self.storage.SessionCommit(ctx, self.session.SessionID(), self.set, del); err != nil {
+		return err
+	}
+	if self.values != nil {
+		for k, v := range self.set {
+			self.values[k] = v
+		}
+		for k := range self.del {
+			delete(self.values, k)
+		}
+	}
+	self.set = make(map[string][]byte)
+	self.del = make(map[string]struct{})
+	return nil
+}
+
+//提交session的修改：开启了延迟写回时把攒下的修改写回存储，否则修改已经写回了，什么都不做
+//经过Middleware的请求会自动提交，不需要调用
+func Save(sess Session) error {
+	bound, ok := sess.(*boundSession)
+	if !ok {
+		return nil
+	}
+	if committer, ok := bound.session.(Committer); ok {
+		return committer.Commit(bound.ctx)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package session
+
+import (
+	"context"
+	"fmt"
+)
+
+/*
+ * 遍历session和按用户管理session，storage需要实现Enumerator/UserIndex，否则返回ErrNotSupported
+ * 内置的memory和redis存储都已实现
+ *
+ * 登录成功之后把session关联到用户上：
+ *   g_sessions.BindUser(sess, user_id)
+ * “退出我的所有设备”、“强制某个用户下线”：
+ *   n, err := g_sessions.DestroyUserSessions(ctx, user_id)
+ */
+
+//ListSessions的limit<=0时，一页的条数
+const default_list_limit = 100
+
+//把session关联到用户上，通常在登录成功、SessionRegenerate之后调用
+func (manager *SessionManager) BindUser(sess Session, user_id string) error {
+	index, ok := manager.storager.(UserIndex)
+	if !ok {
+		return fmt.Errorf("%w: storage %T has no user index", ErrNotSupported, manager.storager)
+	}
+	return index.SessionBindUser(sessionContext(sess), sess.SessionID(), user_id)
+}
+
+//用户所有存活的session的sid
+func (manager *SessionManager) UserSessions(ctx context.Context, user_id string) ([]string, error) {
+	index, ok := manager.storager.(UserIndex)
+	if !ok {
+		return nil, fmt.Errorf("%w: storage %T has no user index", ErrNotSupported, manager.storager)
+	}
+	return index.SessionsOfUser(ctx, user_id)
+}
+
+//销毁用户所有的session，返回销毁的个数
+//只删除服务端的条目，持有这些sid的客户端下次访问时会拿到新的session
+func (manager *SessionManager) DestroyUserSessions(ctx context.Context, user_id string) (int, error) {
+	sids, err := manager.UserSessions(ctx, user_id)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, sid := range sids {
+		manager.locks.Lock(sid)
+		err = manager.storager.SessionDestroy(ctx, sid)
+		manager.locks.Unlock(sid)
+		if err != nil {
+			return count, err
+		}
+		manager.hooks.destroyed(ctx, sid)
+		count++
+	}
+	return count, nil
+}
+
+//分页遍历存活的session，cursor为""表示从头开始，返回的next为""表示已经遍历完
+//
+//	for cursor := ""; ; {
+//	    sids, next, err := manager.ListSessions(ctx, cursor, 100)
+//	    ...
+//	    if next == "" { break }
+//	    cursor = next
+//	}
+func (manager *SessionManager) ListSessions(ctx context.Context, cursor string, limit int) ([]string, string, error) {
+	enumerator, ok := manager.storager.(Enumerator)
+	if !ok {
+		return nil, "", fmt.Errorf("%w: storage %T cannot enumerate sessions", ErrNotSupported, manager.storager)
+	}
+	if limit <= 0 {
+		limit = default_list_limit
+	}
+	return enumerator.SessionList(ctx, cursor, limit)
+}
+
+//存活的session数
+func (manager *SessionManager) CountSessions(ctx context.Context) (int, error) {
+	enumerator, ok := manager.storager.(Enumerator)
+	if !ok {
+		return 0, fmt.Errorf("%w: storage %T cannot enumerate sessions", ErrNotSupported, manager.storager)
+	}
+	return enumerator.SessionCount(ctx)
+}
+
+//handler拿到的session绑定着请求的context，其他实现没有时用context.Background()
+func sessionContext(sess Session) context.Context {
+	if bound, ok := sess.(*boundSession); ok {
+		return bound.ctx
+	}
+	return context.Background()
+}
@@ -0,0 +1,18 @@
+package session
+
+import (
+	"errors"
+)
+
+/*
+ * session包对外暴露的错误，调用方用errors.Is进行判断
+ * 具体storage实现返回的错误，应当用fmt.Errorf("%w")包装这些错误，而不是自己另起炉灶
+ */
+var (
+	ErrSessionNotFound    = errors.New("session: session not found")   //sid对应的条目不存在（或已过期）
+	ErrStorageUnavailable = errors.New("session: storage unavailable") //底层存储不可用，比如redis连不上
+	ErrValueTooLarge      = errors.New("session: value too large")     //写入的值超出了存储的限制
+	ErrNotSupported       = errors.New("session: not supported")       //storage没有实现对应的可选接口
+	ErrInvalidKey         = errors.New("session: invalid key")         //key的类型不被storage支持（比如redis只支持string），或者sid的格式不被storage接受
+	ErrTypeMismatch       = errors.New("session: type mismatch")       //取出的值不是期望的类型（GetAs、Key）
+)
@@ -0,0 +1,108 @@
+package session
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+/*
+ * 存储出错（比如redis挂了）时SessionStart的处理策略
+ * FailClosed：直接返回503，handler拿到error后应当直接return
+ * FailEphemeral：降级为一个只存在于本次请求中的匿名session，handler照常执行，只是数据不会被保存
+ * FailRedirect：重定向到指定的页面（比如一个“系统维护中”的页面），handler拿到error后应当直接return
+ */
+type FailurePolicy int
+
+const (
+	FailClosed FailurePolicy = iota
+	FailEphemeral
+	FailRedirect
+)
+
+//设置存储出错时的处理策略，redirect_url只对FailRedirect有效
+//FailRedirect的redirect_url必须是以/开头的路径或者带scheme和host的完整URL，否则返回错误，原来的策略不变
+func (manager *SessionManager) SetFailurePolicy(policy FailurePolicy, redirect_url string) error {
+	if policy == FailRedirect {
+		if err := checkRedirectUrl(redirect_url); err != nil {
+			return err
+		}
+	}
+	manager.failure_policy = policy
+	manager.redirect_url = redirect_url
+	return nil
+}
+
+//相对路径会按当前请求的路径解析，跳到哪里取决于出错的是哪个请求，所以不接受
+func checkRedirectUrl(redirect_url string) error {
+	u, err := url.Parse(redirect_url)
+	if err != nil {
+		return fmt.Errorf("session: invalid redirect url %q: %w", redirect_url, err)
+	}
+	if u.IsAbs() {
+		if u.Host == "" {
+			return fmt.Errorf("session: redirect url %q has no host", redirect_url)
+		}
+		return nil
+	}
+	//"//host/path"是省略了scheme的外部地址，也不接受
+	if !strings.HasPrefix(redirect_url, "/") || strings.HasPrefix(redirect_url, "//") {
+		return fmt.Errorf("session: redirect url %q must be an absolute path or url", redirect_url)
+	}
+	return nil
+}
+
+//按照策略处理SessionStart中的存储错误，返回值即为SessionStart的返回值
+func (manager *SessionManager) handleFailure(w http.ResponseWriter, r *http.Request, err error) (Session, error) {
+	switch manager.failure_policy {
+	case FailEphemeral:
+		manager.logger.Printf("session: storage failed, fall back to ephemeral session: %v", err)
+		sid, _ := manager.sessionId() //临时session的sid不会下发给客户端，生成失败也无所谓
+		return newEphemeralSession(sid), nil
+	case FailRedirect:
+		http.Redirect(w, r, manager.redirect_url, http.StatusFound)
+	default:
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+	}
+	return nil, err
+}
+
+/*
+ * 匿名的临时session，实现Session接口
+ * 数据只保存在这个对象里，不落存储，也不会给客户端下发cookie，请求结束即丢弃
+ */
+type ephemeralSession struct {
+	lock  sync.Mutex
+	sid   string
+	value map[interface{}]interface{}
+}
+
+func newEphemeralSession(sid string) *ephemeralSession {
+	return &ephemeralSession{sid: sid, value: make(map[interface{}]interface{})}
+}
+
+func (self *ephemeralSession) Set(key, value interface{}) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.value[key] = value
+	return nil
+}
+
+func (self *ephemeralSession) Get(key interface{}) interface{} {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.value[key]
+}
+
+func (self *ephemeralSession) Delete(key interface{}) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.value, key)
+	return nil
+}
+
+func (self *ephemeralSession) SessionID() string {
+	return self.sid
+}
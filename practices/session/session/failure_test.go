@@ -0,0 +1,155 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+//所有操作都失败的storage，模拟redis挂掉
+type downStorage struct{}
+
+func (downStorage) SessionInit(ctx context.Context, sid string) (SessionV2, error) {
+	return nil, ErrStorageUnavailable
+}
+
+func (downStorage) SessionFetch(ctx context.Context, sid string) (SessionV2, error) {
+	return nil, ErrStorageUnavailable
+}
+
+func (downStorage) SessionDestroy(ctx context.Context, sid string) error {
+	return ErrStorageUnavailable
+}
+
+func (downStorage) SessionGC(ctx context.Context, max_life_time int64) error {
+	return ErrStorageUnavailable
+}
+
+func newDownManager(t *testing.T) *SessionManager {
+	t.Helper()
+	manager, err := New(downStorage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manager
+}
+
+//没有cookie（新建）和带着cookie（读取）两条路径都要覆盖
+func outageRequests() map[string]*http.Request {
+	with_cookie := httptest.NewRequest("GET", "/", nil)
+	with_cookie.AddCookie(&http.Cookie{Name: default_cookie_name, Value: "some-sid"})
+	return map[string]*http.Request{
+		"new":   httptest.NewRequest("GET", "/", nil),
+		"fetch": with_cookie,
+	}
+}
+
+func TestOutageFailClosed(t *testing.T) {
+	manager := newDownManager(t)
+	for name, r := range outageRequests() {
+		w := httptest.NewRecorder()
+		sess, err := manager.SessionStart(w, r)
+		if !errors.Is(err, ErrStorageUnavailable) || sess != nil {
+			t.Errorf("%s: SessionStart = %v, %v, want ErrStorageUnavailable", name, sess, err)
+		}
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s: status %d, want 503", name, w.Code)
+		}
+		if h := w.Header().Get("Set-Cookie"); h != "" {
+			t.Errorf("%s: unexpected Set-Cookie %q", name, h)
+		}
+	}
+}
+
+func TestOutageFailRedirect(t *testing.T) {
+	manager := newDownManager(t)
+	if err := manager.SetFailurePolicy(FailRedirect, "/maintenance"); err != nil {
+		t.Fatal(err)
+	}
+	for name, r := range outageRequests() {
+		w := httptest.NewRecorder()
+		if _, err := manager.SessionStart(w, r); !errors.Is(err, ErrStorageUnavailable) {
+			t.Errorf("%s: err = %v, want ErrStorageUnavailable", name, err)
+		}
+		if w.Code != http.StatusFound || w.Header().Get("Location") != "/maintenance" {
+			t.Errorf("%s: got %d to %q, want 302 to /maintenance", name, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
+
+//FailRedirect不接受空的、相对的或者解析不了的地址，出错时原来的策略不变
+func TestFailRedirectInvalidUrl(t *testing.T) {
+	manager := newDownManager(t)
+	for _, u := range []string{"", "maintenance", "../maintenance", "//evil.example/x", "http://", "http://a b/", "/%zz"} {
+		if err := manager.SetFailurePolicy(FailRedirect, u); err == nil {
+			t.Errorf("redirect url %q accepted", u)
+		}
+	}
+	for _, u := range []string{"/", "/maintenance?from=session", "https://status.example.com/"} {
+		if err := manager.SetFailurePolicy(FailRedirect, u); err != nil {
+			t.Errorf("redirect url %q: %v", u, err)
+		}
+	}
+	manager.SetFailurePolicy(FailClosed, "")
+	manager.SetFailurePolicy(FailRedirect, "")
+	w := httptest.NewRecorder()
+	manager.SessionStart(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d after a rejected redirect url, want 503", w.Code)
+	}
+}
+
+func TestOutageFailEphemeral(t *testing.T) {
+	manager := newDownManager(t)
+	if err := manager.SetFailurePolicy(FailEphemeral, ""); err != nil {
+		t.Fatal(err)
+	}
+	for name, r := range outageRequests() {
+		w := httptest.NewRecorder()
+		sess, err := manager.SessionStart(w, r)
+		if err != nil {
+			t.Fatalf("%s: SessionStart: %v", name, err)
+		}
+		if err := sess.Set("k", "v"); err != nil {
+			t.Errorf("%s: Set: %v", name, err)
+		}
+		if v := sess.Get("k"); v != "v" {
+			t.Errorf("%s: Get = %v, want v", name, v)
+		}
+		if h := w.Header().Get("Set-Cookie"); h != "" {
+			t.Errorf("%s: ephemeral session issued a cookie %q", name, h)
+		}
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: status %d, handler should run normally", name, w.Code)
+		}
+	}
+}
+
+//存储出错时handleFailure写503，写响应会触发commit，不能和加载互相等待
+func TestOutageMiddleware(t *testing.T) {
+	manager := newDownManager(t)
+	called := false
+	handler := manager.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		if _, err := FromContext(r.Context()); err == nil {
+			t.Error("FromContext succeeded with storage down")
+		}
+	}))
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("middleware deadlocked loading the session")
+	}
+	if !called || w.Code != http.StatusServiceUnavailable {
+		t.Errorf("called %v, status %d, want handler called and 503", called, w.Code)
+	}
+}
@@ -0,0 +1,66 @@
+package session
+
+/*
+ * flash消息：只显示一次的提示，比如POST之后重定向，在下一个页面提示“登录成功”、“密码错误”
+ *   session.AddFlash(sess, "error", "密码错误")
+ *   http.Redirect(w, r, "/login", 302)
+ *   ...
+ *   msgs, _ := session.Flashes(sess, "error") //取出之后就从session中删除了
+ *
+ * 消息按分类（category）保存，取出一个分类不影响其他分类
+ * 所有分类放在session的同一个key下，值是map[string][]string，这个类型预先注册过，任何Codec、任何storage都能存取
+ * 取出和删除是两步操作，同一个session的两个请求同时取时，可能都取到同一条消息
+ */
+const flash_key = "_flash"
+
+//添加一条flash消息
+func AddFlash(sess Session, category, message string) error {
+	flashes, err := loadFlashes(sess)
+	if err != nil {
+		return err
+	}
+	//不修改取出来的值，memory存储里它可能还被别的请求引用着
+	updated := make(map[string][]string, len(flashes)+1)
+	for k, v := range flashes {
+		updated[k] = v
+	}
+	list := make([]string, 0, len(flashes[category])+1)
+	updated[category] = append(append(list, flashes[category]...), message)
+	return sess.Set(flash_key, updated)
+}
+
+//取出一个分类的全部flash消息，按添加的顺序，取出之后从session中删除；没有消息时返回nil
+func Flashes(sess Session, category string) ([]string, error) {
+	flashes, err := loadFlashes(sess)
+	if err != nil {
+		return nil, err
+	}
+	msgs, ok := flashes[category]
+	if !ok {
+		return nil, nil
+	}
+	if len(flashes) == 1 {
+		return msgs, sess.Delete(flash_key)
+	}
+	rest := make(map[string][]string, len(flashes)-1)
+	for k, v := range flashes {
+		if k != category {
+			rest[k] = v
+		}
+	}
+	return msgs, sess.Set(flash_key, rest)
+}
+
+//取出所有分类的flash消息，取出之后从session中删除；没有消息时返回nil
+func AllFlashes(sess Session) (map[string][]string, error) {
+	flashes, err := loadFlashes(sess)
+	if err != nil || len(flashes) == 0 {
+		return nil, err
+	}
+	return flashes, sess.Delete(flash_key)
+}
+
+func loadFlashes(sess Session) (map[string][]string, error) {
+	flashes, _, err := GetAs[map[string][]string](sess, flash_key)
+	return flashes, err
+}
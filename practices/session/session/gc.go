@@ -0,0 +1,133 @@
+package session
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+/*
+ * 后台GC
+ * 每隔interval（再加上[0, jitter)的随机时间）调用一次storage的SessionGC；
+ * 多个实例共用一个存储时，jitter让它们的GC错开，不会同时扫描
+ * GC不持有manager的任何锁，storage自己负责并发安全，遍历存储期间不会阻塞正常请求
+ *
+ * 用法：
+ *   manager.GCRunner().Start(ctx) //ctx结束或者调用Stop()之后停止
+ *   defer manager.GCRunner().Stop()
+ */
+type GCRunner struct {
+	manager *SessionManager
+
+	lock   sync.Mutex
+	cancel context.CancelFunc //正在运行时不为nil
+	done   chan struct{}      //后台goroutine退出时关闭
+	stats  GCStats
+}
+
+//GC的统计
+type GCStats struct {
+	Runs         uint64        //GC的次数
+	Expired      uint64        //累计删除的过期session数
+	Errors       uint64        //失败的次数
+	LastRun      time.Time     //最后一次GC的开始时间
+	LastExpired  int           //最后一次GC删除的过期session数
+	LastDuration time.Duration //最后一次GC的耗时
+	LastError    error         //最后一次GC的错误，成功时为nil
+}
+
+//manager的GC runner
+func (manager *SessionManager) GCRunner() *GCRunner {
+	return manager.gc
+}
+
+//启动后台GC，已经在运行时什么都不做
+//第一次GC在一个间隔之后进行，而不是启动时马上进行，避免多个实例同时重启时集中扫描
+func (self *GCRunner) Start(ctx context.Context) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.cancel != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	self.cancel, self.done = cancel, done
+	go self.loop(ctx, done)
+}
+
+//停止后台GC，等到正在进行的GC结束才返回；没有在运行时什么都不做
+func (self *GCRunner) Stop() {
+	self.lock.Lock()
+	cancel, done := self.cancel, self.done
+	self.cancel, self.done = nil, nil
+	self.lock.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+func (self *GCRunner) loop(ctx context.Context, done chan struct{}) {
+	defer close(done)
+	timer := time.NewTimer(self.next())
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			self.RunOnce(ctx)
+			timer.Reset(self.next())
+		}
+	}
+}
+
+//下一次GC之前等待的时间
+func (self *GCRunner) next() time.Duration {
+	interval := self.manager.gc_interval
+	if interval == 0 {
+		interval = time.Duration(self.manager.max_life_time) * time.Second
+	}
+	if jitter := self.manager.gc_jitter; jitter > 0 {
+		interval += time.Duration(rand.Int63n(int64(jitter)))
+	}
+	return interval
+}
+
+//马上进行一次GC，返回删除的过期session数（storage没有实现GCCounter时为0）
+func (self *GCRunner) RunOnce(ctx context.Context) (int, error) {
+	manager := self.manager
+	start := time.Now()
+	var expired int
+	var err error
+	if counter, ok := manager.storager.(GCCounter); ok {
+		expired, err = counter.SessionGCCount(ctx, manager.max_life_time)
+	} else {
+		err = manager.storager.SessionGC(ctx, manager.max_life_time)
+	}
+	if err != nil && ctx.Err() == nil {
+		manager.logger.Printf("session: gc failed: %v", err)
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.stats.Runs++
+	self.stats.Expired += uint64(expired)
+	if err != nil {
+		self.stats.Errors++
+	}
+	self.stats.LastRun = start
+	self.stats.LastExpired = expired
+	self.stats.LastDuration = time.Since(start)
+	self.stats.LastError = err
+	return expired, err
+}
+
+//GC的统计
+func (self *GCRunner) Stats() GCStats {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.stats
+}
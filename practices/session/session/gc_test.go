@@ -0,0 +1,100 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//每次GC都报告删除了expired个session的storage
+type gcStorage struct {
+	downStorage
+	expired int
+	runs    int64 //原子操作
+}
+
+func (self *gcStorage) SessionGCCount(ctx context.Context, max_life_time int64) (int, error) {
+	atomic.AddInt64(&self.runs, 1)
+	return self.expired, nil
+}
+
+//等到GC跑了至少n次
+func waitGCRuns(t *testing.T, storage *gcStorage, n int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&storage.runs) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("gc ran %d times, want %d", atomic.LoadInt64(&storage.runs), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestGCRunnerStartStop(t *testing.T) {
+	storage := &gcStorage{expired: 3}
+	manager, err := New(storage, WithGCInterval(5*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner := manager.GCRunner()
+	runner.Stop() //没有在运行时什么都不做
+	runner.Start(context.Background())
+	runner.Start(context.Background()) //已经在运行，不会启动第二个goroutine
+	waitGCRuns(t, storage, 2)
+	runner.Stop()
+
+	runs := atomic.LoadInt64(&storage.runs)
+	stats := runner.Stats()
+	if int64(stats.Runs) != runs {
+		t.Errorf("stats runs %d, storage saw %d", stats.Runs, runs)
+	}
+	if stats.Expired != 3*stats.Runs || stats.LastExpired != 3 {
+		t.Errorf("expired %d (last %d) after %d runs, want 3 per run", stats.Expired, stats.LastExpired, stats.Runs)
+	}
+	if stats.Errors != 0 || stats.LastError != nil || stats.LastRun.IsZero() {
+		t.Errorf("stats %+v", stats)
+	}
+	//Stop返回之后不会再有GC
+	time.Sleep(20 * time.Millisecond)
+	if n := atomic.LoadInt64(&storage.runs); n != runs {
+		t.Errorf("gc ran %d times after Stop", n-runs)
+	}
+
+	//可以重新启动；ctx结束时也会停止
+	ctx, cancel := context.WithCancel(context.Background())
+	runner.Start(ctx)
+	waitGCRuns(t, storage, runs+1)
+	runner.lock.Lock()
+	done := runner.done
+	runner.lock.Unlock()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("gc still running after ctx was canceled")
+	}
+	runner.Stop()
+	if stats := runner.Stats(); stats.Expired != 3*stats.Runs {
+		t.Errorf("expired %d after %d runs", stats.Expired, stats.Runs)
+	}
+}
+
+//storage没有实现GCCounter时只调用SessionGC，失败计入Errors
+func TestGCRunnerRunOnceError(t *testing.T) {
+	manager, err := New(downStorage{}, WithLogger(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := manager.GCRunner().RunOnce(context.Background())
+	if expired != 0 || !errors.Is(err, ErrStorageUnavailable) {
+		t.Errorf("RunOnce = %d, %v", expired, err)
+	}
+	stats := manager.GCRunner().Stats()
+	if stats.Runs != 1 || stats.Errors != 1 || !errors.Is(stats.LastError, ErrStorageUnavailable) || stats.Expired != 0 {
+		t.Errorf("stats %+v", stats)
+	}
+}
@@ -0,0 +1,118 @@
+package session
+
+import (
+	"context"
+	"sync"
+)
+
+/*
+ * session生命周期的钩子，用于审计登录、清理用户相关的资源、统计在线人数等
+ *   manager.OnCreate(func(ctx context.Context, sid string) { ... })
+ *   manager.OnExpire(func(sid string) { ... })
+ * 1. OnCreate：新建了session（包括严格模式下替换掉客户端带来的未知sid）
+ * 2. OnDestroy：SessionDestroy、DestroyUserSessions销毁了session
+ * 3. OnExpire：session过期被删除，由storage在GC或者访问时发现（storage需要实现EventReporter）
+ * 4. OnRegenerate：SessionRegenerate把session迁移到了新的sid
+ * 5. OnEvict：session还没过期，但storage因为容量限制把它淘汰了（比如内存存储的MaxSessions/MaxBytes），不算过期
+ * 钩子在触发事件的goroutine中同步调用，调用时不持有manager的锁，耗时的操作请自己另起goroutine
+ * 可以注册多个，按注册顺序调用；OnExpire和OnEvict没有对应的请求，所以没有ctx
+ */
+type hooks struct {
+	lock       sync.RWMutex
+	create     []func(ctx context.Context, sid string)
+	destroy    []func(ctx context.Context, sid string)
+	expire     []func(sid string)
+	regenerate []func(ctx context.Context, old_sid, new_sid string)
+	evict      []func(sid string)
+}
+
+//新建session时调用
+func (manager *SessionManager) OnCreate(fn func(ctx context.Context, sid string)) {
+	manager.hooks.lock.Lock()
+	defer manager.hooks.lock.Unlock()
+	manager.hooks.create = append(manager.hooks.create, fn)
+}
+
+//销毁session时调用
+func (manager *SessionManager) OnDestroy(fn func(ctx context.Context, sid string)) {
+	manager.hooks.lock.Lock()
+	defer manager.hooks.lock.Unlock()
+	manager.hooks.destroy = append(manager.hooks.destroy, fn)
+}
+
+//session过期被删除时调用
+func (manager *SessionManager) OnExpire(fn func(sid string)) {
+	manager.hooks.lock.Lock()
+	defer manager.hooks.lock.Unlock()
+	manager.hooks.expire = append(manager.hooks.expire, fn)
+}
+
+//session换sid时调用
+func (manager *SessionManager) OnRegenerate(fn func(ctx context.Context, old_sid, new_sid string)) {
+	manager.hooks.lock.Lock()
+	defer manager.hooks.lock.Unlock()
+	manager.hooks.regenerate = append(manager.hooks.regenerate, fn)
+}
+
+//session因为容量限制被淘汰时调用
+func (manager *SessionManager) OnEvict(fn func(sid string)) {
+	manager.hooks.lock.Lock()
+	defer manager.hooks.lock.Unlock()
+	manager.hooks.evict = append(manager.hooks.evict, fn)
+}
+
+func (self *hooks) created(ctx context.Context, sid string) {
+	self.lock.RLock()
+	fns := self.create
+	self.lock.RUnlock()
+	for _, fn := range fns {
+		fn(ctx, sid)
+	}
+}
+
+func (self *hooks) destroyed(ctx context.Context, sid string) {
+	self.lock.RLock()
+	fns := self.destroy
+	self.lock.RUnlock()
+	for _, fn := range fns {
+		fn(ctx, sid)
+	}
+}
+
+func (self *hooks) expired(sid string) {
+	self.lock.RLock()
+	fns := self.expire
+	self.lock.RUnlock()
+	for _, fn := range fns {
+		fn(sid)
+	}
+}
+
+func (self *hooks) regenerated(ctx context.Context, old_sid, new_sid string) {
+	self.lock.RLock()
+	fns := self.regenerate
+	self.lock.RUnlock()
+	for _, fn := range fns {
+		fn(ctx, old_sid, new_sid)
+	}
+}
+
+func (self *hooks) evicted(sid string) {
+	self.lock.RLock()
+	fns := self.evict
+	self.lock.RUnlock()
+	for _, fn := range fns {
+		fn(sid)
+	}
+}
+
+//交给EventReporter的回调
+func (self *hooks) events() StorageEvents {
+	return StorageEvents{
+		Created:     self.created,
+		Destroyed:   self.destroyed,
+		Expired:     self.expired,
+		Regenerated: self.regenerated,
+		Evicted:     self.evicted,
+	}
+}
@@ -0,0 +1,77 @@
+package session_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/hq-cml/GoHttpWeb/practices/session/session"
+	"github.com/hq-cml/GoHttpWeb/practices/session/session/storages"
+)
+
+//内存存储因为容量限制淘汰的session触发OnEvict，不触发OnExpire和OnDestroy
+func TestHooksEvict(t *testing.T) {
+	var on_evict []string
+	storage := storages.NewMemStorage(storages.MemOptions{MaxSessions: 1, OnEvict: func(sid string) { on_evict = append(on_evict, sid) }})
+	manager, err := session.New(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+	var evicted, other []string
+	manager.OnEvict(func(sid string) { evicted = append(evicted, sid) })
+	manager.OnExpire(func(sid string) { other = append(other, "expire "+sid) })
+	manager.OnDestroy(func(ctx context.Context, sid string) { other = append(other, "destroy "+sid) })
+
+	var sids []string
+	for i := 0; i < 3; i++ {
+		sess, err := manager.SessionStart(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sids = append(sids, sess.SessionID())
+	}
+	if want := sids[:2]; !reflect.DeepEqual(evicted, want) {
+		t.Errorf("OnEvict got %v, want %v", evicted, want)
+	}
+	//MemOptions.OnEvict依然会被调用
+	if !reflect.DeepEqual(on_evict, evicted) {
+		t.Errorf("MemOptions.OnEvict got %v, want %v", on_evict, evicted)
+	}
+	if other != nil {
+		t.Errorf("eviction fired other hooks: %v", other)
+	}
+}
+
+//DestroyUserSessions对每个session只触发一次OnDestroy
+func TestHooksDestroyUserSessions(t *testing.T) {
+	manager, err := session.New(storages.NewMemStorage(storages.MemOptions{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+	destroyed := map[string]int{}
+	manager.OnDestroy(func(ctx context.Context, sid string) { destroyed[sid]++ })
+	for i := 0; i < 2; i++ {
+		sess, err := manager.SessionStart(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := manager.BindUser(sess, "tom"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := manager.DestroyUserSessions(context.Background(), "tom")
+	if n != 2 || err != nil {
+		t.Fatalf("DestroyUserSessions = %d, %v", n, err)
+	}
+	if len(destroyed) != 2 {
+		t.Errorf("OnDestroy fired for %d sessions, want 2", len(destroyed))
+	}
+	for sid, count := range destroyed {
+		if count != 1 {
+			t.Errorf("OnDestroy fired %d times for %s", count, sid)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package session
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+//分段锁的段数，sid按hash落到其中一段
+const lock_stripes = 256
+
+/*
+ * 按sid分段的锁
+ * 以前manager用一把全局锁串行化所有请求，一次慢的redis调用会卡住整个服务器；
+ * 现在只有hash到同一段的sid才会互相等待，不同用户的请求基本上可以并行
+ * 新生成的sid是全局唯一的，不会和别的请求冲突，不需要加锁
+ */
+type stripedLock struct {
+	stripes [lock_stripes]sync.Mutex
+}
+
+func (self *stripedLock) stripe(sid string) int {
+	h := fnv.New32a()
+	h.Write([]byte(sid))
+	return int(h.Sum32() % lock_stripes)
+}
+
+//锁住sid所在的段
+func (self *stripedLock) Lock(sid string) {
+	self.stripes[self.stripe(sid)].Lock()
+}
+
+func (self *stripedLock) Unlock(sid string) {
+	self.stripes[self.stripe(sid)].Unlock()
+}
+
+//同时锁住两个sid所在的段，按段号从小到大加锁，避免死锁；两个sid在同一段时只加一次锁
+func (self *stripedLock) Lock2(sid1, sid2 string) {
+	i, j := self.stripe(sid1), self.stripe(sid2)
+	if i > j {
+		i, j = j, i
+	}
+	self.stripes[i].Lock()
+	if i != j {
+		self.stripes[j].Lock()
+	}
+}
+
+func (self *stripedLock) Unlock2(sid1, sid2 string) {
+	i, j := self.stripe(sid1), self.stripe(sid2)
+	if i != j {
+		self.stripes[j].Unlock()
+	}
+	self.stripes[i].Unlock()
+}
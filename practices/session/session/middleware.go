@@ -0,0 +1,173 @@
+package session
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+ * net/http中间件：handler不再自己调用SessionStart，而是用FromContext(r.Context())取session
+ *   http.Handle("/", manager.Middleware(handler))
+ * 1. 懒加载：handler第一次调用FromContext时才去存储里取session，不用session的请求（比如静态文件）不会访问存储
+ * 2. session保存在请求的context中，同一个请求里多次FromContext拿到的是同一个session
+ * 3. 提交：session实现了Committer时（比如开启了WithDeferredWrites），在响应头写出之前和handler返回之后调用Commit，
+ *    把攒下的修改写回存储
+ *
+ * session的cookie是通过响应头下发的，所以第一次FromContext要在handler写响应体之前
+ */
+type ctxKey struct{}
+
+//请求context中没有session（handler没有被Middleware包装）
+var ErrNoSession = errors.New("session: no session in context (forgotten Middleware?)")
+
+/*
+ * 可选接口：把修改攒起来、最后一次性写回存储的session
+ * Middleware在响应头写出之前和handler返回之后调用Commit，可能调用多次，没有新的修改时应当什么都不做
+ */
+type Committer interface {
+	Commit(ctx context.Context) error
+}
+
+//懒加载的session，保存在请求的context中
+type lazySession struct {
+	manager *SessionManager
+	w       http.ResponseWriter
+	r       *http.Request
+
+	//加载时会写响应（下发cookie，或者存储出错时写503），写响应又会触发commit，
+	//所以加载由单独的load_lock串行化，调用SessionStart时不持有保护状态的lock
+	load_lock sync.Mutex
+	lock      sync.Mutex
+	loaded    bool
+	fresh     bool //session已经被销毁，下次加载时不能再用请求中带来的sid
+	sess      Session
+	err       error
+	//Middleware里层的RewriteURLs，见findRewriteWriter；下发sid时可能正持有lock（比如commit），所以不用lock保护
+	rw atomic.Pointer[rewriteWriter]
+}
+
+func (self *lazySession) load() (Session, error) {
+	self.load_lock.Lock()
+	defer self.load_lock.Unlock()
+	self.lock.Lock()
+	loaded, fresh := self.loaded, self.fresh
+	self.lock.Unlock()
+	if !loaded {
+		var sess Session
+		var err error
+		if fresh {
+			sess, err = self.manager.sessionRestart(self.w, self.r)
+		} else {
+			sess, err = self.manager.SessionStart(self.w, self.r)
+		}
+		self.lock.Lock()
+		self.sess, self.err, self.loaded, self.fresh = sess, err, true, false
+		self.lock.Unlock()
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.sess, self.err
+}
+
+//SessionRegenerate/SessionDestroy之后，context中的session要跟着换掉
+//sess为nil表示session已经被销毁，下次FromContext时新建一个，而不是按请求中旧的sid重新加载
+func (self *lazySession) replace(sess Session) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.sess, self.err, self.loaded, self.fresh = sess, nil, sess != nil, sess == nil
+}
+
+//提交session的修改，没有加载过session时什么都不做
+func (self *lazySession) commit() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.loaded || self.sess == nil {
+		return
+	}
+	if err := Save(self.sess); err != nil {
+		self.manager.logger.Printf("session: commit failed: %v", err)
+	}
+}
+
+//中间件，见文件开头的说明
+func (manager *SessionManager) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lazy := &lazySession{manager: manager}
+		cw := &commitWriter{ResponseWriter: w, lazy: lazy}
+		r = r.WithContext(context.WithValue(r.Context(), ctxKey{}, lazy))
+		lazy.w, lazy.r = cw, r
+		next.ServeHTTP(cw, r)
+		lazy.commit()
+	})
+}
+
+//取出请求的session，第一次调用时才真正加载
+//返回error时和SessionStart一样，响应已经按failure_policy写好了，handler应当直接return
+//没有经过Middleware的请求返回ErrNoSession
+func FromContext(ctx context.Context) (Session, error) {
+	lazy, ok := ctx.Value(ctxKey{}).(*lazySession)
+	if !ok {
+		return nil, ErrNoSession
+	}
+	return lazy.load()
+}
+
+func lazyFromContext(ctx context.Context) *lazySession {
+	lazy, _ := ctx.Value(ctxKey{}).(*lazySession)
+	return lazy
+}
+
+/*
+ * 在响应头写出之前提交session的ResponseWriter
+ * 提交可能还要设置cookie（比如cookie存储），响应头一旦写出就来不及了；
+ * 响应头写出之后的修改由handler返回之后的那次提交写回
+ */
+type commitWriter struct {
+	http.ResponseWriter
+	lazy  *lazySession
+	wrote bool //响应头已经写出
+}
+
+//第一次写响应之前提交
+func (self *commitWriter) before() {
+	if !self.wrote {
+		self.wrote = true
+		self.lazy.commit()
+	}
+}
+
+func (self *commitWriter) WriteHeader(status int) {
+	self.before()
+	self.ResponseWriter.WriteHeader(status)
+}
+
+func (self *commitWriter) Write(b []byte) (int, error) {
+	self.before()
+	return self.ResponseWriter.Write(b)
+}
+
+func (self *commitWriter) Flush() {
+	self.before()
+	if flusher, ok := self.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (self *commitWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	self.before()
+	hijacker, ok := self.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, ErrNotSupported
+	}
+	return hijacker.Hijack()
+}
+
+//给http.ResponseController和其他包装用，取出被包装的ResponseWriter
+func (self *commitWriter) Unwrap() http.ResponseWriter {
+	return self.ResponseWriter
+}
@@ -0,0 +1,151 @@
+package session_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/hq-cml/GoHttpWeb/practices/session/session"
+	"github.com/hq-cml/GoHttpWeb/practices/session/session/storages"
+)
+
+func sidCookie(w *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == name && c.Value != "" {
+			return c
+		}
+	}
+	return nil
+}
+
+//SessionDestroy之后再FromContext，不能按请求中旧的sid把session重新建出来
+func TestMiddlewareDestroyThenReload(t *testing.T) {
+	storage := storages.NewMemStorage(storages.MemOptions{})
+	manager, err := session.New(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+
+	w := httptest.NewRecorder()
+	first, err := manager.SessionStart(w, httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old_sid := first.SessionID()
+	old := sidCookie(w, "GOSESSID")
+	if old == nil {
+		t.Fatal("no session cookie issued")
+	}
+
+	var new_sid string
+	handler := manager.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := session.FromContext(r.Context()); err != nil {
+			t.Fatal(err)
+		}
+		manager.SessionDestroy(w, r)
+		sess, err := session.FromContext(r.Context())
+		if err != nil {
+			t.Fatal(err)
+		}
+		new_sid = sess.SessionID()
+		sess.Set("k", "v")
+	}))
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(old)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if new_sid == "" || new_sid == old_sid {
+		t.Fatalf("session after destroy has sid %q, old sid %q", new_sid, old_sid)
+	}
+	if _, err := storage.SessionFetch(context.Background(), old_sid); err == nil {
+		t.Error("destroyed sid was created again")
+	}
+	if c := sidCookie(w, "GOSESSID"); c == nil || c.Value == old.Value {
+		t.Errorf("cookie %v, want a new sid", c)
+	}
+}
+
+//cookie存储：销毁之后重新开始的session里不能带着旧cookie中的数据
+func TestMiddlewareDestroyThenReloadCookie(t *testing.T) {
+	storage, err := storages.NewCookieStorage(storages.CookieStorageOptions{Keys: [][]byte{[]byte(strings.Repeat("k", 32))}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager, err := session.New(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+
+	handler := manager.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sess, err := session.FromContext(r.Context())
+		if err != nil {
+			t.Fatal(err)
+		}
+		sess.Set("user", "tom")
+	}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	old := sidCookie(w, "GOSESSID")
+	if old == nil {
+		t.Fatal("no session cookie issued")
+	}
+
+	handler = manager.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		manager.SessionDestroy(w, r)
+		sess, err := session.FromContext(r.Context())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := sess.Get("user"); v != nil {
+			t.Errorf("value from the destroyed session: %v", v)
+		}
+	}))
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(old)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+}
+
+//URL重写和Middleware的两种嵌套顺序，新下发的sid都要写进页面里的链接
+func TestRewriteURLsWithMiddleware(t *testing.T) {
+	storage := storages.NewMemStorage(storages.MemOptions{})
+	manager, err := session.New(storage, session.WithSidTransport(session.URLRewriteTransport{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+
+	var sid string
+	page := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sess, err := session.FromContext(r.Context())
+		if err != nil {
+			t.Fatal(err)
+		}
+		sid = sess.SessionID()
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<a href="/next">next</a>`))
+	})
+	nestings := map[string]http.Handler{
+		"Middleware(RewriteURLs(h))": manager.Middleware(manager.RewriteURLs(page)),
+		"RewriteURLs(Middleware(h))": manager.RewriteURLs(manager.Middleware(page)),
+	}
+	for desc, handler := range nestings {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		want := `<a href="/next?GOSESSID=` + url.QueryEscape(sid) + `">next</a>`
+		if body := w.Body.String(); body != want {
+			t.Errorf("%s: new session: body %s, want %s", desc, body, want)
+		}
+		//带着sid的请求，沿用请求中的sid
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/?GOSESSID="+url.QueryEscape(sid), nil))
+		if body := w.Body.String(); body != want {
+			t.Errorf("%s: existing session: body %s, want %s", desc, body, want)
+		}
+	}
+}
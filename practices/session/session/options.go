@@ -0,0 +1,247 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+)
+
+/*
+ * New的配置项，用法：
+ *   manager, err := session.New(storage,
+ *       session.WithCookieName("GOSESSID"),
+ *       session.WithIdleTimeout(30*time.Minute),
+ *       session.WithAbsoluteTimeout(12*time.Hour),
+ *   )
+ * 时间都用time.Duration表示，不再有“max_life_time是秒还是纳秒”的歧义；storage内部仍然按秒计算，不足一秒的部分被舍去
+ */
+type Option func(manager *SessionManager)
+
+const (
+	default_cookie_name   = "GOSESSID"
+	default_max_life_time = 3600 //默认空闲超时（秒）
+)
+
+//cookie名（或者其他传递方式下的参数名），默认GOSESSID
+func WithCookieName(name string) Option {
+	return func(manager *SessionManager) {
+		manager.cookie_name = name
+	}
+}
+
+//空闲超时：session超过这么久没有被访问就失效，每次访问都会重新计时，默认1小时
+func WithIdleTimeout(d time.Duration) Option {
+	return func(manager *SessionManager) {
+		manager.max_life_time = int64(d / time.Second)
+	}
+}
+
+//绝对超时：从session创建开始算，不论是否活跃，超过这么久都要失效，0表示不限制
+//需要storage实现AbsoluteTimeoutAware，否则New返回ErrNotSupported
+func WithAbsoluteTimeout(d time.Duration) Option {
+	return func(manager *SessionManager) {
+		manager.absolute_timeout = int64(d / time.Second)
+	}
+}
+
+//GC的间隔，默认和空闲超时相同
+func WithGCInterval(d time.Duration) Option {
+	return func(manager *SessionManager) {
+		manager.gc_interval = d
+	}
+}
+
+//GC间隔的随机抖动，每次GC之前多等待[0, d)的随机时间，默认0
+func WithGCJitter(d time.Duration) Option {
+	return func(manager *SessionManager) {
+		manager.gc_jitter = d
+	}
+}
+
+//sid的生成函数，默认是32字节的随机数做base64；生成的sid要足够长、足够随机，否则可以被猜到
+//sid里不能有'.'（cookie里用它分隔sid和下发时间），生成这样的sid时SessionStart返回错误
+func WithSidGenerator(generator func() (string, error)) Option {
+	return func(manager *SessionManager) {
+		manager.sid_generator = generator
+	}
+}
+
+//值的序列化方式，默认GobCodec
+func WithCodec(codec Codec) Option {
+	return func(manager *SessionManager) {
+		manager.codec = codec
+	}
+}
+
+//日志输出，默认使用log包的标准logger
+func WithLogger(logger *log.Logger) Option {
+	return func(manager *SessionManager) {
+		manager.logger = logger
+	}
+}
+
+//cookie的属性，默认DefaultCookieOptions()
+func WithCookieOptions(opts CookieOptions) Option {
+	return func(manager *SessionManager) {
+		manager.cookie_opts = opts
+	}
+}
+
+//sid的传递方式，默认使用带着cookie属性的CookieTransport
+//传入没有设置Options的CookieTransport{}时，使用WithCookieOptions的配置；设置了Options的，同样要满足cookie名的前缀要求
+func WithSidTransport(transport SidTransport) Option {
+	return func(manager *SessionManager) {
+		manager.transport = transport
+	}
+}
+
+//延迟写回：请求中对session的修改攒在内存里，请求结束时一次写回，没有修改时不写，见deferred.go
+//需要storage实现BatchStorage，否则New返回ErrNotSupported；不使用Middleware时要自己调用session.Save
+func WithDeferredWrites() Option {
+	return func(manager *SessionManager) {
+		manager.deferred = true
+	}
+}
+
+/*
+ * 有效期、Codec、事件回调这些配置是manager下发给storage的，交给New的storage实例同时只能属于一个manager，
+ * 否则后创建的manager会把前一个的配置覆盖掉。需要多个manager时，为每个manager创建各自的storage实例；
+ * manager不再使用时调用Close，storage就可以交给新的manager
+ * NewManager按名字取出的注册的storage例外：为了兼容以前的用法，同一个名字可以创建多个manager，后创建的配置生效
+ */
+var (
+	g_attached_lock sync.Mutex
+	g_attached      = make(map[StorageV2]*SessionManager)
+)
+
+//storage是否保存了manager下发的配置；不可比较的类型无法记录，也没法在不同的manager之间共享状态
+func configurable(storager StorageV2) bool {
+	if !reflect.TypeOf(storager).Comparable() {
+		return false
+	}
+	switch storager.(type) {
+	case LifeTimeAware, AbsoluteTimeoutAware, CodecAware, EventReporter:
+		return true
+	}
+	return false
+}
+
+//NewManager使用的注册的storage，不归到manager名下，见attach
+func sharedStorage() Option {
+	return func(manager *SessionManager) {
+		manager.shared = true
+	}
+}
+
+//把storage归到manager名下，已经属于别的manager时返回错误
+func (manager *SessionManager) attach() error {
+	if manager.shared || !configurable(manager.storager) {
+		return nil
+	}
+	g_attached_lock.Lock()
+	defer g_attached_lock.Unlock()
+	if owner, ok := g_attached[manager.storager]; ok && owner != manager {
+		return fmt.Errorf("session: storage %T is already used by another manager, create a separate instance for each manager", manager.storager)
+	}
+	g_attached[manager.storager] = manager
+	return nil
+}
+
+//CookieTransport没有设置Options时换成manager检查过的cookie属性，设置了的也要检查，其他传递方式原样返回
+func (manager *SessionManager) cookieTransport(transport SidTransport) (SidTransport, error) {
+	cookie, ok := transport.(CookieTransport)
+	if !ok {
+		return transport, nil
+	}
+	if cookie.Options == (CookieOptions{}) {
+		return CookieTransport{Options: manager.cookie_opts}, nil
+	}
+	if err := cookie.Options.Validate(manager.cookie_name); err != nil {
+		return nil, err
+	}
+	return cookie, nil
+}
+
+//关闭管理器：停止后台GC，释放storage，之后storage可以交给新的manager；storage本身不会被关闭
+func (manager *SessionManager) Close() {
+	manager.gc.Stop()
+	if !configurable(manager.storager) {
+		return
+	}
+	g_attached_lock.Lock()
+	defer g_attached_lock.Unlock()
+	if g_attached[manager.storager] == manager {
+		delete(g_attached, manager.storager)
+	}
+}
+
+//创建管理器，直接使用传入的storage实例，不需要先注册
+//老接口的Storage实现用AdaptStorage包装之后传入；一个storage实例同时只能交给一个manager
+func New(storager StorageV2, opts ...Option) (*SessionManager, error) {
+	if storager == nil {
+		return nil, errors.New("session: New with nil storage")
+	}
+	manager := &SessionManager{
+		storager:      storager,
+		cookie_name:   default_cookie_name,
+		cookie_opts:   DefaultCookieOptions(),
+		max_life_time: default_max_life_time,
+		sid_generator: randomSid,
+		codec:         GobCodec{},
+		logger:        log.Default(),
+	}
+	for _, opt := range opts {
+		opt(manager)
+	}
+	if manager.cookie_name == "" {
+		return nil, errors.New("session: empty cookie name")
+	}
+	if manager.max_life_time <= 0 {
+		return nil, fmt.Errorf("session: idle timeout must be at least one second")
+	}
+	if manager.absolute_timeout < 0 {
+		return nil, fmt.Errorf("session: negative absolute timeout")
+	}
+	if manager.gc_interval < 0 || manager.gc_jitter < 0 {
+		return nil, fmt.Errorf("session: negative gc interval or jitter")
+	}
+	if manager.sid_generator == nil || manager.codec == nil || manager.logger == nil {
+		return nil, errors.New("session: nil sid generator, codec or logger")
+	}
+	if err := manager.cookie_opts.Validate(manager.cookie_name); err != nil {
+		return nil, err
+	}
+	if manager.transport == nil {
+		manager.transport = CookieTransport{}
+	}
+	transport, err := manager.cookieTransport(manager.transport)
+	if err != nil {
+		return nil, err
+	}
+	manager.transport = transport
+	if _, ok := storager.(AbsoluteTimeoutAware); !ok && manager.absolute_timeout > 0 {
+		return nil, fmt.Errorf("%w: storage %T does not track session creation time, absolute timeout unavailable", ErrNotSupported, storager)
+	}
+	if _, ok := storager.(BatchStorage); !ok && manager.deferred {
+		return nil, fmt.Errorf("%w: storage %T cannot commit a session in one batch, deferred writes unavailable", ErrNotSupported, storager)
+	}
+	//检查全部通过之后才修改storage，New失败时storage保持原样
+	if err := manager.attach(); err != nil {
+		return nil, err
+	}
+	manager.gc = &GCRunner{manager: manager}
+	if aware, ok := storager.(LifeTimeAware); ok {
+		aware.SetMaxLifeTime(manager.max_life_time)
+	}
+	if aware, ok := storager.(AbsoluteTimeoutAware); ok {
+		aware.SetAbsoluteTimeout(manager.absolute_timeout)
+	}
+	if reporter, ok := storager.(EventReporter); ok {
+		reporter.SetEvents(manager.hooks.events())
+	}
+	manager.SetCodec(manager.codec)
+	return manager, nil
+}
@@ -0,0 +1,163 @@
+package session
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+//记录manager下发的有效期的storage
+type lifeTimeStorage struct {
+	downStorage
+	max_life_time int64
+}
+
+func (self *lifeTimeStorage) SetMaxLifeTime(max_life_time int64) {
+	self.max_life_time = max_life_time
+}
+
+func TestNewRefusesSharedStorage(t *testing.T) {
+	storage := &lifeTimeStorage{}
+	first, err := New(storage, WithIdleTimeout(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//第二个manager不能把第一个的配置覆盖掉
+	if _, err := New(storage, WithIdleTimeout(time.Minute)); err == nil {
+		t.Fatal("second manager on the same storage accepted")
+	}
+	if storage.max_life_time != 3600 {
+		t.Errorf("max_life_time %d, want 3600", storage.max_life_time)
+	}
+	//Close之后可以交给新的manager
+	first.Close()
+	if _, err := New(storage, WithIdleTimeout(time.Minute)); err != nil {
+		t.Fatalf("New after Close: %v", err)
+	}
+	if storage.max_life_time != 60 {
+		t.Errorf("max_life_time %d, want 60", storage.max_life_time)
+	}
+}
+
+//New失败时不能已经改了storage
+func TestNewFailureLeavesStorageAlone(t *testing.T) {
+	storage := &lifeTimeStorage{max_life_time: 42}
+	_, err := New(storage, WithIdleTimeout(time.Hour), WithAbsoluteTimeout(time.Hour))
+	if !errors.Is(err, ErrNotSupported) {
+		t.Fatalf("absolute timeout on a storage without creation time: %v, want ErrNotSupported", err)
+	}
+	if storage.max_life_time != 42 {
+		t.Errorf("failed New changed max_life_time to %d", storage.max_life_time)
+	}
+	//失败的New也没有占用storage
+	if _, err := New(storage); err != nil {
+		t.Errorf("New after a failed New: %v", err)
+	}
+}
+
+//NewManager按名字取的注册的storage，和以前一样可以创建多个manager，后创建的配置生效
+func TestNewManagerSharesRegisteredStorage(t *testing.T) {
+	storage := &lifeTimeStorage{}
+	RegisterV2("shared_test", storage)
+	defer delete(g_storages, "shared_test")
+	first, err := NewManager("shared_test", "GOSESSID", 3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewManager("shared_test", "GOSESSID", 60)
+	if err != nil {
+		t.Fatalf("second NewManager on a registered storage: %v", err)
+	}
+	defer second.Close()
+	if storage.max_life_time != 60 {
+		t.Errorf("max_life_time %d, want 60 from the last manager", storage.max_life_time)
+	}
+	//关掉其中一个之后，还可以继续用这个名字创建
+	first.Close()
+	if _, err := NewManager("shared_test", "GOSESSID", 120); err != nil {
+		t.Errorf("NewManager after Close: %v", err)
+	}
+}
+
+//不保存配置的storage可以共享
+func TestNewStatelessStorageShared(t *testing.T) {
+	for i := 0; i < 2; i++ {
+		manager, err := New(downStorage{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer manager.Close()
+	}
+}
+
+//__Host-/__Secure-前缀的cookie，浏览器会拒绝不满足要求的配置，New时就要报错
+func TestNewValidatesCookiePrefix(t *testing.T) {
+	secure := DefaultCookieOptions()
+	secure.Secure = true
+	with_domain, sub_path, none := secure, secure, DefaultCookieOptions()
+	with_domain.Domain = "example.com"
+	sub_path.Path = "/app"
+	none.SameSite = http.SameSiteNoneMode
+	cases := []struct {
+		name string
+		opts CookieOptions
+		ok   bool
+	}{
+		{"__Host-sid", DefaultCookieOptions(), false},
+		{"__Host-sid", secure, true},
+		{"__Host-sid", with_domain, false},
+		{"__Host-sid", sub_path, false},
+		{"__Secure-sid", DefaultCookieOptions(), false},
+		{"__Secure-sid", with_domain, true},
+		{"sid", none, false},
+		{"sid", DefaultCookieOptions(), true},
+	}
+	for _, c := range cases {
+		_, err := New(downStorage{}, WithCookieName(c.name), WithCookieOptions(c.opts))
+		if (err == nil) != c.ok {
+			t.Errorf("%s with %+v: err %v, want ok %v", c.name, c.opts, err, c.ok)
+		}
+		//Options写在CookieTransport上的，一样要检查（manager自己的cookie属性是合格的）
+		_, err = New(downStorage{}, WithCookieName(c.name), WithCookieOptions(secure), WithSidTransport(CookieTransport{Options: c.opts}))
+		if (err == nil) != c.ok {
+			t.Errorf("%s with transport options %+v: err %v, want ok %v", c.name, c.opts, err, c.ok)
+		}
+	}
+	RegisterV2("prefix_test", downStorage{})
+	defer delete(g_storages, "prefix_test")
+	if _, err := NewManager("prefix_test", "__Host-sid", 60); err == nil {
+		t.Error("NewManager accepted __Host- cookie without Secure")
+	}
+	if _, err := NewManager("prefix_test", "__Host-sid", 60, secure); err != nil {
+		t.Errorf("NewManager with valid __Host- options: %v", err)
+	}
+}
+
+//WithSidTransport(CookieTransport{})下发的cookie要带着WithCookieOptions的属性
+func TestCookieTransportUsesManagerOptions(t *testing.T) {
+	opts := DefaultCookieOptions()
+	opts.Secure = true
+	opts.SameSite = http.SameSiteStrictMode
+	manager, err := New(downStorage{}, WithCookieName("__Host-sid"), WithCookieOptions(opts), WithSidTransport(CookieTransport{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//SetSidTransport也一样
+	manager.SetSidTransport(CookieTransport{})
+	w := httptest.NewRecorder()
+	manager.transport.IssueSid(w, httptest.NewRequest("GET", "/", nil), manager.cookie_name, "abc", 60)
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("got %d cookies", len(cookies))
+	}
+	if c := cookies[0]; !c.Secure || !c.HttpOnly || c.Path != "/" || c.SameSite != http.SameSiteStrictMode {
+		t.Errorf("cookie %+v does not carry the manager's options", c)
+	}
+	//不满足前缀要求的Options不会替换掉原来的传递方式
+	manager.SetSidTransport(CookieTransport{Options: DefaultCookieOptions()})
+	if transport := manager.transport.(CookieTransport); !transport.Options.Secure {
+		t.Error("SetSidTransport accepted options without Secure for a __Host- cookie")
+	}
+}
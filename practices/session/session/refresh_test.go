@@ -0,0 +1,75 @@
+package session_test
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hq-cml/GoHttpWeb/practices/session/session"
+	"github.com/hq-cml/GoHttpWeb/practices/session/session/storages"
+)
+
+//cookie只在距离上次下发超过空闲超时的一半时重新下发，sid保持不变
+func TestSessionStartRefreshesCookie(t *testing.T) {
+	session_only := session.DefaultCookieOptions()
+	session_only.SessionOnly = true
+	now := time.Now().Unix()
+	cases := []struct {
+		desc    string
+		opts    session.CookieOptions
+		issued  string //cookie值中的下发时间，空表示老格式的cookie
+		reissue bool
+	}{
+		{"just issued", session.DefaultCookieOptions(), strconv.FormatInt(now-10, 10), false},
+		{"just before half", session.DefaultCookieOptions(), strconv.FormatInt(now-1790, 10), false},
+		{"past half", session.DefaultCookieOptions(), strconv.FormatInt(now-1810, 10), true},
+		{"legacy cookie", session.DefaultCookieOptions(), "", true},
+		{"session-only cookie", session_only, strconv.FormatInt(now-3000, 10), false},
+	}
+	for _, c := range cases {
+		manager, err := session.New(storages.NewMemStorage(storages.MemOptions{}), session.WithIdleTimeout(time.Hour), session.WithCookieOptions(c.opts))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		sess, err := manager.SessionStart(w, httptest.NewRequest("GET", "/", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cookie := sidCookie(w, "GOSESSID")
+		if cookie == nil {
+			t.Fatalf("%s: no session cookie issued", c.desc)
+		}
+		//构造下发时间不同的cookie
+		escaped := url.QueryEscape(sess.SessionID())
+		if !strings.HasPrefix(cookie.Value, escaped+".") {
+			t.Fatalf("%s: cookie %q does not carry the sid and issue time", c.desc, cookie.Value)
+		}
+		cookie.Value = escaped
+		if c.issued != "" {
+			cookie.Value += "." + c.issued
+		}
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(cookie)
+		w = httptest.NewRecorder()
+		again, err := manager.SessionStart(w, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again.SessionID() != sess.SessionID() {
+			t.Errorf("%s: sid changed from %s to %s", c.desc, sess.SessionID(), again.SessionID())
+		}
+		refreshed := sidCookie(w, "GOSESSID")
+		if (refreshed != nil) != c.reissue {
+			t.Errorf("%s: reissued %v, want %v", c.desc, refreshed != nil, c.reissue)
+		}
+		if refreshed != nil && (!strings.HasPrefix(refreshed.Value, escaped+".") || refreshed.MaxAge < 3590) {
+			t.Errorf("%s: refreshed cookie %q max-age %d", c.desc, refreshed.Value, refreshed.MaxAge)
+		}
+		manager.Close()
+	}
+}
@@ -11,18 +11,20 @@ package session
  * 2.URL重写：在返回给用户的页面里的所有的URL后面追加session标识符，这样用户在收到响应之后，无论点击响应页面里的哪个链接
  *           或提交表单，都会自动带上session标识符，如果客户端禁用了cookie的话，此种方案将会是首选。
  *
- * 本例采用方案1!
+ * 两种方案都支持，由SidTransport决定sid怎么传递（见transport.go），默认采用方案1
  */
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"log"
 
 	"io"
 	"net/http"
-	"net/url"
-	"sync"
+	"strings"
 	"time"
 )
 
@@ -38,7 +40,7 @@ func init() {
  */
 type Session interface {
 	Set(key, value interface{}) error //set session value
-	Get(key interface{}) interface{}  //get session value
+	Get(key interface{}) interface{}  //get session value，值不存在和存储出错都返回nil，需要区分时用GetAs
 	Delete(key interface{}) error     //delete session value
 	SessionID() string                //get current SESSIONID
 }
@@ -52,6 +54,8 @@ type Session interface {
  * SessionFetch函数返回sid所代表的Session变量条目，如果不存在，那么将以sid为参数调用SessionInit函数创建并返回一个新的Session变量
  * SessionDestroy函数用来销毁sid对应的Session变量
  * SessionGC根据maxLifeTime来删除过期的数据
+ *
+ * 这是老版本的接口，新的存储实现请实现storage_v2.go中的StorageV2
  */
 type Storage interface {
 	SessionInit(sid string) (Session, error)
@@ -62,32 +66,75 @@ type Storage interface {
 
 //session管理器
 type SessionManager struct {
-	cookie_name   string     //cookie的名字（SessionId以cookie形式传到客户端）
-	lock          sync.Mutex //protects session
-	storager      Storage    //一种具体的存储实现
-	max_life_time int64      //最大有效期，用于GC
+	cookie_name   string        //cookie的名字（SessionId以cookie形式传到客户端），其他传递方式下是参数名
+	cookie_opts   CookieOptions //cookie的属性
+	transport     SidTransport  //sid在客户端和服务端之间的传递方式，默认CookieTransport
+	locks         stripedLock   //按sid分段的锁，同一个sid的fetch/init/destroy互斥
+	storager      StorageV2     //一种具体的存储实现
+	max_life_time int64         //空闲超时（秒），用于GC
+
+	absolute_timeout int64                  //绝对超时（秒），从创建开始计算，0表示不限制
+	gc_interval      time.Duration          //GC的间隔，0表示和空闲超时相同
+	gc_jitter        time.Duration          //每次GC的间隔再加上[0, gc_jitter)的随机时间
+	gc               *GCRunner              //后台GC
+	sid_generator    func() (string, error) //sid的生成函数
+	logger           *log.Logger
+
+	failure_policy FailurePolicy //存储出错时SessionStart的处理策略，默认FailClosed
+	redirect_url   string        //FailRedirect策略下重定向的地址
+	strict         bool          //严格模式：不接受客户端带来的、存储中不存在的sid
+	codec          Codec         //值的序列化方式，下发给实现了CodecAware的storage
+	hooks          hooks         //生命周期钩子，见hooks.go
+	deferred       bool          //延迟写回，见deferred.go
+	shared         bool          //storage是NewManager按名字取的全局实例，不归某一个manager所有
 }
 
 /*
  * 参照database/sql/driver，先定义好接口，然后具体的存储session的结构只需要：1.实现相应的接口；2.注册，
  * 相应功能这样就可以使用了，g_storages全局变量负责存储全部的storage实现，Register函数负责填充g_storages
  */
-var g_storages = make(map[string]Storage)
+var g_storages = make(map[string]StorageV2)
 
-//创建管理器
-func NewManager(storage_name, cookie_name string, max_life_time int64) (*SessionManager, error) {
+//创建管理器，按名字使用注册过的storage，max_life_time是空闲超时（秒）
+//cookie_opts可选，不传则使用DefaultCookieOptions()；cookie名的__Host-/__Secure-前缀要求不满足时返回错误
+//是New的简单包装，需要更多配置时请直接使用New
+//注册的storage是全局唯一的实例，和以前一样可以用同一个名字创建多个manager，但它们共用这个实例的配置：
+//有效期、Codec和事件回调以最后创建的manager为准；需要互相独立的manager时，用New给每个manager各自的storage实例
+func NewManager(storage_name, cookie_name string, max_life_time int64, cookie_opts ...CookieOptions) (*SessionManager, error) {
 	storager, ok := g_storages[storage_name]
 	if !ok {
 		return nil, fmt.Errorf("session: unknown storage %q (forgotten import?)", storage_name)
 	}
-	return &SessionManager{storager: storager, cookie_name: cookie_name, max_life_time: max_life_time}, nil
+	opts := []Option{WithCookieName(cookie_name), WithIdleTimeout(time.Duration(max_life_time) * time.Second), sharedStorage()}
+	if len(cookie_opts) > 0 {
+		opts = append(opts, WithCookieOptions(cookie_opts[0]))
+	}
+	return New(storager, opts...)
+}
+
+//设置值的序列化方式，同时下发给storage，应当在开始使用之前设置
+//默认使用GobCodec；自定义类型需要先用RegisterType注册
+func (manager *SessionManager) SetCodec(codec Codec) {
+	manager.codec = codec
+	if aware, ok := manager.storager.(CodecAware); ok {
+		aware.SetCodec(codec)
+	}
 }
 
 /*
  * Register函数，注册一个可用的storager。不能重复注册
  * 这个函数应该有各种storage的实现在其init中调用
+ * 老接口的storager会被AdaptStorage包装成StorageV2
  */
 func Register(name string, storager Storage) {
+	if storager == nil {
+		panic("session: Register Storage is nil")
+	}
+	RegisterV2(name, AdaptStorage(storager))
+}
+
+//RegisterV2函数，注册一个实现了StorageV2接口的storager。不能重复注册
+func RegisterV2(name string, storager StorageV2) {
 	if storager == nil {
 		panic("session: Register Storage is nil")
 	}
@@ -98,57 +145,299 @@ func Register(name string, storager Storage) {
 }
 
 //生成全局唯一的Session ID
-func (manager *SessionManager) sessionId() string {
+//cookie的值是"sid.下发时间"，按最后一个'.'拆分；sid本身带'.'时拆不准，所以不接受
+func (manager *SessionManager) sessionId() (string, error) {
+	sid, err := manager.sid_generator()
+	if err != nil {
+		return "", err
+	}
+	if strings.IndexByte(sid, '.') >= 0 {
+		return "", fmt.Errorf("session: generated session id %q contains '.'", sid)
+	}
+	return sid, nil
+}
+
+//默认的sid生成函数：32字节的随机数
+func randomSid() (string, error) {
 	b := make([]byte, 32)
 	if _, err := io.ReadFull(rand.Reader, b); err != nil {
-		return ""
+		return "", fmt.Errorf("session: generate session id: %w", err)
 	}
-	return base64.URLEncoding.EncodeToString(b)
+	return base64.URLEncoding.EncodeToString(b), nil
 }
 
 //SessionStart函数：
 //检查用户request的cookie中对应sid的值，如果没有，则创建sid；如果有，则读取session值，这个值又是什么呢？？？
-func (manager *SessionManager) SessionStart(w http.ResponseWriter, r *http.Request) (session Session) {
-	manager.lock.Lock()
-	defer manager.lock.Unlock()
-	cookie, err := r.Cookie(manager.cookie_name)
-	if err != nil || cookie.Value == "" {
-		sid := manager.sessionId()                     //生成全局唯一的sid
-		session, _ = manager.storager.SessionInit(sid) //生成一个全新的session条目（list的一个element）
-		cookie := http.Cookie{Name: manager.cookie_name, Value: url.QueryEscape(sid), Path: "/", HttpOnly: true, MaxAge: int(manager.max_life_time)}
-		http.SetCookie(w, &cookie)
-	} else {
-		//cookie[cookie_name]对应的值，其实是sessionid!
-		sid, _ := url.QueryUnescape(cookie.Value)
-		session, _ = manager.storager.SessionFetch(sid)
-	}
-	return
+//返回的session绑定了请求的context，请求结束或超时之后，对它的读写都会失败
+//存储出错时按照failure_policy处理：返回error时响应已经写好了（503或重定向），handler应当直接return
+func (manager *SessionManager) SessionStart(w http.ResponseWriter, r *http.Request) (Session, error) {
+	sess, err := manager.sessionStart(w, r)
+	if err != nil {
+		return manager.handleFailure(w, r, err)
+	}
+	return manager.bind(r.Context(), sess), nil
+}
+
+//把storage返回的session交给handler：开启了延迟写回时先包装，再绑定请求的context
+func (manager *SessionManager) bind(ctx context.Context, sess SessionV2) Session {
+	return &boundSession{ctx: ctx, session: manager.deferWrites(sess)}
+}
+
+//MustSessionStart函数：和SessionStart相同，但是出错时直接panic，适合不愿意处理错误的简单handler
+func (manager *SessionManager) MustSessionStart(w http.ResponseWriter, r *http.Request) Session {
+	session, err := manager.SessionStart(w, r)
+	if err != nil {
+		panic(err)
+	}
+	return session
+}
+
+func (manager *SessionManager) sessionStart(w http.ResponseWriter, r *http.Request) (SessionV2, error) {
+	if client, ok := manager.storager.(ClientStorage); ok {
+		return client.SessionLoad(w, r, manager.cookie_name, manager.cookie_opts)
+	}
+	ctx := r.Context()
+	//cookie[cookie_name]对应的值，其实是sessionid!
+	sid := manager.transport.ReadSid(r, manager.cookie_name)
+	if sid == "" {
+		sess, err := manager.sessionNew(w, r)
+		if err == nil {
+			manager.hooks.created(ctx, sess.SessionID())
+		}
+		return sess, err
+	}
+	//新建了session时，解锁之后再触发OnCreate（defer按相反的顺序执行）
+	var created SessionV2
+	defer func() {
+		if created != nil {
+			manager.hooks.created(ctx, created.SessionID())
+		}
+	}()
+	//同一个sid的并发请求需要互斥，否则可能同时发现条目不存在，各自初始化一遍
+	manager.locks.Lock(sid)
+	defer manager.locks.Unlock(sid)
+	sess, err := manager.storager.SessionFetch(ctx, sid)
+	if errors.Is(err, ErrSessionNotFound) {
+		if manager.strict {
+			//严格模式：客户端带来的sid可能是攻击者预先设置好的，不能沿用，重新生成
+			created, err = manager.sessionNew(w, r)
+			return created, err
+		}
+		//沿用客户端带来的sid新建条目
+		if sess, err = manager.storager.SessionInit(ctx, sid); err == nil {
+			created = sess
+		} else if errors.Is(err, ErrInvalidKey) {
+			//storage不接受这个sid（比如包含文件名里不能用的字符），换一个自己生成的，否则这个cookie会让每个请求都失败
+			created, err = manager.sessionNew(w, r)
+			return created, err
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	manager.refresh(w, r, sess)
+	return sess, nil
+}
+
+//SessionDestroy之后重新开始一个session，请求中带来的sid已经销毁了，不能再用
+//出错时和SessionStart一样按failure_policy处理
+func (manager *SessionManager) sessionRestart(w http.ResponseWriter, r *http.Request) (Session, error) {
+	var sess SessionV2
+	var err error
+	if client, ok := manager.storager.(ClientStorage); ok {
+		//数据就在cookie里，清空之后再加载，得到一个新的session
+		sess, err = client.SessionLoad(w, blankCookie(r, manager.cookie_name), manager.cookie_name, manager.cookie_opts)
+	} else if sess, err = manager.sessionNew(w, r); err == nil {
+		manager.hooks.created(r.Context(), sess.SessionID())
+	}
+	if err != nil {
+		return manager.handleFailure(w, r, err)
+	}
+	return manager.bind(r.Context(), sess), nil
+}
+
+//请求的副本，其中名为name的cookie，以及cookie存储的分片（name.1、name.2……）的值被清空
+//只清空值、不删除cookie，cookie存储据此知道客户端有几个分片需要删除
+func blankCookie(r *http.Request, name string) *http.Request {
+	clone := r.Clone(r.Context())
+	var pairs []string
+	for _, c := range r.Cookies() {
+		if c.Name == name || strings.HasPrefix(c.Name, name+".") {
+			c.Value = ""
+		}
+		pairs = append(pairs, c.Name+"="+c.Value)
+	}
+	clone.Header.Set("Cookie", strings.Join(pairs, "; "))
+	return clone
+}
+
+//滑动续期：服务端的条目每次访问都会续期，客户端的cookie也要跟上，否则登录一个小时之后cookie就过期了
+//为了不在每个响应上都带Set-Cookie，只有距离上次下发超过空闲超时的一半时才重新下发
+func (manager *SessionManager) refresh(w http.ResponseWriter, r *http.Request, sess SessionV2) {
+	refresher, ok := manager.transport.(SidRefresher)
+	if !ok {
+		return
+	}
+	issued := refresher.SidIssued(r, manager.cookie_name)
+	if issued == 0 {
+		return
+	}
+	if time.Now().Unix()-issued > manager.max_life_time/2 {
+		manager.issueSid(w, r, sess)
+	}
+}
+
+//生成新的sid，创建条目，并下发给客户端
+func (manager *SessionManager) sessionNew(w http.ResponseWriter, r *http.Request) (SessionV2, error) {
+	sid, err := manager.sessionId() //生成全局唯一的sid
+	if err != nil {
+		return nil, err
+	}
+	sess, err := manager.storager.SessionInit(r.Context(), sid) //生成一个全新的session条目（list的一个element）
+	if err != nil {
+		return nil, err
+	}
+	manager.issueSid(w, r, sess)
+	return sess, nil
+}
+
+//把sess的sid下发给客户端，cookie的MaxAge是session的剩余有效期
+func (manager *SessionManager) issueSid(w http.ResponseWriter, r *http.Request, sess SessionV2) {
+	manager.transport.IssueSid(w, r, manager.cookie_name, sess.SessionID(), int(manager.remaining(sess)))
+}
+
+//session的剩余有效期（秒）：空闲超时，设置了绝对超时时不超过距离绝对超时的时间
+func (manager *SessionManager) remaining(sess SessionV2) int64 {
+	remaining := manager.max_life_time
+	if manager.absolute_timeout > 0 {
+		if aware, ok := sess.(CreationAware); ok {
+			if left := aware.SessionCreated() + manager.absolute_timeout - time.Now().Unix(); left < remaining {
+				remaining = left
+			}
+		}
+	}
+	if remaining < 1 {
+		//MaxAge为0表示没有Max-Age属性，浏览器会一直保留到关闭，这里至少给1秒
+		remaining = 1
+	}
+	return remaining
+}
+
+//设置sid的传递方式，应当在开始使用之前设置
+//和WithSidTransport一样，CookieTransport{}使用manager的cookie属性；Options不满足cookie名的前缀要求时不做修改，记录日志
+func (manager *SessionManager) SetSidTransport(transport SidTransport) {
+	transport, err := manager.cookieTransport(transport)
+	if err != nil {
+		manager.logger.Printf("session: SetSidTransport ignored: %v", err)
+		return
+	}
+	manager.transport = transport
+}
+
+//设置严格模式：开启后，客户端带来的sid如果在存储中不存在，不会被沿用，而是重新生成一个
+func (manager *SessionManager) SetStrictMode(strict bool) {
+	manager.strict = strict
+}
+
+//SessionRegenerate函数：
+//把当前session的数据原子地迁移到一个新生成的sid下，销毁旧的sid，并重新下发cookie
+//应当在登录成功等权限发生变化的时候调用，防止session fixation
+//请求中没有有效的session时，等同于新建一个session
+func (manager *SessionManager) SessionRegenerate(w http.ResponseWriter, r *http.Request) (Session, error) {
+	lazy := lazyFromContext(r.Context())
+	if lazy != nil {
+		//延迟写回时，换sid之前先把已经做的修改提交到旧的sid下，否则会随旧的session对象一起丢掉
+		lazy.commit()
+	}
+	sess, err := manager.sessionRegenerate(w, r)
+	if err == nil && lazy != nil {
+		//经过Middleware的请求，之后FromContext拿到的是新的session
+		lazy.replace(sess)
+	}
+	return sess, err
+}
+
+func (manager *SessionManager) sessionRegenerate(w http.ResponseWriter, r *http.Request) (Session, error) {
+	if client, ok := manager.storager.(ClientStorage); ok {
+		new_sid, err := manager.sessionId()
+		if err != nil {
+			return nil, err
+		}
+		sess, err := client.SessionRenew(w, r, manager.cookie_name, manager.cookie_opts, new_sid)
+		if err != nil {
+			return nil, err
+		}
+		return manager.bind(r.Context(), sess), nil
+	}
+	regenerator, ok := manager.storager.(Regenerator)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	ctx := r.Context()
+	old_sid := manager.transport.ReadSid(r, manager.cookie_name)
+	if old_sid == "" {
+		sess, err := manager.sessionNew(w, r)
+		if err != nil {
+			return nil, err
+		}
+		manager.hooks.created(ctx, sess.SessionID())
+		return manager.bind(ctx, sess), nil
+	}
+	new_sid, err := manager.sessionId()
+	if err != nil {
+		return nil, err
+	}
+	//解锁之后再触发钩子：迁移成功是OnRegenerate，旧的sid不存在时是新建，OnCreate
+	var fire func()
+	defer func() {
+		if fire != nil {
+			fire()
+		}
+	}()
+	manager.locks.Lock2(old_sid, new_sid)
+	defer manager.locks.Unlock2(old_sid, new_sid)
+	sess, err := regenerator.SessionRegenerate(ctx, old_sid, new_sid)
+	if err == nil {
+		fire = func() { manager.hooks.regenerated(ctx, old_sid, new_sid) }
+	} else if errors.Is(err, ErrSessionNotFound) {
+		if sess, err = manager.storager.SessionInit(ctx, new_sid); err == nil {
+			fire = func() { manager.hooks.created(ctx, new_sid) }
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	manager.issueSid(w, r, sess)
+	return manager.bind(ctx, sess), nil
 }
 
 //Destroy session
 //1. 服务端：先调用对应storager的sessiondestroy函数
 //2. 客户端：然后让客户端清除cookie
 func (manager *SessionManager) SessionDestroy(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie(manager.cookie_name)
-	if err != nil || cookie.Value == "" {
+	//经过Middleware的请求，之后FromContext会重新开始一个session
+	if lazy := lazyFromContext(r.Context()); lazy != nil {
+		defer lazy.replace(nil)
+	}
+	if client, ok := manager.storager.(ClientStorage); ok {
+		client.SessionClear(w, r, manager.cookie_name, manager.cookie_opts)
+		return
+	}
+	session_id := manager.transport.ReadSid(r, manager.cookie_name)
+	if session_id == "" {
 		return
-	} else {
-		manager.lock.Lock()
-		defer manager.lock.Unlock()
-		session_id := cookie.Value
-		manager.storager.SessionDestroy(session_id)
-		expiration := time.Now()
-		// MaxAge<0 means delete cookie now, equivalently 'Max-Age: 0'
-		cookie := http.Cookie{Name: manager.cookie_name, Path: "/", HttpOnly: true, Expires: expiration, MaxAge: -1}
-		http.SetCookie(w, &cookie)
+	}
+	manager.locks.Lock(session_id)
+	err := manager.storager.SessionDestroy(r.Context(), session_id)
+	manager.locks.Unlock(session_id)
+	manager.transport.ClearSid(w, r, manager.cookie_name)
+	if err == nil {
+		manager.hooks.destroyed(r.Context(), session_id)
 	}
 }
 
-//利用了time包中的定时器功能，当超时maxLifeTime之后调用GC函数，这样就可以保证maxLifeTime时间内的session是可用的
-//首先调用对应storager的GC，然后启动一个定时器，触发自己，也就是说manager的GC会定期触发~
+//启动后台GC，相当于GCRunner().Start(context.Background())，保留给老代码使用
+//需要停止GC或者查看统计时请使用GCRunner()
 func (manager *SessionManager) GC() {
-	manager.lock.Lock()
-	defer manager.lock.Unlock()
-	manager.storager.SessionGC(manager.max_life_time)
-	time.AfterFunc(time.Duration(manager.max_life_time), func() { manager.GC() }) //自己调用自己
+	manager.gc.Start(context.Background())
 }
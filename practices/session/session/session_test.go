@@ -0,0 +1,118 @@
+package session_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/hq-cml/GoHttpWeb/practices/session/session"
+	"github.com/hq-cml/GoHttpWeb/practices/session/session/storages"
+)
+
+//带着名为GOSESSID的cookie的请求
+func sidRequest(sid string) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: "GOSESSID", Value: url.QueryEscape(sid)})
+	return r
+}
+
+//客户端带来的、存储中不存在的sid：严格模式下换成服务端生成的，非严格模式下沿用
+func TestSessionStartStrictMode(t *testing.T) {
+	const planted = "attacker-chosen-sid"
+	for _, strict := range []bool{true, false} {
+		storage := storages.NewMemStorage(storages.MemOptions{})
+		manager, err := session.New(storage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manager.SetStrictMode(strict)
+		w := httptest.NewRecorder()
+		sess, err := manager.SessionStart(w, sidRequest(planted))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cookie := sidCookie(w, "GOSESSID")
+		if strict {
+			if sess.SessionID() == planted {
+				t.Error("strict mode adopted the client sid")
+			}
+			if cookie == nil || !strings.HasPrefix(cookie.Value, url.QueryEscape(sess.SessionID())+".") {
+				t.Errorf("strict mode issued cookie %v, want the new sid", cookie)
+			}
+		} else {
+			if sess.SessionID() != planted {
+				t.Errorf("non-strict mode: sid %q, want %q", sess.SessionID(), planted)
+			}
+		}
+		if _, err := storage.SessionFetch(context.Background(), planted); (err == nil) == strict {
+			t.Errorf("strict %v: planted sid stored: %v", strict, err)
+		}
+
+		//存储中已经存在的sid两种模式下都沿用
+		again, err := manager.SessionStart(httptest.NewRecorder(), sidRequest(sess.SessionID()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again.SessionID() != sess.SessionID() {
+			t.Errorf("strict %v: existing sid changed from %s to %s", strict, sess.SessionID(), again.SessionID())
+		}
+		manager.Close()
+	}
+}
+
+//SessionRegenerate换一个新的sid并重新下发cookie，值跟着迁移，旧的sid不能再用
+func TestSessionRegenerate(t *testing.T) {
+	storage := storages.NewMemStorage(storages.MemOptions{})
+	manager, err := session.New(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+	sess, err := manager.SessionStart(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old_sid := sess.SessionID()
+	sess.Set("user", "tom")
+
+	w := httptest.NewRecorder()
+	regenerated, err := manager.SessionRegenerate(w, sidRequest(old_sid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	new_sid := regenerated.SessionID()
+	if new_sid == old_sid {
+		t.Fatal("sid not changed")
+	}
+	cookie := sidCookie(w, "GOSESSID")
+	if cookie == nil || !strings.HasPrefix(cookie.Value, url.QueryEscape(new_sid)+".") {
+		t.Errorf("cookie %v, want the new sid", cookie)
+	}
+	if v := regenerated.Get("user"); v != "tom" {
+		t.Errorf("user = %v after regenerate", v)
+	}
+
+	if _, err := storage.SessionFetch(context.Background(), old_sid); !errors.Is(err, session.ErrSessionNotFound) {
+		t.Errorf("old sid still fetchable: %v", err)
+	}
+	//带着旧sid的请求拿不到原来的数据
+	manager.SetStrictMode(true)
+	stale, err := manager.SessionStart(httptest.NewRecorder(), sidRequest(old_sid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stale.SessionID() == old_sid || stale.Get("user") != nil {
+		t.Errorf("old sid %s reused as %s with user %v", old_sid, stale.SessionID(), stale.Get("user"))
+	}
+	fetched, err := manager.SessionStart(httptest.NewRecorder(), sidRequest(new_sid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetched.SessionID() != new_sid || fetched.Get("user") != "tom" {
+		t.Errorf("new sid: %s, user %v", fetched.SessionID(), fetched.Get("user"))
+	}
+}
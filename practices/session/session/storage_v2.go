@@ -0,0 +1,250 @@
+package session
+
+import (
+	"context"
+	"net/http"
+)
+
+/*
+ * v2版本的session/storage接口
+ * 和老接口的区别：
+ * 1. 每个调用都带有context，storage应当在ctx超时或取消时尽快返回，避免一个慢的redis请求把整个请求挂死
+ * 2. SessionGC返回error，GC失败不再无声无息
+ * 3. Get返回error，区分“值不存在”（nil, nil）和“存储出错”
+ * 4. SessionFetch在sid不存在时返回ErrSessionNotFound，是否用这个sid新建条目由manager决定
+ *
+ * 老的Storage实现可以通过AdaptStorage包装成StorageV2继续使用
+ */
+type SessionV2 interface {
+	Set(ctx context.Context, key, value interface{}) error         //set session value
+	Get(ctx context.Context, key interface{}) (interface{}, error) //get session value，不存在时返回nil, nil
+	Delete(ctx context.Context, key interface{}) error             //delete session value
+	SessionID() string                                             //get current SESSIONID
+}
+
+type StorageV2 interface {
+	SessionInit(ctx context.Context, sid string) (SessionV2, error)
+	SessionFetch(ctx context.Context, sid string) (SessionV2, error)
+	SessionDestroy(ctx context.Context, sid string) error
+	SessionGC(ctx context.Context, max_life_time int64) error
+}
+
+/*
+ * 可选接口：把sid对应的条目原子地迁移到一个新的sid下，旧的sid随之失效
+ * 用于登录等权限变化之后更换sid，防止session fixation
+ * old_sid不存在时返回ErrSessionNotFound
+ */
+type Regenerator interface {
+	SessionRegenerate(ctx context.Context, old_sid, new_sid string) (SessionV2, error)
+}
+
+/*
+ * 可选接口：自己负责过期的storage（比如依赖redis的EXPIRE），需要知道条目的有效期（秒）
+ * manager创建时会把自己的max_life_time告知storage
+ */
+type LifeTimeAware interface {
+	SetMaxLifeTime(max_life_time int64)
+}
+
+/*
+ * 可选接口：除了空闲超时之外还支持绝对超时的storage
+ * storage为每个session记录创建时间，创建之后超过absolute_timeout秒的session，不论是否活跃都视为过期：
+ * SessionFetch返回ErrSessionNotFound，GC时也会被删除；0表示不限制
+ */
+type AbsoluteTimeoutAware interface {
+	SetAbsoluteTimeout(absolute_timeout int64)
+}
+
+/*
+ * 可选接口：记录了创建时间的session，manager据此计算cookie的剩余有效期
+ */
+type CreationAware interface {
+	SessionCreated() int64 //创建时间（unix秒）
+}
+
+/*
+ * 可选接口：GC时报告这一轮删除了多少条过期的session，用于GC的统计
+ * 没有实现这个接口的storage照常调用SessionGC，统计中的数量记为0
+ */
+type GCCounter interface {
+	SessionGCCount(ctx context.Context, max_life_time int64) (int, error)
+}
+
+/*
+ * 可选接口：遍历和统计存活的session，用于后台管理等场景
+ * SessionList分页返回sid：cursor为""表示从头开始，返回的next为""表示已经遍历完，否则作为下一页的cursor；
+ * limit是一页最多返回的条数。遍历期间有session创建或者删除时，可能漏掉或者重复个别条目
+ * SessionCount返回存活的session数，条目很多的存储可以返回近似值
+ */
+type Enumerator interface {
+	SessionList(ctx context.Context, cursor string, limit int) (sids []string, next string, err error)
+	SessionCount(ctx context.Context) (int, error)
+}
+
+/*
+ * 可选接口：按用户索引session，用于“退出我的所有设备”、“强制某个用户下线”
+ * SessionBindUser把sid关联到用户上，一个sid只属于一个用户，重复关联以最后一次为准；sid不存在时返回ErrSessionNotFound
+ * 换sid（SessionRegenerate）时关联随之迁移，session被销毁或者过期之后不再出现在SessionsOfUser的结果中
+ */
+type UserIndex interface {
+	SessionBindUser(ctx context.Context, sid, user_id string) error
+	SessionsOfUser(ctx context.Context, user_id string) ([]string, error)
+}
+
+/*
+ * 可选接口：可以一次读出、一次写回整个session的storage，WithDeferredWrites据此实现延迟写回（见deferred.go）
+ * 值都是manager的Codec编码之后的[]byte，key只支持string
+ * SessionValues读出session的全部值，sid不存在时返回ErrSessionNotFound
+ * SessionCommit把一个请求的全部修改一次写回并刷新有效期：set是写入的值，del是删除的key；
+ * 要么全部生效要么都不生效，其他请求不会看到写了一半的session；sid不存在时返回ErrSessionNotFound
+ */
+type BatchStorage interface {
+	SessionValues(ctx context.Context, sid string) (map[string][]byte, error)
+	SessionCommit(ctx context.Context, sid string, set map[string][]byte, del []string) error
+}
+
+/*
+ * 可选接口：报告storage自己发现的session生命周期事件，manager据此触发OnExpire等钩子（见hooks.go）
+ * SessionInit/SessionDestroy/SessionRegenerate是manager调用的，由manager触发钩子，storage只需要报告manager看不到的：
+ * GC删除了过期的条目，或者SessionFetch发现条目已经过期并顺便删除了，调用Expired，每个条目只报告一次；
+ * 因为容量限制淘汰了没有过期的条目，调用Evicted
+ * ClientStorage例外：manager不知道SessionLoad是新建还是还原了session，也不知道cookie里的sid，所以全部事件都由storage报告
+ * 回调要在storage的锁外调用；manager在New时设置，之后不再改变
+ */
+type EventReporter interface {
+	SetEvents(events StorageEvents)
+}
+
+//storage报告事件用的回调，manager设置时每个字段都不为nil
+type StorageEvents struct {
+	Created     func(ctx context.Context, sid string)
+	Destroyed   func(ctx context.Context, sid string)
+	Expired     func(sid string)
+	Regenerated func(ctx context.Context, old_sid, new_sid string)
+	Evicted     func(sid string)
+}
+
+/*
+ * 可选接口：不在服务端保存任何状态，把整个session放在客户端cookie里的storage
+ * 这类storage没有可以按sid查找的条目，所以manager不再下发sid cookie，而是把请求和响应交给storage：
+ * SessionLoad从请求的cookie中还原session（没有或者无效时新建一个），数据变化时由storage自己写回响应的cookie
+ * SessionRenew还原session之后换成new_sid，SessionClear让客户端删除这些cookie
+ * 写cookie时使用manager的cookie_opts，和sid cookie的属性保持一致
+ * cookie只能在响应头写出之前设置，所以对这类session的Set/Delete要在写响应体之前完成
+ */
+type ClientStorage interface {
+	SessionLoad(w http.ResponseWriter, r *http.Request, cookie_name string, cookie_opts CookieOptions) (SessionV2, error)
+	SessionRenew(w http.ResponseWriter, r *http.Request, cookie_name string, cookie_opts CookieOptions, new_sid string) (SessionV2, error)
+	SessionClear(w http.ResponseWriter, r *http.Request, cookie_name string, cookie_opts CookieOptions)
+}
+
+/*
+ * 适配器：把老的Storage/Session包装成StorageV2/SessionV2
+ * 老接口不认识context，所以只能在调用之前检查一下ctx是否已经结束；
+ * 老的SessionFetch会自动创建不存在的条目，所以包装后的SessionFetch永远不会返回ErrSessionNotFound，
+ * 严格模式对这类storage不起作用；老接口也没有迁移sid的能力，SessionRegenerate会返回ErrNotSupported
+ */
+type storageAdapter struct {
+	storager Storage
+}
+
+type sessionAdapter struct {
+	session Session
+}
+
+//把老的Storage实现包装成StorageV2
+func AdaptStorage(storager Storage) StorageV2 {
+	return &storageAdapter{storager: storager}
+}
+
+func (self *storageAdapter) SessionInit(ctx context.Context, sid string) (SessionV2, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	sess, err := self.storager.SessionInit(sid)
+	if err != nil {
+		return nil, err
+	}
+	return &sessionAdapter{session: sess}, nil
+}
+
+func (self *storageAdapter) SessionFetch(ctx context.Context, sid string) (SessionV2, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	sess, err := self.storager.SessionFetch(sid)
+	if err != nil {
+		return nil, err
+	}
+	return &sessionAdapter{session: sess}, nil
+}
+
+func (self *storageAdapter) SessionDestroy(ctx context.Context, sid string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return self.storager.SessionDestroy(sid)
+}
+
+func (self *storageAdapter) SessionGC(ctx context.Context, max_life_time int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	self.storager.SessionGC(max_life_time)
+	return nil
+}
+
+func (self *sessionAdapter) Set(ctx context.Context, key, value interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return self.session.Set(key, value)
+}
+
+func (self *sessionAdapter) Get(ctx context.Context, key interface{}) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return self.session.Get(key), nil
+}
+
+func (self *sessionAdapter) Delete(ctx context.Context, key interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return self.session.Delete(key)
+}
+
+func (self *sessionAdapter) SessionID() string {
+	return self.session.SessionID()
+}
+
+/*
+ * 反方向的包装：manager交给handler的仍然是老的Session接口，用起来简单
+ * 内部把请求的context绑定在session上，handler里的每次Get/Set都受请求context的控制
+ * Get的错误没法通过老接口返回，只能当做值不存在处理；需要区分两者的调用方用GetAs/Key（见typed.go），它们直接调用SessionV2的Get，错误会返回出来
+ */
+type boundSession struct {
+	ctx     context.Context
+	session SessionV2
+}
+
+func (self *boundSession) Set(key, value interface{}) error {
+	return self.session.Set(self.ctx, key, value)
+}
+
+func (self *boundSession) Get(key interface{}) interface{} {
+	v, err := self.session.Get(self.ctx, key)
+	if err != nil {
+		return nil
+	}
+	return v
+}
+
+func (self *boundSession) Delete(key interface{}) error {
+	return self.session.Delete(self.ctx, key)
+}
+
+func (self *boundSession) SessionID() string {
+	return self.session.SessionID()
+}
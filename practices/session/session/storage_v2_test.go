@@ -0,0 +1,177 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+//老接口的存储：SessionFetch自动创建不存在的条目，down时所有操作都失败
+type legacyStorage struct {
+	lock     sync.Mutex
+	sessions map[string]*legacySession
+	down     bool
+}
+
+type legacySession struct {
+	sid     string
+	value   map[interface{}]interface{}
+	storage *legacyStorage
+}
+
+var errLegacyDown = errors.New("legacy storage down")
+
+func (self *legacyStorage) SessionInit(sid string) (Session, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.down {
+		return nil, errLegacyDown
+	}
+	sess := &legacySession{sid: sid, value: make(map[interface{}]interface{}), storage: self}
+	self.sessions[sid] = sess
+	return sess, nil
+}
+
+func (self *legacyStorage) SessionFetch(sid string) (Session, error) {
+	self.lock.Lock()
+	sess, ok := self.sessions[sid]
+	self.lock.Unlock()
+	if ok {
+		return sess, nil
+	}
+	return self.SessionInit(sid)
+}
+
+func (self *legacyStorage) SessionDestroy(sid string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.sessions, sid)
+	return nil
+}
+
+func (self *legacyStorage) SessionGC(maxLifeTime int64) {}
+
+func (self *legacySession) Set(key, value interface{}) error {
+	self.storage.lock.Lock()
+	defer self.storage.lock.Unlock()
+	if self.storage.down {
+		return errLegacyDown
+	}
+	self.value[key] = value
+	return nil
+}
+
+func (self *legacySession) Get(key interface{}) interface{} {
+	self.storage.lock.Lock()
+	defer self.storage.lock.Unlock()
+	return self.value[key]
+}
+
+func (self *legacySession) Delete(key interface{}) error {
+	self.storage.lock.Lock()
+	defer self.storage.lock.Unlock()
+	if self.storage.down {
+		return errLegacyDown
+	}
+	delete(self.value, key)
+	return nil
+}
+
+func (self *legacySession) SessionID() string {
+	return self.sid
+}
+
+//用Register注册的老存储经过AdaptStorage之后，NewManager和SessionStart照常可用
+func TestAdaptStorage(t *testing.T) {
+	storage := &legacyStorage{sessions: make(map[string]*legacySession)}
+	Register("legacy_test", storage)
+	defer delete(g_storages, "legacy_test")
+	manager, err := NewManager("legacy_test", "GOSESSID", 3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+
+	w := httptest.NewRecorder()
+	sess, err := manager.SessionStart(w, httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Set("name", "tom"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := storage.sessions[sess.SessionID()]; !ok {
+		t.Fatal("session not created in the legacy storage")
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(w.Result().Cookies()[0])
+	again, err := manager.SessionStart(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.SessionID() != sess.SessionID() || again.Get("name") != "tom" {
+		t.Errorf("second request: sid %s, name %v", again.SessionID(), again.Get("name"))
+	}
+	if v := again.Get("missing"); v != nil {
+		t.Errorf("missing key = %v", v)
+	}
+	if err := again.Delete("name"); err != nil || again.Get("name") != nil {
+		t.Errorf("delete: %v, name %v", err, again.Get("name"))
+	}
+
+	//老的SessionFetch自动创建条目，适配之后不会返回ErrSessionNotFound，客户端带来的sid总是被沿用
+	unknown := httptest.NewRequest("GET", "/", nil)
+	unknown.AddCookie(&http.Cookie{Name: "GOSESSID", Value: "client-sid"})
+	if adopted, err := manager.SessionStart(httptest.NewRecorder(), unknown); err != nil || adopted.SessionID() != "client-sid" {
+		t.Errorf("unknown sid: %v, %v", adopted, err)
+	}
+	//老接口不能迁移sid
+	if _, err := manager.SessionRegenerate(httptest.NewRecorder(), r); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("regenerate: %v, want ErrNotSupported", err)
+	}
+
+	//老存储返回的错误原样传出来：Set/Delete直接返回，SessionStart按failure_policy处理
+	storage.down = true
+	if err := again.Set("name", "jerry"); !errors.Is(err, errLegacyDown) {
+		t.Errorf("set with storage down: %v", err)
+	}
+	if err := again.Delete("name"); !errors.Is(err, errLegacyDown) {
+		t.Errorf("delete with storage down: %v", err)
+	}
+	w = httptest.NewRecorder()
+	if _, err := manager.SessionStart(w, httptest.NewRequest("GET", "/", nil)); !errors.Is(err, errLegacyDown) || w.Code != http.StatusServiceUnavailable {
+		t.Errorf("start with storage down: %v, status %d", err, w.Code)
+	}
+}
+
+//请求的context结束之后，适配器不再调用老存储
+func TestAdaptStorageCanceled(t *testing.T) {
+	storage := &legacyStorage{sessions: make(map[string]*legacySession)}
+	adapted := AdaptStorage(storage)
+	sess, err := adapted.SessionInit(context.Background(), "sid1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := adapted.SessionFetch(ctx, "sid2"); !errors.Is(err, context.Canceled) {
+		t.Errorf("fetch: %v", err)
+	}
+	if _, ok := storage.sessions["sid2"]; ok {
+		t.Error("canceled fetch created a session")
+	}
+	if err := sess.Set(ctx, "k", "v"); !errors.Is(err, context.Canceled) {
+		t.Errorf("set: %v", err)
+	}
+	//Get的错误没法通过老的Session接口返回：boundSession.Get返回nil，GetAs能拿到错误
+	bound := &boundSession{ctx: ctx, session: sess}
+	if v := bound.Get("k"); v != nil {
+		t.Errorf("bound get = %v", v)
+	}
+	if _, _, err := GetAs[string](bound, "k"); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetAs: %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,456 @@
+package storages
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/hq-cml/GoHttpWeb/practices/session/session"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * Cookie Session实现，实现Session接口
+ * 数据保存在这个对象里，每次Set/Delete之后整体加密，写回响应的cookie
+ * 所以Set/Delete必须在handler写响应体之前调用
+ */
+type CookieSession struct {
+	lock    sync.Mutex
+	sid     string                //session id，保存在加密的数据里，只用于标示
+	values  map[string][]byte     //经过codec序列化的值
+	expires int64                 //过期的unix时间
+	created int64                 //创建的unix时间，用于绝对超时
+	w       http.ResponseWriter   //本次请求的响应，用于写回cookie
+	name    string                //cookie的名字
+	opts    session.CookieOptions //cookie的属性
+	chunks  int                   //请求带来的cookie分片数量，写回的分片更少时多出来的要删除
+	storage *CookieStorage        //所属的storage
+}
+
+/*
+ * Cookie存储实现，这个结构实现Storage和ClientStorage接口
+ * 服务端不保存任何状态，整个session放在客户端的cookie中，适合小的、无状态的服务：
+ * 1. 数据用AES-GCM加密，GCM自带认证，客户端既看不到也改不了；cookie名作为附加数据，不同名字的cookie不能互换
+ * 2. 支持多个密钥：用第一个加密，所有密钥都可以解密；用旧密钥解开的cookie会马上用新密钥重新加密写回，
+ *    轮换密钥时把新密钥放在最前面，等旧cookie都过期之后再去掉旧密钥
+ * 3. 单个cookie不能超过4KB，数据太大时切分成多个cookie：name、name.1、name.2...，超过MaxChunks时Set返回ErrValueTooLarge
+ * 4. 过期时间和创建时间保存在加密的数据里，空闲超时和绝对超时都在解密时检查，SessionGC什么都不用做
+ * 5. 只读的请求不会改变cookie，距离上次写入超过空闲超时的一半时重新写一次，让过期时间跟着访问往后推
+ *
+ * 需要密钥，所以不在init中注册，用法：
+ *   storage, _ := storages.NewCookieStorage(storages.CookieStorageOptions{Keys: [][]byte{key}})
+ *   session.RegisterV2("cookie", storage)
+ */
+type CookieStorage struct {
+	aeads            []cipher.AEAD //每个密钥对应一个，第一个用于加密
+	max_chunks       int
+	max_life_time    int64                 //空闲超时（秒），原子操作
+	absolute_timeout int64                 //绝对超时（秒），0表示不限制，原子操作
+	codec            session.Codec         //值的序列化方式，默认gob
+	events           session.StorageEvents //manager设置的事件回调，cookie存储的全部事件都由自己报告
+}
+
+//cookie存储的配置
+type CookieStorageOptions struct {
+	Keys      [][]byte //AES密钥，长度16、24或32字节，至少一个，第一个用于加密
+	MaxChunks int      //最多切分成几个cookie，默认4
+}
+
+//加密之前的数据
+type cookiePayload struct {
+	Sid     string
+	Expires int64
+	Created int64
+	Issued  int64 //写入cookie的时间，用于滑动续期
+	Values  map[string][]byte
+}
+
+const (
+	cookie_chunk_size         = 3800 //单个cookie值的长度，给名字和属性留出空间，整体不超过4KB
+	cookie_default_max_chunks = 4
+)
+
+var errCookieInvalid = errors.New("session: invalid session cookie")
+
+//创建cookie存储，密钥长度不对时返回错误
+func NewCookieStorage(opts CookieStorageOptions) (*CookieStorage, error) {
+	if len(opts.Keys) == 0 {
+		return nil, errors.New("session: cookie storage needs at least one key")
+	}
+	if opts.MaxChunks <= 0 {
+		opts.MaxChunks = cookie_default_max_chunks
+	}
+	storage := &CookieStorage{max_chunks: opts.MaxChunks, max_life_time: default_life_time, codec: session.GobCodec{}}
+	for i, key := range opts.Keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("session: cookie key %d: %w", i, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("session: cookie key %d: %w", i, err)
+		}
+		storage.aeads = append(storage.aeads, aead)
+	}
+	return storage, nil
+}
+
+//实现session.LifeTimeAware
+func (self *CookieStorage) SetMaxLifeTime(max_life_time int64) {
+	atomic.StoreInt64(&self.max_life_time, max_life_time)
+}
+
+//实现session.AbsoluteTimeoutAware
+func (self *CookieStorage) SetAbsoluteTimeout(absolute_timeout int64) {
+	atomic.StoreInt64(&self.absolute_timeout, absolute_timeout)
+}
+
+//实现session.CodecAware，应当在开始使用之前设置
+func (self *CookieStorage) SetCodec(codec session.Codec) {
+	self.codec = codec
+}
+
+//用第一个密钥加密，结果是base64(nonce+密文)
+func (self *CookieStorage) seal(name string, plain []byte) (string, error) {
+	aead := self.aeads[0]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, plain, []byte(name))), nil
+}
+
+//依次用每个密钥尝试解密，rotated表示用的不是第一个密钥
+func (self *CookieStorage) open(name, value string) (plain []byte, rotated bool, err error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, false, errCookieInvalid
+	}
+	for i, aead := range self.aeads {
+		if len(data) < aead.NonceSize() {
+			return nil, false, errCookieInvalid
+		}
+		plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(name))
+		if err == nil {
+			return plain, i > 0, nil
+		}
+	}
+	return nil, false, errCookieInvalid
+}
+
+//解密并检查是否过期
+func (self *CookieStorage) decode(name, value string) (*cookiePayload, bool, error) {
+	plain, rotated, err := self.open(name, value)
+	if err != nil {
+		return nil, false, err
+	}
+	var payload cookiePayload
+	if err := gob.NewDecoder(bytes.NewReader(plain)).Decode(&payload); err != nil {
+		return nil, false, errCookieInvalid
+	}
+	//过期时仍然返回payload，调用方据此报告过期的sid
+	now := time.Now().Unix()
+	if payload.Expires < now {
+		return &payload, false, session.ErrSessionNotFound
+	}
+	if absolute_timeout := atomic.LoadInt64(&self.absolute_timeout); absolute_timeout > 0 && payload.Created+absolute_timeout < now {
+		return &payload, false, session.ErrSessionNotFound
+	}
+	if payload.Values == nil {
+		payload.Values = make(map[string][]byte)
+	}
+	return &payload, rotated, nil
+}
+
+//第i个分片的cookie名
+func cookieChunkName(name string, i int) string {
+	if i == 0 {
+		return name
+	}
+	return name + "." + strconv.Itoa(i)
+}
+
+//从请求中读出全部分片，拼接起来
+func cookieRead(r *http.Request, name string) (string, int) {
+	var value strings.Builder
+	n := 0
+	for {
+		c, err := r.Cookie(cookieChunkName(name, n))
+		if err != nil {
+			return value.String(), n
+		}
+		value.WriteString(c.Value)
+		n++
+	}
+}
+
+//去掉响应中已经设置的、属于这个session的cookie，同一个请求中多次写回时只保留最后一次
+func cookieReset(w http.ResponseWriter, name string) {
+	header := w.Header()
+	var kept []string
+	for _, line := range header["Set-Cookie"] {
+		n := line
+		if i := strings.IndexByte(line, '='); i >= 0 {
+			n = line[:i]
+		}
+		if n != name && !strings.HasPrefix(n, name+".") {
+			kept = append(kept, line)
+		}
+	}
+	if kept == nil {
+		header.Del("Set-Cookie")
+	} else {
+		header["Set-Cookie"] = kept
+	}
+}
+
+//让客户端删除第from个及之后的分片
+func cookieDelete(w http.ResponseWriter, name string, opts session.CookieOptions, from, to int) {
+	for i := from; i < to; i++ {
+		http.SetCookie(w, opts.Cookie(cookieChunkName(name, i), "", -1))
+	}
+}
+
+//生成新的sid
+func cookieSid() (string, error) {
+	b := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", fmt.Errorf("session: generate session id: %w", err)
+	}
+	return base64.URLEncoding.EncodeToString(b), nil
+}
+
+//把数据加密写回响应，调用方持有sess.lock
+func (self *CookieSession) flush() error {
+	now := time.Now().Unix()
+	self.expires = now + atomic.LoadInt64(&self.storage.max_life_time)
+	if absolute_timeout := atomic.LoadInt64(&self.storage.absolute_timeout); absolute_timeout > 0 && self.created+absolute_timeout < self.expires {
+		self.expires = self.created + absolute_timeout
+	}
+	max_age := self.expires - now
+	if max_age < 1 {
+		max_age = 1
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&cookiePayload{Sid: self.sid, Expires: self.expires, Created: self.created, Issued: now, Values: self.values}); err != nil {
+		return err
+	}
+	value, err := self.storage.seal(self.name, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	n := (len(value) + cookie_chunk_size - 1) / cookie_chunk_size
+	if n > self.storage.max_chunks {
+		return fmt.Errorf("%w: session needs %d cookies, limit is %d", session.ErrValueTooLarge, n, self.storage.max_chunks)
+	}
+	cookieReset(self.w, self.name)
+	for i := 0; i < n; i++ {
+		chunk := value[i*cookie_chunk_size:]
+		if len(chunk) > cookie_chunk_size {
+			chunk = chunk[:cookie_chunk_size]
+		}
+		http.SetCookie(self.w, self.opts.Cookie(cookieChunkName(self.name, i), chunk, int(max_age)))
+	}
+	cookieDelete(self.w, self.name, self.opts, n, self.chunks)
+	return nil
+}
+
+/*
+ * CookieSession实现SessionV2接口的：Set/Get/Delete/SessionID方法
+ * key只支持string；value经过storage的codec序列化之后保存
+ * 写回失败（比如超出了cookie的大小限制）时修改会被撤销
+ */
+func (self *CookieSession) Set(ctx context.Context, key, value interface{}) error {
+	k, ok := key.(string)
+	if !ok {
+		return fmt.Errorf("%w: cookie session key must be string, got %T", session.ErrInvalidKey, key)
+	}
+	v, err := self.storage.codec.Encode(value)
+	if err != nil {
+		return err
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	old, existed := self.values[k]
+	self.values[k] = v
+	if err := self.flush(); err != nil {
+		if existed {
+			self.values[k] = old
+		} else {
+			delete(self.values, k)
+		}
+		return err
+	}
+	return nil
+}
+
+//值不存在时返回nil, nil
+func (self *CookieSession) Get(ctx context.Context, key interface{}) (interface{}, error) {
+	k, ok := key.(string)
+	if !ok {
+		return nil, fmt.Errorf("%w: cookie session key must be string, got %T", session.ErrInvalidKey, key)
+	}
+	self.lock.Lock()
+	v, exists := self.values[k]
+	self.lock.Unlock()
+	if !exists {
+		return nil, nil
+	}
+	return self.storage.codec.Decode(v)
+}
+
+func (self *CookieSession) Delete(ctx context.Context, key interface{}) error {
+	k, ok := key.(string)
+	if !ok {
+		return fmt.Errorf("%w: cookie session key must be string, got %T", session.ErrInvalidKey, key)
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	old, existed := self.values[k]
+	if !existed {
+		return nil
+	}
+	delete(self.values, k)
+	if err := self.flush(); err != nil {
+		self.values[k] = old
+		return err
+	}
+	return nil
+}
+
+func (self *CookieSession) SessionID() string {
+	return self.sid
+}
+
+//实现session.CreationAware
+func (self *CookieSession) SessionCreated() int64 {
+	return self.created
+}
+
+/*
+ * CookieStorage实现ClientStorage接口的：SessionLoad/SessionRenew/SessionClear方法
+ */
+//从请求的cookie中解出session；没有、被篡改、密钥不认识或者已经过期时新建一个，并下发cookie
+func (self *CookieStorage) SessionLoad(w http.ResponseWriter, r *http.Request, cookie_name string, cookie_opts session.CookieOptions) (session.SessionV2, error) {
+	sess, fresh, err := self.load(w, r, cookie_name, cookie_opts)
+	if err != nil {
+		return nil, err
+	}
+	if fresh && self.events.Created != nil {
+		self.events.Created(r.Context(), sess.sid)
+	}
+	return sess, nil
+}
+
+//还原或者新建session，fresh表示是新建的；cookie中的session已经过期时报告Expired
+func (self *CookieStorage) load(w http.ResponseWriter, r *http.Request, cookie_name string, cookie_opts session.CookieOptions) (*CookieSession, bool, error) {
+	value, chunks := cookieRead(r, cookie_name)
+	sess := &CookieSession{w: w, name: cookie_name, opts: cookie_opts, chunks: chunks, storage: self}
+	if value != "" {
+		payload, rotated, err := self.decode(cookie_name, value)
+		if errors.Is(err, session.ErrSessionNotFound) && self.events.Expired != nil {
+			//cookie存储没有GC，只有客户端带着过期的cookie回来时才知道它过期了
+			self.events.Expired(payload.Sid)
+		}
+		if err == nil {
+			sess.sid, sess.values, sess.expires, sess.created = payload.Sid, payload.Values, payload.Expires, payload.Created
+			stale := time.Now().Unix()-payload.Issued > atomic.LoadInt64(&self.max_life_time)/2
+			if rotated || stale {
+				//用旧密钥加密的，换成新密钥；或者需要续期
+				sess.lock.Lock()
+				defer sess.lock.Unlock()
+				if err := sess.flush(); err != nil {
+					return nil, false, err
+				}
+			}
+			return sess, false, nil
+		}
+	}
+	sid, err := cookieSid()
+	if err != nil {
+		return nil, false, err
+	}
+	sess.sid, sess.values, sess.created = sid, make(map[string][]byte), time.Now().Unix()
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+	if err := sess.flush(); err != nil {
+		return nil, false, err
+	}
+	return sess, true, nil
+}
+
+//解出session之后换成new_sid重新下发，数据保持不变
+func (self *CookieStorage) SessionRenew(w http.ResponseWriter, r *http.Request, cookie_name string, cookie_opts session.CookieOptions, new_sid string) (session.SessionV2, error) {
+	cs, fresh, err := self.load(w, r, cookie_name, cookie_opts)
+	if err != nil {
+		return nil, err
+	}
+	old_sid := cs.sid
+	cs.lock.Lock()
+	cs.sid = new_sid
+	err = cs.flush()
+	cs.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	//和服务端存储一样：原来没有session时算新建，否则算换sid
+	if fresh {
+		if self.events.Created != nil {
+			self.events.Created(r.Context(), new_sid)
+		}
+	} else if self.events.Regenerated != nil {
+		self.events.Regenerated(r.Context(), old_sid, new_sid)
+	}
+	return cs, nil
+}
+
+//让客户端删除session的全部cookie
+func (self *CookieStorage) SessionClear(w http.ResponseWriter, r *http.Request, cookie_name string, cookie_opts session.CookieOptions) {
+	value, chunks := cookieRead(r, cookie_name)
+	cookieReset(w, cookie_name)
+	cookieDelete(w, cookie_name, cookie_opts, 0, chunks)
+	if value == "" || self.events.Destroyed == nil {
+		return
+	}
+	if payload, _, err := self.decode(cookie_name, value); err == nil {
+		self.events.Destroyed(r.Context(), payload.Sid)
+	}
+}
+
+//实现session.EventReporter
+func (self *CookieStorage) SetEvents(events session.StorageEvents) {
+	self.events = events
+}
+
+/*
+ * CookieStorage实现StorageV2接口的：SessionInit/SessionFetch/SessionDestroy/SessionGC方法
+ * 服务端没有按sid保存的条目，只能通过manager（ClientStorage接口）使用
+ */
+func (self *CookieStorage) SessionInit(ctx context.Context, sid string) (session.SessionV2, error) {
+	return nil, fmt.Errorf("%w: cookie storage needs the request, use it through SessionManager", session.ErrNotSupported)
+}
+
+func (self *CookieStorage) SessionFetch(ctx context.Context, sid string) (session.SessionV2, error) {
+	return nil, fmt.Errorf("%w: cookie storage needs the request, use it through SessionManager", session.ErrNotSupported)
+}
+
+//服务端没有数据，删除cookie由SessionClear负责
+func (self *CookieStorage) SessionDestroy(ctx context.Context, sid string) error {
+	return nil
+}
+
+//过期时间保存在加密的数据里，不需要GC
+func (self *CookieStorage) SessionGC(ctx context.Context, max_life_time int64) error {
+	return nil
+}
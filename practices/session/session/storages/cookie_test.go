@@ -0,0 +1,294 @@
+package storages
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/gob"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hq-cml/GoHttpWeb/practices/session/session"
+)
+
+const cookie_test_name = "GOSESSID"
+
+var (
+	cookie_key1 = bytes.Repeat([]byte{1}, 32)
+	cookie_key2 = bytes.Repeat([]byte{2}, 32)
+)
+
+func newCookieStorage(t *testing.T, opts CookieStorageOptions) *CookieStorage {
+	t.Helper()
+	storage, err := NewCookieStorage(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage
+}
+
+//模拟浏览器：上一次响应下发的cookie（删除的除外）带到下一个请求上
+func cookieRequest(w *httptest.ResponseRecorder, jar map[string]string) *http.Request {
+	for _, c := range w.Result().Cookies() {
+		if c.MaxAge < 0 {
+			delete(jar, c.Name)
+		} else {
+			jar[c.Name] = c.Value
+		}
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	for name, value := range jar {
+		r.AddCookie(&http.Cookie{Name: name, Value: value})
+	}
+	return r
+}
+
+//加载session，返回CookieSession以便检查内部状态
+func cookieLoad(t *testing.T, storage *CookieStorage, w http.ResponseWriter, r *http.Request) *CookieSession {
+	t.Helper()
+	sess, err := storage.SessionLoad(w, r, cookie_test_name, session.CookieOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sess.(*CookieSession)
+}
+
+//不经过CookieSession，直接加密一个payload，用于构造过期的cookie
+func cookieSeal(t *testing.T, storage *CookieStorage, payload cookiePayload) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&payload); err != nil {
+		t.Fatal(err)
+	}
+	value, err := storage.seal(cookie_test_name, buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestCookieStorageRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	storage := newCookieStorage(t, CookieStorageOptions{Keys: [][]byte{cookie_key1}})
+	jar := map[string]string{}
+	w := httptest.NewRecorder()
+	sess := cookieLoad(t, storage, w, httptest.NewRequest("GET", "/", nil))
+	if err := sess.Set(ctx, "name", "tom"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Set(ctx, "roles", []string{"admin"}); err != nil {
+		t.Fatal(err)
+	}
+	if value := w.Result().Cookies()[0].Value; strings.Contains(value, "tom") || strings.Contains(value, sess.sid) {
+		t.Errorf("cookie value is not encrypted: %s", value)
+	}
+
+	w2 := httptest.NewRecorder()
+	loaded := cookieLoad(t, storage, w2, cookieRequest(w, jar))
+	if loaded.sid != sess.sid {
+		t.Errorf("sid = %s, want %s", loaded.sid, sess.sid)
+	}
+	if v, _ := loaded.Get(ctx, "name"); v != "tom" {
+		t.Errorf("name = %v", v)
+	}
+	if v, _ := loaded.Get(ctx, "roles"); !reflect.DeepEqual(v, []string{"admin"}) {
+		t.Errorf("roles = %v", v)
+	}
+	//刚写过的cookie，只读的请求不需要重新下发
+	if cookies := w2.Result().Cookies(); len(cookies) != 0 {
+		t.Errorf("read-only request rewrote %d cookies", len(cookies))
+	}
+}
+
+//被篡改的、用别的密钥加密的、换了名字的cookie都解不开，当做没有session
+func TestCookieStorageRejectsForgedCookies(t *testing.T) {
+	ctx := context.Background()
+	storage := newCookieStorage(t, CookieStorageOptions{Keys: [][]byte{cookie_key1}})
+	w := httptest.NewRecorder()
+	sess := cookieLoad(t, storage, w, httptest.NewRequest("GET", "/", nil))
+	sess.Set(ctx, "name", "tom")
+	value := w.Result().Cookies()[0].Value
+
+	data, _ := base64.RawURLEncoding.DecodeString(value)
+	data[len(data)/2] ^= 1
+	tampered := base64.RawURLEncoding.EncodeToString(data)
+	other := newCookieStorage(t, CookieStorageOptions{Keys: [][]byte{cookie_key2}})
+
+	cases := []struct {
+		desc    string
+		storage *CookieStorage
+		name    string
+		value   string
+	}{
+		{"tampered", storage, cookie_test_name, tampered},
+		{"wrong key", other, cookie_test_name, value},
+		{"other cookie name", storage, "OTHER", value},
+		{"not base64", storage, cookie_test_name, "!!!"},
+	}
+	for _, c := range cases {
+		if _, _, err := c.storage.decode(c.name, c.value); !errors.Is(err, errCookieInvalid) {
+			t.Errorf("%s: decode = %v, want errCookieInvalid", c.desc, err)
+		}
+	}
+	//通过SessionLoad加载时得到一个新的空session
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: cookie_test_name, Value: tampered})
+	loaded := cookieLoad(t, storage, httptest.NewRecorder(), r)
+	if loaded.sid == sess.sid {
+		t.Error("tampered cookie kept the sid")
+	}
+	if v, _ := loaded.Get(ctx, "name"); v != nil {
+		t.Errorf("tampered cookie kept the value %v", v)
+	}
+}
+
+//轮换密钥：新密钥放在最前面，旧cookie还能解开，并且马上用新密钥重新加密写回
+func TestCookieStorageKeyRotation(t *testing.T) {
+	ctx := context.Background()
+	old := newCookieStorage(t, CookieStorageOptions{Keys: [][]byte{cookie_key1}})
+	rotated := newCookieStorage(t, CookieStorageOptions{Keys: [][]byte{cookie_key2, cookie_key1}})
+	only_new := newCookieStorage(t, CookieStorageOptions{Keys: [][]byte{cookie_key2}})
+	jar := map[string]string{}
+
+	w := httptest.NewRecorder()
+	sess := cookieLoad(t, old, w, httptest.NewRequest("GET", "/", nil))
+	sess.Set(ctx, "name", "tom")
+
+	w2 := httptest.NewRecorder()
+	loaded := cookieLoad(t, rotated, w2, cookieRequest(w, jar))
+	if loaded.sid != sess.sid {
+		t.Fatalf("old cookie not accepted after rotation: sid %s, want %s", loaded.sid, sess.sid)
+	}
+	cookies := w2.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("old cookie not rewritten, got %d cookies", len(cookies))
+	}
+	if _, rewrapped, err := rotated.decode(cookie_test_name, cookies[0].Value); err != nil || rewrapped {
+		t.Errorf("rewritten cookie: rotated %v, err %v; want encrypted with the first key", rewrapped, err)
+	}
+
+	//旧密钥去掉之后，重新加密过的cookie依然可用
+	loaded = cookieLoad(t, only_new, httptest.NewRecorder(), cookieRequest(w2, jar))
+	if v, _ := loaded.Get(ctx, "name"); loaded.sid != sess.sid || v != "tom" {
+		t.Errorf("after dropping the old key: sid %s, name %v", loaded.sid, v)
+	}
+	//新密钥加密的cookie，只有旧密钥的storage解不开
+	if _, _, err := old.decode(cookie_test_name, jar[cookie_test_name]); !errors.Is(err, errCookieInvalid) {
+		t.Errorf("old key decrypted a cookie sealed with the new key: %v", err)
+	}
+}
+
+//数据超过一个cookie时切分成name、name.1...，读取时拼接起来；变小之后多出来的分片要删除
+func TestCookieStorageChunks(t *testing.T) {
+	ctx := context.Background()
+	storage := newCookieStorage(t, CookieStorageOptions{Keys: [][]byte{cookie_key1}})
+	jar := map[string]string{}
+	big := make([]byte, 2*cookie_chunk_size)
+	rand.Read(big)
+
+	w := httptest.NewRecorder()
+	sess := cookieLoad(t, storage, w, httptest.NewRequest("GET", "/", nil))
+	if err := sess.Set(ctx, "big", big); err != nil {
+		t.Fatal(err)
+	}
+	r := cookieRequest(w, jar)
+	if len(jar) < 3 {
+		t.Fatalf("got %d cookies, want at least 3 chunks", len(jar))
+	}
+	for i := 0; i < len(jar); i++ {
+		name := cookie_test_name
+		if i > 0 {
+			name += "." + strconv.Itoa(i)
+		}
+		if len(jar[name]) == 0 || len(jar[name]) > cookie_chunk_size {
+			t.Errorf("chunk %s has %d bytes", name, len(jar[name]))
+		}
+	}
+
+	w2 := httptest.NewRecorder()
+	loaded := cookieLoad(t, storage, w2, r)
+	if v, _ := loaded.Get(ctx, "big"); !bytes.Equal(v.([]byte), big) {
+		t.Error("reassembled value differs")
+	}
+	if err := loaded.Delete(ctx, "big"); err != nil {
+		t.Fatal(err)
+	}
+	cookieRequest(w2, jar)
+	if len(jar) != 1 || jar[cookie_test_name] == "" {
+		t.Errorf("cookies after shrinking: %v, want only %s", jar, cookie_test_name)
+	}
+}
+
+//超过MaxChunks时Set返回ErrValueTooLarge，修改被撤销，已经下发的cookie不变
+func TestCookieStorageMaxChunks(t *testing.T) {
+	ctx := context.Background()
+	storage := newCookieStorage(t, CookieStorageOptions{Keys: [][]byte{cookie_key1}, MaxChunks: 2})
+	w := httptest.NewRecorder()
+	sess := cookieLoad(t, storage, w, httptest.NewRequest("GET", "/", nil))
+	sess.Set(ctx, "name", "tom")
+	before := w.Header()["Set-Cookie"]
+
+	big := make([]byte, 2*cookie_chunk_size)
+	rand.Read(big)
+	if err := sess.Set(ctx, "big", big); !errors.Is(err, session.ErrValueTooLarge) {
+		t.Errorf("set past MaxChunks: %v, want ErrValueTooLarge", err)
+	}
+	if v, _ := sess.Get(ctx, "big"); v != nil {
+		t.Error("oversized value kept after a failed set")
+	}
+	if after := w.Header()["Set-Cookie"]; !reflect.DeepEqual(after, before) {
+		t.Errorf("Set-Cookie changed by a failed set: %v, was %v", after, before)
+	}
+}
+
+//空闲超时和绝对超时都在解密时检查，过期的cookie当做没有session，并报告Expired
+func TestCookieStorageExpiry(t *testing.T) {
+	ctx := context.Background()
+	storage := newCookieStorage(t, CookieStorageOptions{Keys: [][]byte{cookie_key1}})
+	var expired []string
+	storage.SetEvents(session.StorageEvents{Expired: func(sid string) { expired = append(expired, sid) }})
+	now := time.Now().Unix()
+
+	cases := []struct {
+		desc             string
+		payload          cookiePayload
+		absolute_timeout int64
+	}{
+		{"idle", cookiePayload{Sid: "idle", Expires: now - 1, Created: now - 100, Issued: now - 100}, 0},
+		{"absolute", cookiePayload{Sid: "absolute", Expires: now + 100, Created: now - 100, Issued: now}, 60},
+	}
+	for _, c := range cases {
+		storage.SetAbsoluteTimeout(c.absolute_timeout)
+		expired = nil
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: cookie_test_name, Value: cookieSeal(t, storage, c.payload)})
+		sess := cookieLoad(t, storage, httptest.NewRecorder(), r)
+		if sess.sid == c.payload.Sid {
+			t.Errorf("%s: expired cookie accepted", c.desc)
+		}
+		if !reflect.DeepEqual(expired, []string{c.payload.Sid}) {
+			t.Errorf("%s: expired events %v, want [%s]", c.desc, expired, c.payload.Sid)
+		}
+	}
+
+	//没有过期的cookie正常加载，过期时间随写入往后推
+	storage.SetAbsoluteTimeout(0)
+	storage.SetMaxLifeTime(3600)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: cookie_test_name, Value: cookieSeal(t, storage, cookiePayload{Sid: "live", Expires: now + 10, Created: now, Issued: now})})
+	sess := cookieLoad(t, storage, httptest.NewRecorder(), r)
+	if sess.sid != "live" {
+		t.Fatalf("live cookie not accepted, got sid %s", sess.sid)
+	}
+	sess.Set(ctx, "k", 1)
+	if sess.expires < now+3600 {
+		t.Errorf("expires %d not pushed to now+3600", sess.expires)
+	}
+}
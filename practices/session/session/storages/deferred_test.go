@@ -0,0 +1,236 @@
+package storages
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hq-cml/GoHttpWeb/practices/session/session"
+)
+
+//延迟写回的manager，每个请求带上上一个响应下发的cookie
+type deferredClient struct {
+	t       *testing.T
+	manager *session.SessionManager
+	cookie  *http.Cookie
+}
+
+func newDeferredClient(t *testing.T, storage session.StorageV2, opts ...session.Option) *deferredClient {
+	t.Helper()
+	manager, err := session.New(storage, append(opts, session.WithDeferredWrites())...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(manager.Close)
+	return &deferredClient{t: t, manager: manager}
+}
+
+//不经过Middleware的请求，fn返回之后调用Save
+func (self *deferredClient) request(fn func(sess session.Session)) {
+	self.t.Helper()
+	r := httptest.NewRequest("GET", "/", nil)
+	if self.cookie != nil {
+		r.AddCookie(self.cookie)
+	}
+	w := httptest.NewRecorder()
+	sess, err := self.manager.SessionStart(w, r)
+	if err != nil {
+		self.t.Fatal(err)
+	}
+	fn(sess)
+	if err := session.Save(sess); err != nil {
+		self.t.Fatal(err)
+	}
+	for _, c := range w.Result().Cookies() {
+		self.cookie = c
+	}
+}
+
+//记录假redis收到的写命令
+func recordWrites(fake *fakeRedis) func() []string {
+	var lock sync.Mutex
+	var writes []string
+	fake.before = func(args []string) {
+		switch args[0] {
+		case "EVAL", "HSET", "HMSET", "HDEL":
+			lock.Lock()
+			writes = append(writes, args[0])
+			lock.Unlock()
+		}
+	}
+	return func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		result := writes
+		writes = nil
+		return result
+	}
+}
+
+//没有修改的请求不写存储；有修改的请求只提交一次
+func TestDeferredWritesCommitOnlyChanges(t *testing.T) {
+	fake := newFakeRedis(t)
+	client := newDeferredClient(t, newFakeRedisStorage(fake, RedisOptions{}))
+	client.request(func(sess session.Session) {})
+	writes := recordWrites(fake)
+
+	client.request(func(sess session.Session) {
+		sess.Set("a", 1)
+		sess.Set("b", 2)
+		sess.Delete("c")
+	})
+	if got := writes(); len(got) != 1 || got[0] != "EVAL" {
+		t.Errorf("request with changes sent %v, want one EVAL", got)
+	}
+	client.request(func(sess session.Session) {
+		if v := sess.Get("a"); v != 1 {
+			t.Errorf("a = %v", v)
+		}
+		sess.Get("b")
+	})
+	if got := writes(); len(got) != 0 {
+		t.Errorf("read-only request sent %v", got)
+	}
+	//Save可以调用多次，后面几次没有新的修改
+	client.request(func(sess session.Session) {
+		sess.Set("a", 3)
+		session.Save(sess)
+		session.Save(sess)
+	})
+	if got := writes(); len(got) != 1 {
+		t.Errorf("repeated Save sent %v, want one write", got)
+	}
+}
+
+//请求里能读到自己还没有提交的修改，提交之前其他请求看不到
+func TestDeferredWritesReadOwnWrites(t *testing.T) {
+	cases := map[string]func() session.StorageV2{
+		"memory": func() session.StorageV2 { return NewMemStorage(MemOptions{}) },
+		"redis":  func() session.StorageV2 { return newFakeRedisStorage(newFakeRedis(t), RedisOptions{}) },
+	}
+	for name, storage := range cases {
+		client := newDeferredClient(t, storage())
+		client.request(func(sess session.Session) {
+			sess.Set("kept", "v")
+			sess.Set("gone", "v")
+		})
+		client.request(func(sess session.Session) {
+			sess.Set("new", "n")
+			sess.Delete("gone")
+			sess.Set("kept", "changed")
+			if v := sess.Get("new"); v != "n" {
+				t.Errorf("%s: pending set reads %v", name, v)
+			}
+			if v := sess.Get("gone"); v != nil {
+				t.Errorf("%s: pending delete reads %v", name, v)
+			}
+			if v := sess.Get("kept"); v != "changed" {
+				t.Errorf("%s: overwritten value reads %v", name, v)
+			}
+			//删除之后再写入，读到新值
+			sess.Set("gone", "back")
+			if v := sess.Get("gone"); v != "back" {
+				t.Errorf("%s: set after delete reads %v", name, v)
+			}
+			sess.Delete("gone")
+
+			//同一个session的另一个请求，在提交之前看到的还是原来的值
+			r := httptest.NewRequest("GET", "/", nil)
+			r.AddCookie(client.cookie)
+			other, err := client.manager.SessionStart(httptest.NewRecorder(), r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v := other.Get("kept"); v != "v" {
+				t.Errorf("%s: uncommitted change visible to another request: %v", name, v)
+			}
+		})
+		client.request(func(sess session.Session) {
+			for key, want := range map[string]interface{}{"new": "n", "gone": nil, "kept": "changed"} {
+				if v := sess.Get(key); v != want {
+					t.Errorf("%s: committed %s = %v, want %v", name, key, v, want)
+				}
+			}
+		})
+	}
+}
+
+//没有实现BatchStorage的storage不能开启延迟写回；不开启时修改直接写回，Save什么都不做
+func TestDeferredWritesWithoutBatchStorage(t *testing.T) {
+	storage := NewFileStorage(FileOptions{Dir: filepath.Join(t.TempDir(), "sessions")})
+	if _, err := session.New(storage, session.WithDeferredWrites()); !errors.Is(err, session.ErrNotSupported) {
+		t.Fatalf("deferred writes on file storage: %v, want ErrNotSupported", err)
+	}
+	manager, err := session.New(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+	sess, err := manager.SessionStart(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.Set("k", "v")
+	fetched, err := storage.SessionFetch(context.Background(), sess.SessionID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := fetched.Get(context.Background(), "k"); v != "v" {
+		t.Errorf("write-through value = %v", v)
+	}
+	if err := session.Save(sess); err != nil {
+		t.Errorf("Save without deferred writes: %v", err)
+	}
+}
+
+//提交失败：Save返回错误，修改保留可以再次提交；经过Middleware时错误写进日志
+func TestDeferredWritesSaveError(t *testing.T) {
+	fake := newFakeRedis(t)
+	var logged bytes.Buffer
+	client := newDeferredClient(t, newFakeRedisStorage(fake, RedisOptions{}), session.WithLogger(log.New(&logged, "", 0)))
+	client.request(func(sess session.Session) {})
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(client.cookie)
+	sess, err := client.manager.SessionStart(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.Set("k", "v")
+	fake.setDown(true)
+	if err := session.Save(sess); !errors.Is(err, session.ErrStorageUnavailable) {
+		t.Errorf("Save with redis down: %v, want ErrStorageUnavailable", err)
+	}
+	fake.setDown(false)
+	if err := session.Save(sess); err != nil {
+		t.Fatalf("Save after redis recovered: %v", err)
+	}
+	client.request(func(sess session.Session) {
+		if v := sess.Get("k"); v != "v" {
+			t.Errorf("value after retried Save = %v", v)
+		}
+	})
+
+	handler := client.manager.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sess, err := session.FromContext(r.Context())
+		if err != nil {
+			return
+		}
+		sess.Set("k", "lost")
+		fake.setDown(true)
+	}))
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(client.cookie)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	fake.setDown(false)
+	if !strings.Contains(logged.String(), "commit failed") || !strings.Contains(logged.String(), session.ErrStorageUnavailable.Error()) {
+		t.Errorf("log %q, want the commit error", logged.String())
+	}
+}
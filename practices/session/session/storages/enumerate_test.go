@@ -0,0 +1,141 @@
+package storages
+
+import (
+	"context"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hq-cml/GoHttpWeb/practices/session/session"
+)
+
+/*
+ * 通过manager分页遍历：每个存活的session恰好出现一次，页与页之间不重不漏，最后一页的next为""
+ * expire让storage里的一个session过期（还没有被GC），它不应当出现在结果中
+ */
+func testListSessions(t *testing.T, name string, storage session.StorageV2, expire func(sid string)) {
+	manager, err := session.New(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+	ctx := context.Background()
+	var sids []string
+	for i := 0; i < 26; i++ {
+		sess, err := manager.SessionStart(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sids = append(sids, sess.SessionID())
+	}
+	expire(sids[7])
+	alive := append(append([]string{}, sids[:7]...), sids[8:]...)
+	sort.Strings(alive)
+
+	for _, limit := range []int{1, 5, 10, 25, 26, 100} {
+		var listed []string
+		pages := 0
+		for cursor := ""; ; pages++ {
+			page, next, err := manager.ListSessions(ctx, cursor, limit)
+			if err != nil {
+				t.Fatalf("%s: limit %d, cursor %q: %v", name, limit, cursor, err)
+			}
+			if len(page) > limit {
+				t.Errorf("%s: limit %d: page of %d", name, limit, len(page))
+			}
+			listed = append(listed, page...)
+			if next == "" {
+				break
+			}
+			if next == cursor || pages > len(sids) {
+				t.Fatalf("%s: limit %d: cursor %q does not advance", name, limit, next)
+			}
+			cursor = next
+		}
+		sort.Strings(listed)
+		if len(listed) != len(alive) {
+			t.Errorf("%s: limit %d: listed %d sessions, want %d", name, limit, len(listed), len(alive))
+			continue
+		}
+		for i := range listed {
+			if listed[i] != alive[i] {
+				t.Errorf("%s: limit %d: listed %v, want %v", name, limit, listed, alive)
+				break
+			}
+		}
+		//redis的页按索引的下标划分，过期的sid也占位置，所以按全部的sid计算页数的上限
+		if max := len(sids)/limit + 1; pages+1 > max {
+			t.Errorf("%s: limit %d: %d pages, want at most %d", name, limit, pages+1, max)
+		}
+	}
+	//limit<=0时使用默认的页大小
+	if page, next, err := manager.ListSessions(ctx, "", 0); err != nil || next != "" || len(page) != len(alive) {
+		t.Errorf("%s: default limit: %d sessions, next %q, %v", name, len(page), next, err)
+	}
+	count, err := manager.CountSessions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//redis的计数包括还没有被GC清理出索引的sid
+	if count != len(alive) && count != len(sids) {
+		t.Errorf("%s: count %d, want %d", name, count, len(alive))
+	}
+}
+
+func TestListSessionsMemory(t *testing.T) {
+	storage := NewMemStorage(MemOptions{Shards: 4})
+	testListSessions(t, "memory", storage, func(sid string) {
+		shard := storage.shard(sid)
+		shard.lock.Lock()
+		shard.sessions[sid].Value.(*MemSession).time_accessed = time.Now().Add(-2 * time.Hour)
+		shard.lock.Unlock()
+	})
+}
+
+func TestListSessionsRedis(t *testing.T) {
+	fake := newFakeRedis(t)
+	storage := newFakeRedisStorage(fake, RedisOptions{})
+	testListSessions(t, "redis", storage, func(sid string) { fake.expireKey(storage.key(sid)) })
+}
+
+//redis一页只需要一次往返，不会对每个sid发一个EXISTS
+func TestRedisListOneRoundTripPerPage(t *testing.T) {
+	fake := newFakeRedis(t)
+	storage := newFakeRedisStorage(fake, RedisOptions{})
+	ctx := context.Background()
+	for _, sid := range []string{"a", "b", "c", "d", "e"} {
+		storage.SessionInit(ctx, sid)
+	}
+	fake.expireKey(storage.key("c"))
+	var lock sync.Mutex
+	var commands []string
+	fake.before = func(args []string) {
+		lock.Lock()
+		defer lock.Unlock()
+		commands = append(commands, args[0])
+	}
+	sids, next, err := storage.SessionList(ctx, "", 10)
+	if err != nil || next != "" || len(sids) != 4 {
+		t.Errorf("SessionList = %v, %q, %v", sids, next, err)
+	}
+	if n, err := storage.SessionGCCount(ctx, 3600); n != 1 || err != nil {
+		t.Errorf("GC = %d, %v, want 1", n, err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	//list一次EVAL；GC读索引一次EVAL，之后只为过期的c清理索引
+	evals := 0
+	for _, cmd := range commands {
+		switch cmd {
+		case "EVAL":
+			evals++
+		case "EXISTS", "ZRANGE":
+			t.Errorf("per-member command %s in %v", cmd, commands)
+		}
+	}
+	if evals != 2 {
+		t.Errorf("commands %v, want one EVAL per page", commands)
+	}
+}
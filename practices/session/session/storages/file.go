@@ -0,0 +1,608 @@
+package storages
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"github.com/hq-cml/GoHttpWeb/practices/session/session"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * 文件Session实现，实现Session接口
+ * 本身不缓存数据，每次读写都直接操作sid对应的文件
+ */
+type FileSession struct {
+	sid     string       //session id唯一标示
+	created int64        //创建时间（unix秒）
+	storage *FileStorage //所属的storage
+}
+
+/*
+ * 文件存储实现，这个结构实现Storage接口
+ * 单机部署、又需要在重启之后保留session的时候使用，不需要额外跑一个redis
+ *
+ * 1. 每个sid对应目录下的一个文件，内容是gob编码的fileData（创建时间和map[string][]byte），value由codec序列化
+ * 2. 写文件时先写临时文件再rename，rename是原子的，读的人不会看到写了一半的文件
+ * 3. 同一个sid的读改写由分段锁串行化：进程内是互斥锁，进程之间是目录下每段一个的锁文件上的flock，
+ *    多个进程（比如平滑重启时新旧两个进程）可以共用一个目录；没有flock的系统上只在本进程内有效
+ * 4. 文件的mtime就是最后访问时间，GC按mtime删除空闲超时的文件；设置了绝对超时时还要读出创建时间检查
+ * 5. sid会被拼进文件路径，只接受base64url字符，防止../之类的路径穿越
+ * 6. 目录（默认在公共的临时目录下）可能被别的用户抢先创建，那样他就能读到、甚至伪造session，
+ *    所以第一次使用之前检查目录的属主必须是当前用户、并且其他人没有任何权限，否则所有操作都返回ErrStorageUnavailable；
+ *    目录不能是符号链接，否则检查的是链接本身，session实际写到了链接指向的、没有检查过的目录里
+ */
+type FileStorage struct {
+	dir              string                        //存放session文件的目录
+	perm             os.FileMode                   //文件权限
+	locks            [file_lock_stripes]sync.Mutex //按sid分段的锁，进程内的部分，见lockStripe
+	max_life_time    int64                         //空闲超时（秒），原子操作
+	absolute_timeout int64                         //绝对超时（秒），0表示不限制，原子操作
+	codec            session.Codec                 //值的序列化方式，默认gob
+	events           session.StorageEvents         //manager设置的事件回调，报告过期的条目
+	dir_checked      int32                         //目录已经通过了checkDir的检查，原子操作
+}
+
+//session文件的内容
+type fileData struct {
+	Created int64             //创建时间（unix秒）
+	Values  map[string][]byte //经过codec序列化的值
+}
+
+//文件存储的配置
+type FileOptions struct {
+	Dir  string      //存放session文件的目录，默认是系统临时目录下的gosessions，必须是当前用户独占的目录
+	Perm os.FileMode //文件权限，默认0600
+}
+
+const (
+	file_lock_stripes = 64
+	file_prefix       = "sess_"       //session文件名的前缀
+	file_tmp_prefix   = ".tmp_sess_"  //写入过程中的临时文件的前缀
+	file_lock_prefix  = ".lock_sess_" //分段锁文件的前缀，后面是段号
+)
+
+//sid不是合法的文件名，包装ErrInvalidKey，manager据此换一个自己生成的sid
+var errInvalidSid = fmt.Errorf("%w: invalid session id", session.ErrInvalidKey)
+
+func init() {
+	fmt.Println("File storage init")
+	session.RegisterV2("file", NewFileStorage(FileOptions{}))
+}
+
+//创建文件存储，目录在第一次使用时创建并检查
+func NewFileStorage(opts FileOptions) *FileStorage {
+	if opts.Dir == "" {
+		opts.Dir = filepath.Join(os.TempDir(), "gosessions")
+	}
+	if opts.Perm == 0 {
+		opts.Perm = 0600
+	}
+	return &FileStorage{dir: opts.Dir, perm: opts.Perm, max_life_time: default_life_time, codec: session.GobCodec{}}
+}
+
+//实现session.LifeTimeAware，过期但还没被GC的文件在SessionFetch时也视为不存在
+func (self *FileStorage) SetMaxLifeTime(max_life_time int64) {
+	atomic.StoreInt64(&self.max_life_time, max_life_time)
+}
+
+//实现session.AbsoluteTimeoutAware
+func (self *FileStorage) SetAbsoluteTimeout(absolute_timeout int64) {
+	atomic.StoreInt64(&self.absolute_timeout, absolute_timeout)
+}
+
+//实现session.CodecAware，应当在开始使用之前设置
+func (self *FileStorage) SetCodec(codec session.Codec) {
+	self.codec = codec
+}
+
+//sid的最大长度，sql存储的sid列是VARBINARY(128)
+const max_sid_len = 128
+
+//sid只能由base64url字符组成，不能为空，也不能太长；sql存储也用它检查，客户端带来的sid不能被数据库截断
+func validSid(sid string) bool {
+	if sid == "" || len(sid) > max_sid_len {
+		return false
+	}
+	for _, c := range sid {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '=':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func (self *FileStorage) path(sid string) string {
+	return filepath.Join(self.dir, file_prefix+sid)
+}
+
+func (self *FileStorage) stripe(sid string) int {
+	h := fnv.New32a()
+	h.Write([]byte(sid))
+	return int(h.Sum32() % file_lock_stripes)
+}
+
+//锁住sid所在的段，返回解锁的函数
+func (self *FileStorage) lock(sid string) (func(), error) {
+	return self.lockStripe(self.stripe(sid))
+}
+
+/*
+ * 锁住第i段：先拿进程内的互斥锁，再对这一段的锁文件加flock，其他进程的同一段就要等待
+ * 锁文件建好之后一直留在目录里，从不删除或者替换，所以不会出现“锁住的文件已经被别人删掉、换成了新文件”的情况
+ * session文件本身会被rename替换，不能直接在它上面加锁
+ * flock不受ctx控制，持有锁的一方只做几次文件读写，等待的时间很短
+ */
+func (self *FileStorage) lockStripe(i int) (func(), error) {
+	self.locks[i].Lock()
+	file, err := os.OpenFile(filepath.Join(self.dir, fmt.Sprintf("%s%02d", file_lock_prefix, i)), os.O_RDWR|os.O_CREATE, self.perm)
+	if err == nil {
+		if err = lockFile(file); err != nil {
+			file.Close()
+		}
+	}
+	if err != nil {
+		self.locks[i].Unlock()
+		return nil, fmt.Errorf("%w: %v", session.ErrStorageUnavailable, err)
+	}
+	return func() {
+		//关闭文件同时释放flock
+		file.Close()
+		self.locks[i].Unlock()
+	}, nil
+}
+
+//读出sid对应的全部数据，文件不存在时返回ErrSessionNotFound，调用方持有锁
+func (self *FileStorage) load(sid string) (*fileData, error) {
+	data, err := os.ReadFile(self.path(sid))
+	if os.IsNotExist(err) {
+		return nil, session.ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", session.ErrStorageUnavailable, err)
+	}
+	var file_data fileData
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&file_data); err != nil {
+		return nil, fmt.Errorf("session: corrupt session file %s: %w", sid, err)
+	}
+	if file_data.Values == nil {
+		file_data.Values = make(map[string][]byte)
+	}
+	return &file_data, nil
+}
+
+//把数据写入临时文件，再rename成sid对应的文件，调用方持有锁
+func (self *FileStorage) save(sid string, file_data *fileData) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(file_data); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(self.dir, file_tmp_prefix+"*")
+	if err != nil {
+		return fmt.Errorf("%w: %v", session.ErrStorageUnavailable, err)
+	}
+	_, err = tmp.Write(buf.Bytes())
+	if err == nil {
+		err = tmp.Chmod(self.perm)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if close_err := tmp.Close(); err == nil {
+		err = close_err
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), self.path(sid))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("%w: %v", session.ErrStorageUnavailable, err)
+	}
+	return nil
+}
+
+/*
+ * 目录不存在时以0700创建；已经存在时，必须是当前用户的目录，并且group和other没有任何权限
+ * 检查通过之后不再重复检查；没有通过时每次都重新检查，修好目录的权限之后不需要重启
+ */
+func (self *FileStorage) checkDir() error {
+	if atomic.LoadInt32(&self.dir_checked) == 1 {
+		return nil
+	}
+	if err := os.MkdirAll(self.dir, 0700); err != nil {
+		return fmt.Errorf("%w: %v", session.ErrStorageUnavailable, err)
+	}
+	//用Lstat检查目录本身，而不是符号链接指向的目录
+	info, err := os.Lstat(self.dir)
+	if err != nil {
+		return fmt.Errorf("%w: %v", session.ErrStorageUnavailable, err)
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("%w: session dir %s is a symlink", session.ErrStorageUnavailable, self.dir)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%w: session dir %s is not a directory", session.ErrStorageUnavailable, self.dir)
+	}
+	if uid, ok := fileOwner(info); ok && uid != os.Getuid() {
+		return fmt.Errorf("%w: session dir %s is owned by uid %d, not by us", session.ErrStorageUnavailable, self.dir, uid)
+	}
+	if perm := info.Mode().Perm(); perm&0077 != 0 {
+		return fmt.Errorf("%w: session dir %s is accessible by other users (mode %v)", session.ErrStorageUnavailable, self.dir, perm)
+	}
+	atomic.StoreInt32(&self.dir_checked, 1)
+	return nil
+}
+
+//更新文件的mtime，即最后访问时间，调用方持有锁
+func (self *FileStorage) touch(sid string) error {
+	now := time.Now()
+	err := os.Chtimes(self.path(sid), now, now)
+	if os.IsNotExist(err) {
+		return session.ErrSessionNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", session.ErrStorageUnavailable, err)
+	}
+	return nil
+}
+
+//文件是否已经空闲超时
+func (self *FileStorage) expired(info os.FileInfo, max_life_time int64) bool {
+	return info.ModTime().Unix()+max_life_time < time.Now().Unix()
+}
+
+//实现session.EventReporter
+func (self *FileStorage) SetEvents(events session.StorageEvents) {
+	self.events = events
+}
+
+//报告过期被删除的session，在锁外调用
+func (self *FileStorage) expiredSids(sids ...string) {
+	if self.events.Expired == nil {
+		return
+	}
+	for _, sid := range sids {
+		self.events.Expired(sid)
+	}
+}
+
+//创建时间为created的session是否已经绝对超时
+func (self *FileStorage) tooOld(created int64) bool {
+	absolute_timeout := atomic.LoadInt64(&self.absolute_timeout)
+	return absolute_timeout > 0 && created+absolute_timeout < time.Now().Unix()
+}
+
+//在sid的锁内执行fn，fn拿到当前数据，返回true表示需要写回
+func (self *FileStorage) update(ctx context.Context, sid string, fn func(values map[string][]byte) bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := self.checkDir(); err != nil {
+		return err
+	}
+	unlock, err := self.lock(sid)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	file_data, err := self.load(sid)
+	if err != nil {
+		return err
+	}
+	if !fn(file_data.Values) {
+		return self.touch(sid)
+	}
+	return self.save(sid, file_data)
+}
+
+/*
+ * FileSession实现SessionV2接口的：Set/Get/Delete/SessionID方法
+ * key只支持string；value经过storage的codec序列化之后写入文件
+ * 文件已经被删除（销毁或者GC）之后再操作会返回ErrSessionNotFound
+ */
+func (self *FileSession) Set(ctx context.Context, key, value interface{}) error {
+	k, ok := key.(string)
+	if !ok {
+		return fmt.Errorf("%w: file session key must be string, got %T", session.ErrInvalidKey, key)
+	}
+	v, err := self.storage.codec.Encode(value)
+	if err != nil {
+		return err
+	}
+	return self.storage.update(ctx, self.sid, func(values map[string][]byte) bool {
+		values[k] = v
+		return true
+	})
+}
+
+//值不存在时返回nil, nil
+func (self *FileSession) Get(ctx context.Context, key interface{}) (interface{}, error) {
+	k, ok := key.(string)
+	if !ok {
+		return nil, fmt.Errorf("%w: file session key must be string, got %T", session.ErrInvalidKey, key)
+	}
+	var v []byte
+	var exists bool
+	err := self.storage.update(ctx, self.sid, func(values map[string][]byte) bool {
+		v, exists = values[k]
+		return false
+	})
+	if err != nil || !exists {
+		return nil, err
+	}
+	return self.storage.codec.Decode(v)
+}
+
+func (self *FileSession) Delete(ctx context.Context, key interface{}) error {
+	k, ok := key.(string)
+	if !ok {
+		return fmt.Errorf("%w: file session key must be string, got %T", session.ErrInvalidKey, key)
+	}
+	return self.storage.update(ctx, self.sid, func(values map[string][]byte) bool {
+		if _, exists := values[k]; !exists {
+			return false
+		}
+		delete(values, k)
+		return true
+	})
+}
+
+func (self *FileSession) SessionID() string {
+	return self.sid
+}
+
+//实现session.CreationAware
+func (self *FileSession) SessionCreated() int64 {
+	return self.created
+}
+
+/*
+ * FileStorage实现StorageV2接口的：SessionInit/SessionFetch/SessionDestroy/SessionGC方法
+ */
+//当新来一个用户的时候，创建一个空的session文件
+func (self *FileStorage) SessionInit(ctx context.Context, sid string) (session.SessionV2, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if !validSid(sid) {
+		return nil, errInvalidSid
+	}
+	if err := self.checkDir(); err != nil {
+		return nil, err
+	}
+	unlock, err := self.lock(sid)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	created := time.Now().Unix()
+	if err := self.save(sid, &fileData{Created: created, Values: map[string][]byte{}}); err != nil {
+		return nil, err
+	}
+	return &FileSession{sid: sid, created: created, storage: self}, nil
+}
+
+//sid对应的文件存在且没有过期（空闲超时或者绝对超时）时返回，并更新mtime；否则返回ErrSessionNotFound
+//非法的sid（比如包含路径分隔符）一律视为不存在
+func (self *FileStorage) SessionFetch(ctx context.Context, sid string) (session.SessionV2, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if !validSid(sid) {
+		return nil, session.ErrSessionNotFound
+	}
+	if err := self.checkDir(); err != nil {
+		return nil, err
+	}
+	//删除了过期的文件时，解锁之后再报告（defer按相反的顺序执行）
+	expired := false
+	defer func() {
+		if expired {
+			self.expiredSids(sid)
+		}
+	}()
+	unlock, err := self.lock(sid)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	info, err := os.Stat(self.path(sid))
+	if os.IsNotExist(err) {
+		return nil, session.ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", session.ErrStorageUnavailable, err)
+	}
+	if self.expired(info, atomic.LoadInt64(&self.max_life_time)) {
+		expired = os.Remove(self.path(sid)) == nil
+		return nil, session.ErrSessionNotFound
+	}
+	file_data, err := self.load(sid)
+	if err != nil {
+		return nil, err
+	}
+	if self.tooOld(file_data.Created) {
+		expired = os.Remove(self.path(sid)) == nil
+		return nil, session.ErrSessionNotFound
+	}
+	if err := self.touch(sid); err != nil {
+		return nil, err
+	}
+	return &FileSession{sid: sid, created: file_data.Created, storage: self}, nil
+}
+
+//删除sid对应的文件
+func (self *FileStorage) SessionDestroy(ctx context.Context, sid string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !validSid(sid) {
+		return nil
+	}
+	if err := self.checkDir(); err != nil {
+		return err
+	}
+	unlock, err := self.lock(sid)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := os.Remove(self.path(sid)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("%w: %v", session.ErrStorageUnavailable, err)
+	}
+	return nil
+}
+
+//把old_sid对应的文件rename成new_sid对应的文件，old_sid不存在或者已经过期时返回ErrSessionNotFound
+func (self *FileStorage) SessionRegenerate(ctx context.Context, old_sid, new_sid string) (session.SessionV2, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if !validSid(old_sid) {
+		return nil, session.ErrSessionNotFound
+	}
+	if !validSid(new_sid) {
+		return nil, errInvalidSid
+	}
+	if err := self.checkDir(); err != nil {
+		return nil, err
+	}
+	//删除了过期的文件时，解锁之后再报告（defer按相反的顺序执行）
+	expired := false
+	defer func() {
+		if expired {
+			self.expiredSids(old_sid)
+		}
+	}()
+	//按段号从小到大加锁，避免死锁
+	i, j := self.stripe(old_sid), self.stripe(new_sid)
+	if i > j {
+		i, j = j, i
+	}
+	unlock, err := self.lockStripe(i)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if i != j {
+		unlock, err := self.lockStripe(j)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+	}
+	//和SessionFetch一样，过期但还没被GC的文件视为不存在，不能借着换sid复活
+	info, err := os.Stat(self.path(old_sid))
+	if os.IsNotExist(err) {
+		return nil, session.ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", session.ErrStorageUnavailable, err)
+	}
+	if self.expired(info, atomic.LoadInt64(&self.max_life_time)) {
+		expired = os.Remove(self.path(old_sid)) == nil
+		return nil, session.ErrSessionNotFound
+	}
+	//创建时间随文件一起迁移，换sid不会延长绝对超时
+	file_data, err := self.load(old_sid)
+	if err != nil {
+		return nil, err
+	}
+	if self.tooOld(file_data.Created) {
+		expired = os.Remove(self.path(old_sid)) == nil
+		return nil, session.ErrSessionNotFound
+	}
+	err = os.Rename(self.path(old_sid), self.path(new_sid))
+	if os.IsNotExist(err) {
+		return nil, session.ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", session.ErrStorageUnavailable, err)
+	}
+	if err := self.touch(new_sid); err != nil {
+		return nil, err
+	}
+	return &FileSession{sid: new_sid, created: file_data.Created, storage: self}, nil
+}
+
+//GC，遍历目录，删除mtime+max_life_time比当前时间还小的session文件，以及残留的临时文件
+func (self *FileStorage) SessionGC(ctx context.Context, max_life_time int64) error {
+	_, err := self.SessionGCCount(ctx, max_life_time)
+	return err
+}
+
+//实现session.GCCounter，返回删除的session文件数（不含临时文件）
+func (self *FileStorage) SessionGCCount(ctx context.Context, max_life_time int64) (int, error) {
+	if err := self.checkDir(); err != nil {
+		return 0, err
+	}
+	entries, err := os.ReadDir(self.dir)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", session.ErrStorageUnavailable, err)
+	}
+	var gc_err error
+	count := 0
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return count, err
+		}
+		name := entry.Name()
+		switch {
+		case strings.HasPrefix(name, file_prefix):
+			sid := strings.TrimPrefix(name, file_prefix)
+			removed, err := self.gcFile(sid, max_life_time)
+			if err != nil {
+				gc_err = err
+			}
+			if removed {
+				self.expiredSids(sid)
+				count++
+			}
+		case strings.HasPrefix(name, file_tmp_prefix):
+			//写入过程中崩溃留下的临时文件
+			if info, err := entry.Info(); err == nil && self.expired(info, max_life_time) {
+				os.Remove(filepath.Join(self.dir, name))
+			}
+		}
+	}
+	return count, gc_err
+}
+
+//持有锁再检查一遍mtime，避免删掉GC遍历期间刚刚被访问过的文件；设置了绝对超时时还要读出创建时间
+//返回值表示是否删除了文件
+func (self *FileStorage) gcFile(sid string, max_life_time int64) (bool, error) {
+	unlock, err := self.lock(sid)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	info, err := os.Stat(self.path(sid))
+	if err != nil {
+		return false, nil
+	}
+	if !self.expired(info, max_life_time) {
+		if atomic.LoadInt64(&self.absolute_timeout) == 0 {
+			return false, nil
+		}
+		file_data, err := self.load(sid)
+		if err != nil || !self.tooOld(file_data.Created) {
+			return false, nil
+		}
+	}
+	if err := os.Remove(self.path(sid)); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("%w: %v", session.ErrStorageUnavailable, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,18 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package storages
+
+import (
+	"os"
+	"syscall"
+)
+
+//对整个文件加排他的flock，阻塞到拿到锁为止；文件关闭时自动释放
+func lockFile(file *os.File) error {
+	for {
+		err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
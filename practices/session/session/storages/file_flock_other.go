@@ -0,0 +1,12 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package storages
+
+import (
+	"os"
+)
+
+//没有flock的系统上不加文件锁，只有进程内的分段锁，不要让多个进程共用一个目录
+func lockFile(file *os.File) error {
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package storages
+
+import (
+	"os"
+)
+
+//没有uid的系统上不检查属主，只检查权限位
+func fileOwner(info os.FileInfo) (int, bool) {
+	return 0, false
+}
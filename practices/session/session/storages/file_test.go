@@ -0,0 +1,219 @@
+package storages
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hq-cml/GoHttpWeb/practices/session/session"
+)
+
+func TestFileStorageRoundTrip(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "sessions")
+	storage := NewFileStorage(FileOptions{Dir: dir})
+	ctx := context.Background()
+	sess, err := storage.SessionInit(ctx, "sid1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Set(ctx, "k", []string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	fetched, err := storage.SessionFetch(ctx, "sid1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := fetched.Get(ctx, "k"); len(v.([]string)) != 1 {
+		t.Errorf("Get = %v", v)
+	}
+	//目录是新建的，只有自己能访问
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0700 {
+		t.Errorf("dir mode %v, want 0700", perm)
+	}
+	if _, err := storage.SessionFetch(ctx, "../etc/passwd"); !errors.Is(err, session.ErrSessionNotFound) {
+		t.Errorf("fetch with path in sid: %v, want ErrSessionNotFound", err)
+	}
+}
+
+//客户端带来的sid不是合法的文件名时，manager换一个自己生成的sid，而不是每个请求都返回503
+func TestFileStorageInvalidClientSid(t *testing.T) {
+	storage := NewFileStorage(FileOptions{Dir: filepath.Join(t.TempDir(), "sessions")})
+	if _, err := storage.SessionInit(context.Background(), "a!b"); !errors.Is(err, session.ErrInvalidKey) {
+		t.Errorf("init with invalid sid: %v, want ErrInvalidKey", err)
+	}
+	manager, err := session.New(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+	for _, value := range []string{"a!b", "x%2Fy", "..%2F..%2Fetc"} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: "GOSESSID", Value: value})
+		w := httptest.NewRecorder()
+		sess, err := manager.SessionStart(w, r)
+		if err != nil {
+			t.Errorf("%s: %v (status %d)", value, err, w.Code)
+			continue
+		}
+		if sid := sess.SessionID(); !validSid(sid) {
+			t.Errorf("%s: session id %q", value, sid)
+		}
+		if cookies := w.Result().Cookies(); len(cookies) != 1 || strings.HasPrefix(cookies[0].Value, value) {
+			t.Errorf("%s: issued cookies %v, want a new sid", value, cookies)
+		}
+		if err := sess.Set("k", "v"); err != nil {
+			t.Errorf("%s: set: %v", value, err)
+		}
+	}
+}
+
+//别人可以访问的目录里的session不能信任
+func TestFileStorageRejectsSharedDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	storage := NewFileStorage(FileOptions{Dir: dir})
+	ctx := context.Background()
+	if _, err := storage.SessionInit(ctx, "sid1"); !errors.Is(err, session.ErrStorageUnavailable) {
+		t.Errorf("init in a world-writable dir: %v, want ErrStorageUnavailable", err)
+	}
+	if _, err := storage.SessionFetch(ctx, "sid1"); !errors.Is(err, session.ErrStorageUnavailable) {
+		t.Errorf("fetch in a world-writable dir: %v, want ErrStorageUnavailable", err)
+	}
+	//修好权限之后不需要重建storage
+	if err := os.Chmod(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.SessionInit(ctx, "sid1"); err != nil {
+		t.Errorf("init after fixing the dir: %v", err)
+	}
+}
+
+func TestFileStorageRejectsForeignOwner(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("needs root to chown the directory")
+	}
+	dir := t.TempDir()
+	if err := os.Chown(dir, 12345, 12345); err != nil {
+		t.Fatal(err)
+	}
+	storage := NewFileStorage(FileOptions{Dir: dir})
+	if _, err := storage.SessionInit(context.Background(), "sid1"); !errors.Is(err, session.ErrStorageUnavailable) {
+		t.Errorf("init in someone else's dir: %v, want ErrStorageUnavailable", err)
+	}
+}
+
+//符号链接指向的目录没有经过检查，不能使用
+func TestFileStorageRejectsSymlinkDir(t *testing.T) {
+	base := t.TempDir()
+	target := filepath.Join(base, "target")
+	if err := os.Mkdir(target, 0700); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(base, "sessions")
+	if err := os.Symlink(target, link); err != nil {
+		t.Skip("symlinks not supported: ", err)
+	}
+	storage := NewFileStorage(FileOptions{Dir: link})
+	if _, err := storage.SessionInit(context.Background(), "sid1"); !errors.Is(err, session.ErrStorageUnavailable) {
+		t.Errorf("init in a symlinked dir: %v, want ErrStorageUnavailable", err)
+	}
+}
+
+//两个进程共用一个目录：各自的storage有各自的进程内锁，读改写只能靠锁文件串行化，不能丢失对方的修改
+func TestFileStorageSharedBetweenProcesses(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skip("no flock")
+	}
+	dir := filepath.Join(t.TempDir(), "sessions")
+	storages := []*FileStorage{NewFileStorage(FileOptions{Dir: dir}), NewFileStorage(FileOptions{Dir: dir})}
+	ctx := context.Background()
+	if _, err := storages[0].SessionInit(ctx, "sid1"); err != nil {
+		t.Fatal(err)
+	}
+	const n = 50
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sess, err := storages[i%2].SessionFetch(ctx, "sid1")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if err := sess.Set(ctx, fmt.Sprintf("k%d", i), i); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	sess, err := storages[1].SessionFetch(ctx, "sid1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if v, _ := sess.Get(ctx, fmt.Sprintf("k%d", i)); v != i {
+			t.Errorf("k%d = %v, want %d", i, v, i)
+		}
+	}
+	//锁文件不是session，GC不能动它
+	if _, err := storages[0].SessionGCCount(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, fmt.Sprintf("%s%02d", file_lock_prefix, storages[0].stripe("sid1")))); err != nil {
+		t.Errorf("lock file after GC: %v", err)
+	}
+}
+
+//过期但还没被GC的文件不能借着换sid复活
+func TestFileStorageRegenerateExpired(t *testing.T) {
+	storage := NewFileStorage(FileOptions{Dir: filepath.Join(t.TempDir(), "sessions")})
+	storage.SetMaxLifeTime(60)
+	var expired []string
+	storage.SetEvents(session.StorageEvents{Expired: func(sid string) { expired = append(expired, sid) }})
+	ctx := context.Background()
+	for _, sid := range []string{"idle", "old"} {
+		if _, err := storage.SessionInit(ctx, sid); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	past := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(storage.path("idle"), past, past); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.SessionRegenerate(ctx, "idle", "idle2"); !errors.Is(err, session.ErrSessionNotFound) {
+		t.Errorf("regenerate idle session: %v, want ErrSessionNotFound", err)
+	}
+
+	storage.SetAbsoluteTimeout(60)
+	if err := storage.save("old", &fileData{Created: past.Unix(), Values: map[string][]byte{}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.SessionRegenerate(ctx, "old", "old2"); !errors.Is(err, session.ErrSessionNotFound) {
+		t.Errorf("regenerate too old session: %v, want ErrSessionNotFound", err)
+	}
+	for _, sid := range []string{"idle", "idle2", "old", "old2"} {
+		if _, err := os.Stat(storage.path(sid)); !os.IsNotExist(err) {
+			t.Errorf("file of %s still exists: %v", sid, err)
+		}
+	}
+	if len(expired) != 2 {
+		t.Errorf("expired %v, want [idle old]", expired)
+	}
+}
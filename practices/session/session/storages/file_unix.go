@@ -0,0 +1,17 @@
+//go:build unix
+
+package storages
+
+import (
+	"os"
+	"syscall"
+)
+
+//文件属主的uid
+func fileOwner(info os.FileInfo) (int, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return int(stat.Uid), true
+}
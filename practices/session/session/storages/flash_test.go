@@ -0,0 +1,81 @@
+package storages
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/hq-cml/GoHttpWeb/practices/session/session"
+)
+
+/*
+ * flash消息只能被读到一次：添加之后的下一个请求读到，再下一个请求就没有了
+ * 每个请求都重新从storage加载session，覆盖“读出之后的删除确实写回了storage”
+ */
+func testFlashOnce(t *testing.T, storage session.StorageV2, opts ...session.Option) {
+	manager, err := session.New(storage, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+
+	var cookie *http.Cookie
+	request := func(fn func(sess session.Session)) {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/", nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		sess, err := manager.SessionStart(w, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fn(sess)
+		if err := session.Save(sess); err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range w.Result().Cookies() {
+			cookie = c
+		}
+	}
+
+	request(func(sess session.Session) {
+		if err := session.AddFlash(sess, "info", "saved"); err != nil {
+			t.Fatal(err)
+		}
+		session.AddFlash(sess, "info", "again")
+		session.AddFlash(sess, "error", "oops")
+	})
+	request(func(sess session.Session) {
+		msgs, err := session.Flashes(sess, "info")
+		if err != nil || !reflect.DeepEqual(msgs, []string{"saved", "again"}) {
+			t.Errorf("first read: %v, %v", msgs, err)
+		}
+	})
+	request(func(sess session.Session) {
+		if msgs, err := session.Flashes(sess, "info"); msgs != nil || err != nil {
+			t.Errorf("second read: %v, %v; want nothing", msgs, err)
+		}
+		//取出一个分类不影响其他分类，它同样只能读到一次
+		if msgs, _ := session.Flashes(sess, "error"); !reflect.DeepEqual(msgs, []string{"oops"}) {
+			t.Errorf("other category: %v", msgs)
+		}
+	})
+	request(func(sess session.Session) {
+		if all, err := session.AllFlashes(sess); all != nil || err != nil {
+			t.Errorf("flashes left: %v, %v", all, err)
+		}
+	})
+}
+
+func TestFlashOnceMemory(t *testing.T) {
+	testFlashOnce(t, NewMemStorage(MemOptions{}))
+}
+
+func TestFlashOnceRedis(t *testing.T) {
+	testFlashOnce(t, newFakeRedisStorage(newFakeRedis(t), RedisOptions{}))
+	//延迟写回时，修改在请求结束时才一次提交
+	testFlashOnce(t, newFakeRedisStorage(newFakeRedis(t), RedisOptions{}), session.WithDeferredWrites())
+}
@@ -0,0 +1,79 @@
+package storages
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/hq-cml/GoHttpWeb/practices/session/session"
+)
+
+/*
+ * OnCreate只在新建session时触发一次，取回已有的session不触发；
+ * OnRegenerate拿到换sid前后的两个sid，不再触发OnCreate
+ */
+func testHooksCreateRegenerate(t *testing.T, name string, storage session.StorageV2) {
+	manager, err := session.New(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+	var created []string
+	var regenerated [][2]string
+	manager.OnCreate(func(ctx context.Context, sid string) { created = append(created, sid) })
+	manager.OnRegenerate(func(ctx context.Context, old_sid, new_sid string) {
+		regenerated = append(regenerated, [2]string{old_sid, new_sid})
+	})
+	request := func(sid string) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		if sid != "" {
+			w := httptest.NewRecorder()
+			session.CookieTransport{}.IssueSid(w, r, "GOSESSID", sid, 60)
+			r.AddCookie(w.Result().Cookies()[0])
+		}
+		return r
+	}
+
+	sess, err := manager.SessionStart(httptest.NewRecorder(), request(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sid := sess.SessionID()
+	if !reflect.DeepEqual(created, []string{sid}) {
+		t.Errorf("%s: OnCreate got %v after the first request, want [%s]", name, created, sid)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := manager.SessionStart(httptest.NewRecorder(), request(sid)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(created) != 1 {
+		t.Errorf("%s: OnCreate fired %d times, fetching an existing session must not fire it", name, len(created))
+	}
+
+	//客户端带来的sid在存储中不存在，沿用它新建，同样触发一次
+	if _, err := manager.SessionStart(httptest.NewRecorder(), request("unknown")); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(created, []string{sid, "unknown"}) {
+		t.Errorf("%s: OnCreate got %v, want [%s unknown]", name, created, sid)
+	}
+
+	regenerate, err := manager.SessionRegenerate(httptest.NewRecorder(), request(sid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][2]string{{sid, regenerate.SessionID()}}; !reflect.DeepEqual(regenerated, want) {
+		t.Errorf("%s: OnRegenerate got %v, want %v", name, regenerated, want)
+	}
+	if len(created) != 2 {
+		t.Errorf("%s: regenerate fired OnCreate: %v", name, created)
+	}
+}
+
+func TestHooksCreateRegenerate(t *testing.T) {
+	testHooksCreateRegenerate(t, "memory", NewMemStorage(MemOptions{}))
+	testHooksCreateRegenerate(t, "redis", newFakeRedisStorage(newFakeRedis(t), RedisOptions{}))
+}
@@ -2,137 +2,823 @@ package storages
 
 import (
 	"container/list"
+	"context"
 	"fmt"
 	"github.com/hq-cml/GoHttpWeb/practices/session/session"
+	"hash/fnv"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 /*
  * 内存Session实现，这个结构实现Session接口
  * 这个更准确的说是一个用户对应的session结构，而不是整体的session结构
+ *
+ * value由自己的读写锁保护；sid只在SessionRegenerate中被修改，修改时同时持有新旧两个分片的锁和自己的锁；
+ * time_accessed、size和user_id由所在分片的锁保护，time_created创建之后不再改变
  */
 type MemSession struct {
+	lock          sync.RWMutex                //保护value和sid
 	sid           string                      //session id唯一标示
 	time_accessed time.Time                   //最后访问时间
+	time_created  time.Time                   //创建时间，用于绝对超时
 	value         map[interface{}]interface{} //session里面存储的值
+	size          int64                       //value估算占用的字节数
+	user_id       string                      //关联的用户，空表示没有关联
+	storage       *MemStorage                 //所属的storage
+}
+
+/*
+ * 内存存储分片
+ * 每个分片有自己的锁、索引和LRU链表，链表头部是最近访问的条目，尾部是最久未访问的条目
+ * 超出容量限制时，从链表尾部开始淘汰
+ */
+type memShard struct {
+	lock     sync.Mutex               //锁
+	sessions map[string]*list.Element //用于存储的内存，key是sid，value是list的Element（其实本质上，是一个）
+	list     *list.List               //LRU链表，用于gc和淘汰
+	index    *memIndex                //按sid排序的索引，用于SessionList分页
+	storage  *MemStorage              //所属的storage，用于更新全局的条目数和字节数
 }
 
 /*
  * 内存存储实现，这个结构实现Storage接口
  * 这是一个整体session的对应的结构
+ * sid按hash分散到N个分片上，不同分片的操作互不影响
  */
 type MemStorage struct {
-	lock     sync.Mutex               //锁
-	sessions map[string]*list.Element //用于存储的内存，key是sid，value是list的Element（其实本质上，是一个）
-	list     *list.List               //链表，用于gc
+	shards    []*memShard
+	codec     session.Codec //值的序列化方式，nil表示直接保存Go值
+	sizer     func(key, value interface{}) int
+	on_evict  func(sid string)
+	evictions uint64 //累计淘汰的条目数，原子操作
+
+	max_sessions int64 //最多容纳的条目数，0表示不限
+	max_bytes    int64 //最多容纳的字节数，0表示不限
+	sessions     int64 //当前条目数，原子操作
+	bytes        int64 //当前估算字节数，原子操作
+
+	max_life_time    int64 //空闲超时（秒），原子操作
+	absolute_timeout int64 //绝对超时（秒），0表示不限制，原子操作
+
+	events session.StorageEvents //manager设置的事件回调，报告过期和淘汰的条目
+
+	//用户索引：user_id -> sid集合。条目从分片中移除时同步删除，加锁顺序总是先分片锁后users_lock
+	users_lock sync.Mutex
+	users      map[string]map[string]struct{}
 }
 
-var g_memstorage = &MemStorage{}
+/*
+ * 内存存储的配置
+ * 容量限制是整个storage的，条目数和字节数用全局的计数器统计：超出时先从当前分片的LRU尾部淘汰，
+ * 当前分片淘汰完了还超出（比如新条目落在一个空分片上）再依次淘汰其他分片的，所以淘汰顺序只在分片内是严格的LRU
+ * 每次调用返回时条目数不超过MaxSessions；并发写入时，可能短暂地超出几个条目
+ * 单个条目自己就超过MaxBytes的写入返回ErrValueTooLarge，不会为了放下它把其他条目全部淘汰
+ * 没有cookie的爬虫每个请求都会创建一个session，不设上限的话可以把内存耗尽
+ */
+type MemOptions struct {
+	Shards      int                              //分片数，<=0时使用默认值
+	MaxSessions int                              //最多容纳的条目数，0表示不限
+	MaxBytes    int64                            //最多容纳的字节数（估算值），0表示不限
+	OnEvict     func(sid string)                 //条目因为容量限制被淘汰时的回调，在锁外调用；交给manager时也会触发它的OnEvict钩子
+	Sizer       func(key, value interface{}) int //估算一个键值对占用的字节数，nil时使用memSizeOf
+}
+
+//内存存储的统计信息
+type MemStats struct {
+	Sessions  int    //当前条目数
+	Bytes     int64  //当前估算字节数
+	Evictions uint64 //累计淘汰的条目数
+}
+
+//默认分片数
+const mem_default_shards = 16
+
+//manager没有告知有效期时，自己负责过期的storage使用的默认值（秒）
+const default_life_time = 3600
+
+var g_memstorage = NewMemStorage(MemOptions{})
 
 func init() {
 	fmt.Println("Mem storage init")
-	g_memstorage.list = list.New()
-	g_memstorage.sessions = make(map[string]*list.Element, 0)
-	session.Register("memory", g_memstorage)
+	session.RegisterV2("memory", g_memstorage)
+}
+
+//创建内存存储，需要多个实例（比如不同分片数）时自行创建并用session.RegisterV2注册
+func NewMemStorage(opts MemOptions) *MemStorage {
+	if opts.Shards <= 0 {
+		opts.Shards = mem_default_shards
+	}
+	if opts.Sizer == nil {
+		opts.Sizer = memSizeOf
+	}
+	storage := &MemStorage{
+		shards:        make([]*memShard, opts.Shards),
+		sizer:         opts.Sizer,
+		on_evict:      opts.OnEvict,
+		max_sessions:  int64(opts.MaxSessions),
+		max_bytes:     opts.MaxBytes,
+		max_life_time: default_life_time,
+		users:         make(map[string]map[string]struct{}),
+	}
+	for i := range storage.shards {
+		storage.shards[i] = &memShard{
+			sessions: make(map[string]*list.Element),
+			list:     list.New(),
+			index:    newMemIndex(),
+			storage:  storage,
+		}
+	}
+	return storage
+}
+
+//默认的字节数估算：字符串和[]byte按长度计算，其他类型按格式化之后的长度粗略估计
+func memSizeOf(key, value interface{}) int {
+	return memSizeOfValue(key) + memSizeOfValue(value)
+}
+
+func memSizeOfValue(v interface{}) int {
+	switch x := v.(type) {
+	case nil:
+		return 0
+	case string:
+		return len(x)
+	case []byte:
+		return len(x)
+	case []string:
+		n := 0
+		for _, s := range x {
+			n += len(s)
+		}
+		return n
+	default:
+		return len(fmt.Sprint(x))
+	}
+}
+
+//实现session.CodecAware：设置之后值以序列化后的[]byte保存，取出来的是副本，
+//和其他storage的行为保持一致；字节数的估算也就变得准确了。应当在开始使用之前设置
+func (self *MemStorage) SetCodec(codec session.Codec) {
+	self.codec = codec
+}
+
+//实现session.LifeTimeAware，SessionFetch据此判断条目是否已经空闲超时
+func (self *MemStorage) SetMaxLifeTime(max_life_time int64) {
+	atomic.StoreInt64(&self.max_life_time, max_life_time)
+}
+
+//实现session.AbsoluteTimeoutAware
+func (self *MemStorage) SetAbsoluteTimeout(absolute_timeout int64) {
+	atomic.StoreInt64(&self.absolute_timeout, absolute_timeout)
+}
+
+//实现session.EventReporter
+func (self *MemStorage) SetEvents(events session.StorageEvents) {
+	self.events = events
+}
+
+//报告过期被删除的条目，在分片锁外调用
+func (self *MemStorage) expiredSids(sids ...string) {
+	if self.events.Expired == nil {
+		return
+	}
+	for _, sid := range sids {
+		self.events.Expired(sid)
+	}
+}
+
+//条目在now时是否已经过期（空闲超时或者绝对超时），调用方持有分片锁
+func (self *MemStorage) expired(sess *MemSession, max_life_time, absolute_timeout int64, now time.Time) bool {
+	if sess.time_accessed.Unix()+max_life_time < now.Unix() {
+		return true
+	}
+	return absolute_timeout > 0 && sess.time_created.Unix()+absolute_timeout < now.Unix()
+}
+
+//统计信息
+func (self *MemStorage) Stats() MemStats {
+	return MemStats{
+		Sessions:  int(atomic.LoadInt64(&self.sessions)),
+		Bytes:     atomic.LoadInt64(&self.bytes),
+		Evictions: atomic.LoadUint64(&self.evictions),
+	}
+}
+
+//sid所在的分片号
+func (self *MemStorage) shardIndex(sid string) int {
+	h := fnv.New32a()
+	h.Write([]byte(sid))
+	return int(h.Sum32() % uint32(len(self.shards)))
+}
+
+func (self *MemStorage) shard(sid string) *memShard {
+	return self.shards[self.shardIndex(sid)]
 }
 
 /*
- * MemSession实现Session接口的：Set/Get/Delete/SessionID方法
+ * MemSession实现SessionV2接口的：Set/Get/Delete/SessionID方法
+ * 条目已经被销毁或者GC之后，再操作会返回ErrSessionNotFound
  */
-func (self *MemSession) Set(key, value interface{}) error {
-	self.value[key] = value
-	//更新对应条目的访问时间
-	g_memstorage.SessionUpdate(self.sid)
-	return nil
+func (self *MemSession) Set(ctx context.Context, key, value interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if codec := self.storage.codec; codec != nil {
+		data, err := codec.Encode(value)
+		if err != nil {
+			return err
+		}
+		value = data
+	}
+	//写入值，同时更新对应条目的访问时间和字节数
+	return self.storage.access(self, func() (int64, func()) {
+		delta := int64(self.storage.sizer(key, value))
+		old, ok := self.value[key]
+		if ok {
+			delta -= int64(self.storage.sizer(key, old))
+		}
+		self.value[key] = value
+		return delta, func() {
+			if ok {
+				self.value[key] = old
+			} else {
+				delete(self.value, key)
+			}
+		}
+	})
 }
 
-func (self *MemSession) Get(key interface{}) interface{} {
+func (self *MemSession) Get(ctx context.Context, key interface{}) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	//更新对应条目的访问时间
-	g_memstorage.SessionUpdate(self.sid)
-	if v, ok := self.value[key]; ok {
-		return v
-	} else {
-		return nil
+	if err := self.storage.access(self, nil); err != nil {
+		return nil, err
 	}
-	return nil
+	self.lock.RLock()
+	v, ok := self.value[key]
+	self.lock.RUnlock()
+	if !ok {
+		return nil, nil
+	}
+	if codec := self.storage.codec; codec != nil {
+		return codec.Decode(v.([]byte))
+	}
+	return v, nil
 }
 
-func (self *MemSession) Delete(key interface{}) error {
-	delete(self.value, key)
-	g_memstorage.SessionUpdate(self.sid)
-	return nil
+func (self *MemSession) Delete(ctx context.Context, key interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return self.storage.access(self, func() (int64, func()) {
+		old, ok := self.value[key]
+		if !ok {
+			return 0, nil
+		}
+		delete(self.value, key)
+		return -int64(self.storage.sizer(key, old)), nil
+	})
 }
 
 func (self *MemSession) SessionID() string {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
 	return self.sid
 }
 
+//实现session.CreationAware
+func (self *MemSession) SessionCreated() int64 {
+	return self.time_created.Unix()
+}
+
 /*
- * MemStorage实现Storage接口的：SessionInit/SessionFetch/SessionDestroy/SessionGC方法
+ * MemStorage实现StorageV2接口的：SessionInit/SessionFetch/SessionDestroy/SessionGC方法
+ * 内存操作不会阻塞，所以ctx只在入口处检查一次
  */
 //当新来一个用户的时候，新增一个session条目（element）
-func (self *MemStorage) SessionInit(sid string) (session.Session, error) {
-	self.lock.Lock()
-	defer self.lock.Unlock()
+func (self *MemStorage) SessionInit(ctx context.Context, sid string) (session.SessionV2, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	shard := self.shard(sid)
+	shard.lock.Lock()
 	v := make(map[interface{}]interface{}, 0)
-	newsess := &MemSession{sid: sid, time_accessed: time.Now(), value: v}
-	//将新生成的条目压入队列，开始GC轮回
-	element := self.list.PushBack(newsess)
-	//将新生成的条目以element的形式，放入session中去，用于后续读写
-	self.sessions[sid] = element
+	now := time.Now()
+	newsess := &MemSession{sid: sid, time_accessed: now, time_created: now, value: v, storage: self}
+	if element, ok := shard.sessions[sid]; ok {
+		//sid已经存在，用新条目替换
+		shard.remove(element)
+	}
+	//将新生成的条目压入队列头部，开始GC轮回，并以element的形式放入session中去，用于后续读写
+	element := shard.add(newsess)
+	evicted := shard.evict(element)
+	shard.lock.Unlock()
+	self.evicted(shard, evicted)
 	return newsess, nil
 }
 
-//根据sid，从storage中取出整个对应的条目（Element），以MemSession形式返回
-func (self *MemStorage) SessionFetch(sid string) (session.Session, error) {
-	if element, ok := self.sessions[sid]; ok {
-		return element.Value.(*MemSession), nil
-	} else {
-		sess, err := self.SessionInit(sid)
-		return sess, err
+//根据sid，从storage中取出整个对应的条目（Element），以MemSession形式返回，同时更新访问时间
+//不存在，或者已经过期但还没被GC时，返回ErrSessionNotFound
+func (self *MemStorage) SessionFetch(ctx context.Context, sid string) (session.SessionV2, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	shard := self.shard(sid)
+	shard.lock.Lock()
+	element, ok := shard.sessions[sid]
+	if !ok {
+		shard.lock.Unlock()
+		return nil, session.ErrSessionNotFound
 	}
-	return nil, nil
+	sess := element.Value.(*MemSession)
+	now := time.Now()
+	if self.expired(sess, atomic.LoadInt64(&self.max_life_time), atomic.LoadInt64(&self.absolute_timeout), now) {
+		shard.remove(element)
+		shard.lock.Unlock()
+		self.expiredSids(sid)
+		return nil, session.ErrSessionNotFound
+	}
+	sess.time_accessed = now
+	shard.list.MoveToFront(element)
+	shard.lock.Unlock()
+	return sess, nil
 }
 
 //根据sid，销毁storage中对应的条目，两处，内存中和gc队列中均需要清除
-func (self *MemStorage) SessionDestroy(sid string) error {
-	if element, ok := self.sessions[sid]; ok {
-		delete(self.sessions, sid)
-		self.list.Remove(element)
-		return nil
+func (self *MemStorage) SessionDestroy(ctx context.Context, sid string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	shard := self.shard(sid)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	if element, ok := shard.sessions[sid]; ok {
+		shard.remove(element)
 	}
 	return nil
 }
 
-//GC，从最久未被访问的条目，一直向前遍历。
+//把old_sid对应的条目迁移到new_sid下，条目对象本身不变，持有它的handler可以继续使用
+//old_sid不存在或者已经过期时返回ErrSessionNotFound
+//新旧sid可能落在不同的分片上，按分片号从小到大加锁，避免死锁
+func (self *MemStorage) SessionRegenerate(ctx context.Context, old_sid, new_sid string) (session.SessionV2, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	i, j := self.shardIndex(old_sid), self.shardIndex(new_sid)
+	old_shard, new_shard := self.shards[i], self.shards[j]
+	if i > j {
+		i, j = j, i
+	}
+	self.shards[i].lock.Lock()
+	if i != j {
+		self.shards[j].lock.Lock()
+	}
+	unlock := func() {
+		if i != j {
+			self.shards[j].lock.Unlock()
+		}
+		self.shards[i].lock.Unlock()
+	}
+
+	element, ok := old_shard.sessions[old_sid]
+	if !ok {
+		unlock()
+		return nil, session.ErrSessionNotFound
+	}
+	sess := element.Value.(*MemSession)
+	now := time.Now()
+	//和SessionFetch一样，过期但还没被GC的条目视为不存在，不能借着换sid复活
+	if self.expired(sess, atomic.LoadInt64(&self.max_life_time), atomic.LoadInt64(&self.absolute_timeout), now) {
+		old_shard.remove(element)
+		unlock()
+		self.expiredSids(old_sid)
+		return nil, session.ErrSessionNotFound
+	}
+	old_shard.remove(element)
+
+	sess.lock.Lock()
+	sess.sid = new_sid
+	sess.lock.Unlock()
+	sess.time_accessed = now
+	element = new_shard.add(sess)
+	evicted := new_shard.evict(element)
+	unlock()
+	self.evicted(new_shard, evicted)
+	return sess, nil
+}
+
+//GC，逐个分片从最久未被访问的条目，一直向前遍历。
 //如果条目的访问时间+max_life_time比当前时间还小，则表示过期，则在队列以及内存中均予以删除
-func (self *MemStorage) SessionGC(max_life_time int64) {
+//设置了绝对超时时，还要遍历整个分片，删除创建时间太早的条目（它们可能一直很活跃，排在链表前面）
+//每次只锁一个分片，GC期间其他分片的请求不受影响；删除的条目在分片锁外报告给events.Expired
+func (self *MemStorage) SessionGC(ctx context.Context, max_life_time int64) error {
+	_, err := self.SessionGCCount(ctx, max_life_time)
+	return err
+}
+
+//实现session.GCCounter，返回删除的条目数
+func (self *MemStorage) SessionGCCount(ctx context.Context, max_life_time int64) (int, error) {
+	count := 0
+	for _, shard := range self.shards {
+		if err := ctx.Err(); err != nil {
+			return count, err
+		}
+		expired := shard.gc(max_life_time, atomic.LoadInt64(&self.absolute_timeout))
+		self.expiredSids(expired...)
+		count += len(expired)
+	}
+	return count, nil
+}
+
+//返回删除的sid
+func (self *memShard) gc(max_life_time, absolute_timeout int64) []string {
 	self.lock.Lock()
 	defer self.lock.Unlock()
 
+	var expired []string
+	now := time.Now().Unix()
 	for {
 		element := self.list.Back()
 		if element == nil {
 			break
 		}
-		if (element.Value.(*MemSession).time_accessed.Unix() + max_life_time) < time.Now().Unix() {
-			self.list.Remove(element)
-			delete(self.sessions, element.Value.(*MemSession).sid)
+		sess := element.Value.(*MemSession)
+		if (sess.time_accessed.Unix() + max_life_time) < now {
+			self.remove(element)
+			expired = append(expired, sess.sid)
 		} else {
 			break
 		}
 	}
+	if absolute_timeout > 0 {
+		for element := self.list.Front(); element != nil; {
+			next := element.Next()
+			if sess := element.Value.(*MemSession); sess.time_created.Unix()+absolute_timeout < now {
+				self.remove(element)
+				expired = append(expired, sess.sid)
+			}
+			element = next
+		}
+	}
+	return expired
 }
 
 //跟新session存储中sid对应的条目（element）的更新时间，并且将对应条目前移
 func (self *MemStorage) SessionUpdate(sid string) error {
-	self.lock.Lock()
-	defer self.lock.Unlock()
-	if element, ok := self.sessions[sid]; ok {
+	shard := self.shard(sid)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	if element, ok := shard.sessions[sid]; ok {
 		element.Value.(*MemSession).time_accessed = time.Now()
-		self.list.MoveToFront(element)
+		shard.list.MoveToFront(element)
 		return nil
 	}
+	return session.ErrSessionNotFound
+}
+
+//访问sess：在分片锁内执行修改（modify为nil表示只读），更新访问时间和字节数，必要时淘汰其他条目
+//modify在sess的写锁内执行，返回字节数的变化量和撤销修改的函数（只会变小的修改可以返回nil）
+//修改之后这一个条目自己就超过了MaxBytes时，淘汰别人也放不下它，撤销修改并返回ErrValueTooLarge
+//sess已经不在storage中时返回ErrSessionNotFound；如果在此期间sess被迁移到了新的sid，按新的sid重试
+func (self *MemStorage) access(sess *MemSession, modify func() (int64, func())) error {
+	for {
+		sid := sess.SessionID()
+		shard := self.shard(sid)
+		shard.lock.Lock()
+		element, ok := shard.sessions[sid]
+		if ok && element.Value == sess {
+			if modify != nil {
+				sess.lock.Lock()
+				delta, undo := modify()
+				if delta > 0 && self.max_bytes > 0 && sess.size+delta > self.max_bytes {
+					if undo != nil {
+						undo()
+					}
+					sess.lock.Unlock()
+					shard.lock.Unlock()
+					return fmt.Errorf("%w: session needs %d bytes, limit is %d", session.ErrValueTooLarge, sess.size+delta, self.max_bytes)
+				}
+				sess.lock.Unlock()
+				sess.size += delta
+				atomic.AddInt64(&self.bytes, delta)
+			}
+			sess.time_accessed = time.Now()
+			shard.list.MoveToFront(element)
+			evicted := shard.evict(element)
+			shard.lock.Unlock()
+			self.evicted(shard, evicted)
+			return nil
+		}
+		shard.lock.Unlock()
+		if sess.SessionID() == sid {
+			return session.ErrSessionNotFound
+		}
+	}
+}
+
+//淘汰之后的统计和回调，在分片锁外调用
+//from是刚刚插入或者访问了条目的分片，它淘汰到只剩刚访问的条目之后仍然超出容量时，
+//依次从后面的分片淘汰，每次只锁一个分片
+func (self *MemStorage) evicted(from *memShard, sids []string) {
+	if self.full() {
+		start := 0
+		for i, shard := range self.shards {
+			if shard == from {
+				start = i
+			}
+		}
+		for i := 1; i < len(self.shards) && self.full(); i++ {
+			shard := self.shards[(start+i)%len(self.shards)]
+			shard.lock.Lock()
+			sids = append(sids, shard.evict(nil)...)
+			shard.lock.Unlock()
+		}
+	}
+	if len(sids) == 0 {
+		return
+	}
+	atomic.AddUint64(&self.evictions, uint64(len(sids)))
+	for _, sid := range sids {
+		if self.on_evict != nil {
+			self.on_evict(sid)
+		}
+		if self.events.Evicted != nil {
+			self.events.Evicted(sid)
+		}
+	}
+}
+
+//把条目放进分片，放在链表头部，调用方持有分片锁
+func (self *memShard) add(sess *MemSession) *list.Element {
+	element := self.list.PushFront(sess)
+	self.sessions[sess.sid] = element
+	self.index.insert(sess.sid)
+	atomic.AddInt64(&self.storage.sessions, 1)
+	atomic.AddInt64(&self.storage.bytes, sess.size)
+	if sess.user_id != "" {
+		self.storage.indexUser(sess.user_id, sess.sid)
+	}
+	return element
+}
+
+//从分片中移除条目，调用方持有分片锁
+func (self *memShard) remove(element *list.Element) {
+	sess := element.Value.(*MemSession)
+	self.list.Remove(element)
+	delete(self.sessions, sess.sid)
+	self.index.remove(sess.sid)
+	atomic.AddInt64(&self.storage.sessions, -1)
+	atomic.AddInt64(&self.storage.bytes, -sess.size)
+	if sess.user_id != "" {
+		self.storage.unindexUser(sess.user_id, sess.sid)
+	}
+}
+
+//整个storage是否超出了容量限制
+func (self *MemStorage) full() bool {
+	return (self.max_sessions > 0 && atomic.LoadInt64(&self.sessions) > self.max_sessions) ||
+		(self.max_bytes > 0 && atomic.LoadInt64(&self.bytes) > self.max_bytes)
+}
+
+//整个storage超出容量时从分片链表尾部（最久未访问）开始淘汰，keep是刚刚访问的条目，不会被淘汰
+//返回被淘汰的sid，调用方持有分片锁
+func (self *memShard) evict(keep *list.Element) []string {
+	var evicted []string
+	for self.storage.full() {
+		element := self.list.Back()
+		if element == nil || element == keep {
+			break
+		}
+		sid := element.Value.(*MemSession).sid
+		self.remove(element)
+		evicted = append(evicted, sid)
+	}
+	return evicted
+}
+
+/*
+ * MemStorage实现session.Enumerator：按sid的字典序分页，cursor是上一页的最后一个sid
+ * 遍历期间一直存活的session恰好出现一次；已经过期但还没被GC的条目不会出现
+ * 每个分片从自己的有序索引里取cursor之后的limit+1条，合并之后取前limit条，多出来的说明还有下一页
+ */
+func (self *MemStorage) SessionList(ctx context.Context, cursor string, limit int) ([]string, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	max_life_time, absolute_timeout := atomic.LoadInt64(&self.max_life_time), atomic.LoadInt64(&self.absolute_timeout)
+	now := time.Now()
+	var sids []string
+	for _, shard := range self.shards {
+		n := 0
+		shard.lock.Lock()
+		for node := shard.index.after(cursor); node != nil && (limit <= 0 || n <= limit); node = node.next[0] {
+			if !self.expired(shard.sessions[node.sid].Value.(*MemSession), max_life_time, absolute_timeout, now) {
+				sids = append(sids, node.sid)
+				n++
+			}
+		}
+		shard.lock.Unlock()
+	}
+	sort.Strings(sids)
+	if limit <= 0 || len(sids) <= limit {
+		return sids, "", nil
+	}
+	return sids[:limit], sids[limit-1], nil
+}
+
+func (self *MemStorage) SessionCount(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	count := 0
+	self.each(func(string) {
+		count++
+	})
+	return count, nil
+}
+
+//对每个没有过期的条目调用fn，每次锁一个分片
+func (self *MemStorage) each(fn func(sid string)) {
+	max_life_time, absolute_timeout := atomic.LoadInt64(&self.max_life_time), atomic.LoadInt64(&self.absolute_timeout)
+	now := time.Now()
+	for _, shard := range self.shards {
+		shard.lock.Lock()
+		for sid, element := range shard.sessions {
+			if !self.expired(element.Value.(*MemSession), max_life_time, absolute_timeout, now) {
+				fn(sid)
+			}
+		}
+		shard.lock.Unlock()
+	}
+}
+
+/*
+ * MemStorage实现session.UserIndex
+ */
+func (self *MemStorage) SessionBindUser(ctx context.Context, sid, user_id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	shard := self.shard(sid)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	element, ok := shard.sessions[sid]
+	if !ok {
+		return session.ErrSessionNotFound
+	}
+	sess := element.Value.(*MemSession)
+	if sess.user_id != "" {
+		self.unindexUser(sess.user_id, sid)
+	}
+	sess.user_id = user_id
+	if user_id != "" {
+		self.indexUser(user_id, sid)
+	}
 	return nil
 }
+
+func (self *MemStorage) SessionsOfUser(ctx context.Context, user_id string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	//先把sid复制出来再逐个检查，不能在持有users_lock的时候去拿分片锁
+	self.users_lock.Lock()
+	sids := make([]string, 0, len(self.users[user_id]))
+	for sid := range self.users[user_id] {
+		sids = append(sids, sid)
+	}
+	self.users_lock.Unlock()
+
+	max_life_time, absolute_timeout := atomic.LoadInt64(&self.max_life_time), atomic.LoadInt64(&self.absolute_timeout)
+	now := time.Now()
+	alive := sids[:0]
+	for _, sid := range sids {
+		shard := self.shard(sid)
+		shard.lock.Lock()
+		element, ok := shard.sessions[sid]
+		if ok && !self.expired(element.Value.(*MemSession), max_life_time, absolute_timeout, now) {
+			alive = append(alive, sid)
+		}
+		shard.lock.Unlock()
+	}
+	sort.Strings(alive)
+	return alive, nil
+}
+
+//调用方持有sid所在分片的锁
+func (self *MemStorage) indexUser(user_id, sid string) {
+	self.users_lock.Lock()
+	defer self.users_lock.Unlock()
+	sids, ok := self.users[user_id]
+	if !ok {
+		sids = make(map[string]struct{})
+		self.users[user_id] = sids
+	}
+	sids[sid] = struct{}{}
+}
+
+//调用方持有sid所在分片的锁
+func (self *MemStorage) unindexUser(user_id, sid string) {
+	self.users_lock.Lock()
+	defer self.users_lock.Unlock()
+	delete(self.users[user_id], sid)
+	if len(self.users[user_id]) == 0 {
+		delete(self.users, user_id)
+	}
+}
+
+/*
+ * MemStorage实现session.BatchStorage
+ * 内存存储的读写本来就很便宜，实现这个接口是为了WithDeferredWrites在内存存储上也能使用（比如测试时代替redis）
+ * 需要设置了Codec（通过manager使用时总是设置了的），值都是编码之后的[]byte
+ */
+func (self *MemStorage) SessionValues(ctx context.Context, sid string) (map[string][]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	sess, err := self.batchSession(sid)
+	if err != nil {
+		return nil, err
+	}
+	if err := self.access(sess, nil); err != nil {
+		return nil, err
+	}
+	sess.lock.RLock()
+	defer sess.lock.RUnlock()
+	values := make(map[string][]byte, len(sess.value))
+	for k, v := range sess.value {
+		if key, ok := k.(string); ok {
+			values[key] = v.([]byte)
+		}
+	}
+	return values, nil
+}
+
+//全部修改在session的写锁内完成，其他请求看不到修改了一半的session
+func (self *MemStorage) SessionCommit(ctx context.Context, sid string, set map[string][]byte, del []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	sess, err := self.batchSession(sid)
+	if err != nil {
+		return err
+	}
+	return self.access(sess, func() (int64, func()) {
+		var delta int64
+		//修改前的值，撤销时恢复；nil表示原来没有这个key
+		saved := make(map[string]interface{}, len(set)+len(del))
+		save := func(k string) {
+			if _, ok := saved[k]; !ok {
+				saved[k] = sess.value[k]
+			}
+		}
+		for k, v := range set {
+			save(k)
+			delta += int64(self.sizer(k, v))
+			if old, ok := sess.value[k]; ok {
+				delta -= int64(self.sizer(k, old))
+			}
+			sess.value[k] = v
+		}
+		for _, k := range del {
+			if old, ok := sess.value[k]; ok {
+				save(k)
+				delta -= int64(self.sizer(k, old))
+				delete(sess.value, k)
+			}
+		}
+		return delta, func() {
+			for k, old := range saved {
+				if old == nil {
+					delete(sess.value, k)
+				} else {
+					sess.value[k] = old
+				}
+			}
+		}
+	})
+}
+
+//按sid找到条目，用于BatchStorage；过期的条目视为不存在
+func (self *MemStorage) batchSession(sid string) (*MemSession, error) {
+	if self.codec == nil {
+		return nil, fmt.Errorf("%w: memory storage without codec cannot commit encoded values", session.ErrNotSupported)
+	}
+	shard := self.shard(sid)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	element, ok := shard.sessions[sid]
+	if !ok {
+		return nil, session.ErrSessionNotFound
+	}
+	sess := element.Value.(*MemSession)
+	if self.expired(sess, atomic.LoadInt64(&self.max_life_time), atomic.LoadInt64(&self.absolute_timeout), time.Now()) {
+		return nil, session.ErrSessionNotFound
+	}
+	return sess, nil
+}
@@ -0,0 +1,90 @@
+package storages
+
+import (
+	"math/rand"
+)
+
+/*
+ * 分片内按sid字典序排列的索引，用于SessionList分页
+ * 跳表实现：插入、删除和定位cursor都是O(log n)，取一页只需要从cursor开始往后走，不用每次把所有sid排一遍序
+ * 不是并发安全的，由所在分片的锁保护
+ */
+type memIndex struct {
+	head  memIndexNode //哨兵，不保存sid
+	level int          //当前用到的层数
+}
+
+type memIndexNode struct {
+	sid  string
+	next []*memIndexNode
+}
+
+//最大层数，每一层的节点数大约是下一层的1/4，足够容纳上亿个条目
+const mem_index_max_level = 16
+
+func newMemIndex() *memIndex {
+	return &memIndex{head: memIndexNode{next: make([]*memIndexNode, mem_index_max_level)}, level: 1}
+}
+
+func memIndexLevel() int {
+	level := 1
+	for level < mem_index_max_level && rand.Intn(4) == 0 {
+		level++
+	}
+	return level
+}
+
+//每一层中最后一个sid小于sid的节点
+func (self *memIndex) predecessors(sid string) [mem_index_max_level]*memIndexNode {
+	var prev [mem_index_max_level]*memIndexNode
+	node := &self.head
+	for i := self.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].sid < sid {
+			node = node.next[i]
+		}
+		prev[i] = node
+	}
+	return prev
+}
+
+//加入sid，已经存在时什么都不做
+func (self *memIndex) insert(sid string) {
+	prev := self.predecessors(sid)
+	if next := prev[0].next[0]; next != nil && next.sid == sid {
+		return
+	}
+	level := memIndexLevel()
+	for ; self.level < level; self.level++ {
+		prev[self.level] = &self.head
+	}
+	node := &memIndexNode{sid: sid, next: make([]*memIndexNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = prev[i].next[i]
+		prev[i].next[i] = node
+	}
+}
+
+func (self *memIndex) remove(sid string) {
+	prev := self.predecessors(sid)
+	node := prev[0].next[0]
+	if node == nil || node.sid != sid {
+		return
+	}
+	for i := range node.next {
+		prev[i].next[i] = node.next[i]
+	}
+	for self.level > 1 && self.head.next[self.level-1] == nil {
+		self.level--
+	}
+}
+
+//第一个sid大于cursor的节点，沿着next[0]往后走就是按字典序的遍历
+func (self *memIndex) after(cursor string) *memIndexNode {
+	node := &self.head
+	for i := self.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].sid <= cursor {
+			node = node.next[i]
+		}
+	}
+	return node.next[0]
+}
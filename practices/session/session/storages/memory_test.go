@@ -0,0 +1,295 @@
+package storages
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hq-cml/GoHttpWeb/practices/session/session"
+)
+
+/*
+ * 并发读写和GC同时进行，需要用go test -race运行才有意义：
+ *   go test -race -run Mem ./session/storages/
+ */
+func TestMemStorageStress(t *testing.T) {
+	storage := NewMemStorage(MemOptions{Shards: 4, MaxSessions: 64})
+	ctx := context.Background()
+	const (
+		workers = 16
+		rounds  = 500
+		sids    = 100
+	)
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	//GC一直在跑，max_life_time为0时上一秒之前访问过的条目都会被删除
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := storage.SessionGCCount(ctx, 0); err != nil {
+				t.Error(err)
+				return
+			}
+			storage.Stats()
+		}
+	}()
+	var workers_wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		workers_wg.Add(1)
+		go func(w int) {
+			defer workers_wg.Done()
+			for i := 0; i < rounds; i++ {
+				sid := fmt.Sprintf("sid-%d", (w*rounds+i)%sids)
+				sess, err := storage.SessionFetch(ctx, sid)
+				if errors.Is(err, session.ErrSessionNotFound) {
+					sess, err = storage.SessionInit(ctx, sid)
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				//条目随时可能被GC、淘汰或者被别人迁移走，这时返回ErrSessionNotFound是正常的
+				for _, err := range []error{
+					sess.Set(ctx, "worker", w),
+					sess.Set(ctx, fmt.Sprint("k", i%4), i),
+					ignoreValue(sess.Get(ctx, "worker")),
+					sess.Delete(ctx, fmt.Sprint("k", (i+1)%4)),
+				} {
+					if err != nil && !errors.Is(err, session.ErrSessionNotFound) {
+						t.Error(err)
+						return
+					}
+				}
+				if i%50 == 0 {
+					_, err := storage.SessionRegenerate(ctx, sid, fmt.Sprintf("%s-%d-%d", sid, w, i))
+					if err != nil && !errors.Is(err, session.ErrSessionNotFound) {
+						t.Error(err)
+						return
+					}
+				}
+				if i%70 == 0 {
+					if err := storage.SessionDestroy(ctx, sid); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}(w)
+	}
+	workers_wg.Wait()
+	close(stop)
+	wg.Wait()
+
+	//压力过后，每个分片的索引和链表仍然一致，全局的条目数和字节数与各个条目相符
+	var count int
+	var bytes int64
+	for i, shard := range storage.shards {
+		shard.lock.Lock()
+		for element := shard.list.Front(); element != nil; element = element.Next() {
+			sess := element.Value.(*MemSession)
+			if shard.sessions[sess.sid] != element {
+				t.Errorf("shard %d: %s in list but not indexed", i, sess.sid)
+			}
+			bytes += sess.size
+		}
+		if shard.list.Len() != len(shard.sessions) {
+			t.Errorf("shard %d: list has %d entries, index has %d", i, shard.list.Len(), len(shard.sessions))
+		}
+		//有序索引和条目一一对应，并且是排好序的
+		var indexed []string
+		for node := shard.index.after(""); node != nil; node = node.next[0] {
+			if _, ok := shard.sessions[node.sid]; !ok {
+				t.Errorf("shard %d: %s in sorted index but not stored", i, node.sid)
+			}
+			indexed = append(indexed, node.sid)
+		}
+		if len(indexed) != len(shard.sessions) || !sort.StringsAreSorted(indexed) {
+			t.Errorf("shard %d: sorted index %v, %d entries", i, indexed, len(shard.sessions))
+		}
+		count += len(shard.sessions)
+		shard.lock.Unlock()
+	}
+	stats := storage.Stats()
+	if stats.Sessions != count || stats.Bytes != bytes {
+		t.Errorf("stats %d sessions %d bytes, entries sum to %d sessions %d bytes", stats.Sessions, stats.Bytes, count, bytes)
+	}
+	if count > 64 {
+		t.Errorf("%d entries over limit 64", count)
+	}
+}
+
+//容量限制是整个storage的，不是每个分片的：分片比条目多时，新条目落在空分片上也要淘汰别的分片
+func TestMemStorageMaxSessions(t *testing.T) {
+	for _, max := range []int{1, 10, 100} {
+		var evicted []string
+		storage := NewMemStorage(MemOptions{MaxSessions: max, OnEvict: func(sid string) { evicted = append(evicted, sid) }})
+		ctx := context.Background()
+		for i := 0; i < 3*max; i++ {
+			storage.SessionInit(ctx, fmt.Sprint("sid-", i))
+			if n := storage.Stats().Sessions; n > max {
+				t.Fatalf("max %d: %d sessions after %d inits", max, n, i+1)
+			}
+		}
+		if n, _ := storage.SessionCount(ctx); n != max {
+			t.Errorf("max %d: %d sessions, want %d", max, n, max)
+		}
+		if len(evicted) != 2*max {
+			t.Errorf("max %d: %d evictions, want %d", max, len(evicted), 2*max)
+		}
+		//最后创建的条目不会被淘汰
+		if _, err := storage.SessionFetch(ctx, fmt.Sprint("sid-", 3*max-1)); err != nil {
+			t.Errorf("max %d: newest session evicted: %v", max, err)
+		}
+	}
+}
+
+func TestMemStorageMaxBytes(t *testing.T) {
+	storage := NewMemStorage(MemOptions{MaxBytes: 100})
+	ctx := context.Background()
+	for i := 0; i < 20; i++ {
+		sess, _ := storage.SessionInit(ctx, fmt.Sprint("sid-", i))
+		//key 1字节，value 19字节
+		sess.Set(ctx, "k", strings.Repeat("v", 19))
+		if b := storage.Stats().Bytes; b > 100 {
+			t.Fatalf("%d bytes after %d sessions, limit 100", b, i+1)
+		}
+	}
+	if n := storage.Stats().Sessions; n != 5 {
+		t.Errorf("%d sessions, want 5", n)
+	}
+}
+
+//单个条目超过MaxBytes时写入失败，不能为了它把其他用户的session都淘汰掉
+func TestMemStorageValueTooLarge(t *testing.T) {
+	var evicted []string
+	storage := NewMemStorage(MemOptions{MaxBytes: 1000, OnEvict: func(sid string) { evicted = append(evicted, sid) }})
+	ctx := context.Background()
+	for i := 0; i < 20; i++ {
+		sess, _ := storage.SessionInit(ctx, fmt.Sprint("sid-", i))
+		sess.Set(ctx, "k", "v")
+	}
+	before := storage.Stats()
+	sess, _ := storage.SessionInit(ctx, "big")
+	sess.Set(ctx, "small", "v")
+	if err := sess.Set(ctx, "k", strings.Repeat("v", 5000)); !errors.Is(err, session.ErrValueTooLarge) {
+		t.Errorf("set oversized value: %v, want ErrValueTooLarge", err)
+	}
+	if v, _ := sess.Get(ctx, "k"); v != nil {
+		t.Errorf("oversized value kept: %d bytes", len(v.(string)))
+	}
+	if v, _ := sess.Get(ctx, "small"); v != "v" {
+		t.Errorf("earlier value = %v, want v", v)
+	}
+	if len(evicted) != 0 {
+		t.Errorf("evicted %v", evicted)
+	}
+	for i := 0; i < 20; i++ {
+		if _, err := storage.SessionFetch(ctx, fmt.Sprint("sid-", i)); err != nil {
+			t.Errorf("sid-%d: %v", i, err)
+		}
+	}
+	if stats := storage.Stats(); stats.Sessions != before.Sessions+1 || stats.Bytes != before.Bytes+6 || stats.Evictions != 0 {
+		t.Errorf("stats %+v, before %+v", stats, before)
+	}
+
+	//批量提交同样整体撤销
+	storage = NewMemStorage(MemOptions{MaxBytes: 1000})
+	storage.SetCodec(session.GobCodec{})
+	storage.SessionInit(ctx, "other")
+	storage.SessionInit(ctx, "big")
+	storage.SessionCommit(ctx, "big", map[string][]byte{"small": []byte("v")}, nil)
+	err := storage.SessionCommit(ctx, "big", map[string][]byte{"small": []byte("x"), "k": make([]byte, 5000)}, []string{"small"})
+	if !errors.Is(err, session.ErrValueTooLarge) {
+		t.Errorf("commit oversized value: %v, want ErrValueTooLarge", err)
+	}
+	values, _ := storage.SessionValues(ctx, "big")
+	if len(values) != 1 || string(values["small"]) != "v" {
+		t.Errorf("values after failed commit: %q", values)
+	}
+	if stats := storage.Stats(); stats.Sessions != 2 || stats.Bytes != 6 {
+		t.Errorf("stats after failed commit %+v", stats)
+	}
+}
+
+func ignoreValue(_ interface{}, err error) error {
+	return err
+}
+
+func TestMemStorageShards(t *testing.T) {
+	if n := len(NewMemStorage(MemOptions{}).shards); n != mem_default_shards {
+		t.Errorf("default shards %d, want %d", n, mem_default_shards)
+	}
+	if n := len(NewMemStorage(MemOptions{Shards: 3}).shards); n != 3 {
+		t.Errorf("shards %d, want 3", n)
+	}
+}
+
+func TestMemStorageRegenerate(t *testing.T) {
+	storage := NewMemStorage(MemOptions{Shards: 8})
+	ctx := context.Background()
+	sess, _ := storage.SessionInit(ctx, "old")
+	if err := sess.Set(ctx, "k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	moved, err := storage.SessionRegenerate(ctx, "old", "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := moved.Get(ctx, "k"); v != "v" {
+		t.Errorf("value after regenerate = %v, want v", v)
+	}
+	if _, err := storage.SessionFetch(ctx, "old"); !errors.Is(err, session.ErrSessionNotFound) {
+		t.Errorf("old sid still fetchable: %v", err)
+	}
+	//handler手上的旧对象跟着迁移到了新的sid
+	if sess.SessionID() != "new" {
+		t.Errorf("sid %q, want new", sess.SessionID())
+	}
+}
+
+//过期但还没被GC的条目不能借着换sid复活
+func TestMemStorageRegenerateExpired(t *testing.T) {
+	storage := NewMemStorage(MemOptions{})
+	storage.SetMaxLifeTime(60)
+	var expired []string
+	storage.SetEvents(session.StorageEvents{Expired: func(sid string) { expired = append(expired, sid) }})
+	ctx := context.Background()
+	storage.SessionInit(ctx, "idle")
+	storage.SessionInit(ctx, "old")
+
+	shard := storage.shard("idle")
+	shard.lock.Lock()
+	shard.sessions["idle"].Value.(*MemSession).time_accessed = time.Now().Add(-time.Hour)
+	shard.lock.Unlock()
+	if _, err := storage.SessionRegenerate(ctx, "idle", "idle2"); !errors.Is(err, session.ErrSessionNotFound) {
+		t.Errorf("regenerate idle session: %v, want ErrSessionNotFound", err)
+	}
+
+	storage.SetAbsoluteTimeout(60)
+	shard = storage.shard("old")
+	shard.lock.Lock()
+	shard.sessions["old"].Value.(*MemSession).time_created = time.Now().Add(-time.Hour)
+	shard.lock.Unlock()
+	if _, err := storage.SessionRegenerate(ctx, "old", "old2"); !errors.Is(err, session.ErrSessionNotFound) {
+		t.Errorf("regenerate too old session: %v, want ErrSessionNotFound", err)
+	}
+	for _, sid := range []string{"idle", "idle2", "old", "old2"} {
+		if _, err := storage.SessionFetch(ctx, sid); !errors.Is(err, session.ErrSessionNotFound) {
+			t.Errorf("%s still fetchable: %v", sid, err)
+		}
+	}
+	if len(expired) != 2 {
+		t.Errorf("expired %v, want [idle old]", expired)
+	}
+}
@@ -1,90 +1,462 @@
 package storages
 
 import (
-	"container/list"
+	"context"
 	"fmt"
 	"github.com/astaxie/goredis"
 	"github.com/hq-cml/GoHttpWeb/practices/session/session"
-	"sync"
+	"sort"
+	"strconv"
+	"sync/atomic"
 	"time"
 )
 
 /*
  * RedisSession实现，实现Session接口
  * 这是一个用户对应的session结构，而不是整体的session结构
+ * 本身不保存任何数据，只是redis中一个hash的句柄
  */
 type RedisSession struct {
-	sid           string    //session id唯一标示
-	time_accessed time.Time //最后访问时间
-	//value         map[interface{}]interface{} //session里面存储的值
+	sid     string        //session id唯一标示
+	created int64         //创建时间（unix秒），SessionInit/SessionFetch时从redis中读出，0表示未知
+	storage *RedisStorage //所属的storage
 }
 
 /*
  * Redis存储实现，这个结构实现Storage接口
  * 这是一个整体session的对应的结构
+ *
+ * 进程内不保存任何状态，一切以redis为准：
+ * 1. 每个session是redis中的一个hash，key是前缀+redis_session_infix+sid；sid来自客户端，
+ *    有了单独的子前缀，任何sid都不会和索引的key重合
+ * 2. 条目是否存在用EXISTS判断，多个实例挂在负载均衡后面也能共享session
+ * 3. 过期交给redis的EXPIRE，每次访问都刷新TTL，所以不需要本地的GC队列
+ * 4. 创建时间保存在hash的redis_created_field字段中；设置了绝对超时时，TTL不会超过距离绝对超时的时间，
+ *    redis到时自动删除，SessionFetch也会再检查一遍
+ * 5. 为了遍历和按用户查找，另外维护几个索引（见redis_index_key等），session过期时redis不会通知我们，
+ *    所以索引里会残留已经过期的sid，读取时过滤掉，由GC统一清理
  */
 type RedisStorage struct {
-	lock     sync.Mutex               //锁
-	sessions map[string]*list.Element //用于存储的内存，key是sid，value是list的Element（其实本质上，是一个）
-	list     *list.List               //链表，用于gc
+	client           redisClient   //redis客户端，自带连接池
+	prefix           string        //key的前缀
+	timeout          time.Duration //单次redis调用的超时时间，0表示只受ctx控制
+	max_life_time    int64         //空闲超时（秒），用于EXPIRE，原子操作
+	absolute_timeout int64         //绝对超时（秒），0表示不限制，原子操作
+	codec            session.Codec //值的序列化方式，默认gob
+	slots            chan struct{} //同时执行的redis调用数的上限，见redisDo
+
+	events session.StorageEvents //manager设置的事件回调，报告过期的条目
+}
+
+/*
+ * redis存储的配置
+ * goredis内部按需建立连接，不支持单独设置连接和读写的超时，
+ * 所以两者相加作为单次调用的超时时间（一次调用可能包含建立连接）
+ */
+type RedisOptions struct {
+	Name        string        //注册到session包的名字，为空则不注册，重名会panic
+	Addr        string        //redis地址，默认127.0.0.1:6379
+	Password    string        //密码，为空则不认证
+	DB          int           //db编号
+	KeyPrefix   string        //key的前缀，多个应用共用一个redis时用来避免冲突
+	PoolSize    int           //连接池大小，也是同时执行的redis调用数的上限，<=0时为redis_default_pool_size
+	DialTimeout time.Duration //建立连接的超时时间
+	ReadTimeout time.Duration //读写的超时时间
+}
+
+var g_redis_storage *RedisStorage
+
+//用到的redis命令，goredisClient实现了这个接口；测试时连接的是说RESP协议的假redis（见redis_test.go）
+type redisClient interface {
+	Del(key string) (bool, error)
+	Exists(key string) (bool, error)
+	Expire(key string, time int64) (bool, error)
+	Rename(src string, dst string) error
+	Hset(key string, field string, val []byte) (bool, error)
+	Hget(key string, field string) ([]byte, error)
+	Hdel(key string, field string) (bool, error)
+	Hexists(key string, field string) (bool, error)
+	Hgetall(key string, val interface{}) error
+	Hmset(key string, mapping interface{}) error
+	Sadd(key string, value []byte) (bool, error)
+	Srem(key string, value []byte) (bool, error)
+	Smembers(key string) ([][]byte, error)
+	Zadd(key string, value []byte, score float64) (bool, error)
+	Zrem(key string, value []byte) (bool, error)
+	Zcard(key string) (int, error)
+	Zrange(key string, start int, end int) ([][]byte, error)
+	Eval(script string, keys []string, args ...string) (interface{}, error)
+}
+
+//普通命令交给goredis，Lua脚本交给redisScripter（见redis_script.go）
+type goredisClient struct {
+	*goredis.Client
+	*redisScripter
 }
 
-var g_redis_storage = &RedisStorage{}
-var g_redis_client goredis.Client
+var _ redisClient = goredisClient{}
+
+//redis单个value最大512MB
+const redis_max_value_size = 512 << 20
+
+//SessionInit时写入的字段，保证空的session在redis中也是存在的（redis不允许空hash）
+const redis_created_field = "_session_created"
+
+//redis默认地址
+const redis_default_addr = "127.0.0.1:6379"
+
+//默认的连接池大小
+const redis_default_pool_size = 5
+
+//redis中的key（都要加上前缀）
+//sid由客户端带来，可以是任意字符串，session的key必须有自己的子前缀，否则sid为"_sessions"时就会读写到索引
+//注意：升级前保存在前缀+sid下的session不再可见，相当于所有用户重新登录一次
+const (
+	redis_session_infix  = "s:"             //每个session的hash，前缀+redis_session_infix+sid
+	redis_index_key      = "_sessions"      //zset，所有session的sid，score是创建时间
+	redis_users_key      = "_session_users" //hash，sid -> 关联的用户
+	redis_user_key_infix = "_user:"         //set，前缀+redis_user_key_infix+用户，用户的所有sid
+)
+
+//GC清理索引时，每次从zset中读取的条数
+const redis_index_page = 1000
+
+/*
+ * 修改一个已经存在的session：检查、修改和刷新TTL在redis里一次完成
+ * key不存在（已经被销毁或者过期）时什么都不做，返回0，不会凭空建出一个没有创建时间、也不在索引里的hash
+ * KEYS[1]是session的key；ARGV依次是：现在的时间，空闲超时，绝对超时，写入的字段数n，n对字段和值，其余是删除的字段
+ * 老的条目没有创建时间，从现在开始算；TTL的计算和expire相同。删除字段时创建时间留在hash里，session不会随之消失
+ */
+const redis_write_script = `
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+local now = tonumber(ARGV[1])
+local created = tonumber(redis.call('HGET', KEYS[1], '` + redis_created_field + `'))
+if not created then
+	created = now
+	redis.call('HSET', KEYS[1], '` + redis_created_field + `', ARGV[1])
+end
+local n = tonumber(ARGV[4])
+for i = 5, 4 + 2 * n, 2 do
+	redis.call('HSET', KEYS[1], ARGV[i], ARGV[i + 1])
+end
+for i = 5 + 2 * n, #ARGV do
+	redis.call('HDEL', KEYS[1], ARGV[i])
+end
+local ttl = tonumber(ARGV[2])
+local absolute_timeout = tonumber(ARGV[3])
+if absolute_timeout > 0 and created + absolute_timeout - now < ttl then
+	ttl = created + absolute_timeout - now
+end
+if ttl < 1 then
+	ttl = 1
+end
+redis.call('EXPIRE', KEYS[1], ttl)
+return 1
+`
+
+/*
+ * 新建一个session：删除旧的数据和用户关联、写入创建时间、加入索引、设置TTL在redis里一次完成，
+ * 中途出错不会留下一个没有TTL、永远不会过期的key
+ * KEYS依次是session的key、索引的key、sid -> 用户的hash；ARGV依次是：sid，创建时间，TTL，用户set的key的前缀
+ */
+const redis_init_script = `
+redis.call('DEL', KEYS[1])
+local user = redis.call('HGET', KEYS[3], ARGV[1])
+if user then
+	redis.call('SREM', ARGV[4] .. user, ARGV[1])
+	redis.call('HDEL', KEYS[3], ARGV[1])
+end
+redis.call('HSET', KEYS[1], '` + redis_created_field + `', ARGV[2])
+redis.call('ZADD', KEYS[2], ARGV[2], ARGV[1])
+redis.call('EXPIRE', KEYS[1], ARGV[3])
+return 1
+`
+
+/*
+ * 读取索引的一页，同时检查每个sid的session是否还存在，一页只需要一次往返
+ * KEYS[1]是索引的key；ARGV依次是：ZRANGE的起止下标，session的key的前缀
+ * 返回sid和是否存在（1/0）交替排列的数组
+ */
+const redis_page_script = `
+local page = redis.call('ZRANGE', KEYS[1], ARGV[1], ARGV[2])
+local result = {}
+for i, sid in ipairs(page) do
+	result[2 * i - 1] = sid
+	result[2 * i] = redis.call('EXISTS', ARGV[3] .. sid)
+end
+return result
+`
 
 func init() {
 	fmt.Println("Redis storage init")
-	// 设置端口为redis默认端口
-	g_redis_client.Addr = "127.0.0.1:6379"
-	g_redis_storage.list = list.New()
-	g_redis_storage.sessions = make(map[string]*list.Element, 0)
-	session.Register("redis", g_redis_storage)
+	// 默认连接本机redis的默认端口
+	g_redis_storage = NewRedisStorage(RedisOptions{Name: "redis"})
+}
+
+//创建redis存储，opts.Name不为空时同时注册到session包
+//比如staging和production用不同的名字注册，指向不同的redis
+func NewRedisStorage(opts RedisOptions) *RedisStorage {
+	if opts.Addr == "" {
+		opts.Addr = redis_default_addr
+	}
+	if opts.PoolSize <= 0 {
+		opts.PoolSize = redis_default_pool_size
+	}
+	client := goredisClient{
+		Client:        &goredis.Client{Addr: opts.Addr, Password: opts.Password, Db: opts.DB, MaxPoolSize: opts.PoolSize},
+		redisScripter: newRedisScripter(opts),
+	}
+	storage := &RedisStorage{
+		client:        client,
+		prefix:        opts.KeyPrefix,
+		timeout:       opts.DialTimeout + opts.ReadTimeout,
+		max_life_time: default_life_time,
+		codec:         session.GobCodec{},
+		slots:         make(chan struct{}, opts.PoolSize),
+	}
+	if opts.Name != "" {
+		session.RegisterV2(opts.Name, storage)
+	}
+	return storage
+}
+
+//sid在redis中对应的key
+func (self *RedisStorage) key(sid string) string {
+	return self.prefix + redis_session_infix + sid
+}
+
+//带上storage配置的超时时间执行redis调用
+func (self *RedisStorage) do(ctx context.Context, fn func() error) error {
+	if self.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, self.timeout)
+		defer cancel()
+	}
+	return redisDo(ctx, self.slots, fn)
 }
 
 /*
- * RedisSession实现Session接口的：Set/Get/Delete/SessionID方法
+ * goredis不支持context，所以把每次redis调用放到单独的goroutine里执行，
+ * 调用方只等到ctx结束为止，慢的redis请求不会把整个请求挂死
+ * goredis也没有读写超时，被放弃的调用仍然在后台占着连接，直到redis返回或者TCP连接断开，可能要等很久；
+ * 所以同时执行的调用数不超过slots的容量（连接池大小）：redis卡住时，后来的调用排队等待，
+ * 等到ctx结束就返回错误，goroutine不会无限堆积。请求的ctx没有超时时间时，要配置DialTimeout/ReadTimeout
+ * redis返回的错误统一包装成ErrStorageUnavailable
  */
-func (self *RedisSession) Set(key, value interface{}) error {
-	var k string
-	var v []byte
-	var ok bool
-	if k, ok = key.(string); !ok {
-		return nil
+func redisDo(ctx context.Context, slots chan struct{}, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	if v, ok = value.([]byte); !ok {
+	done := make(chan error, 1)
+	go func() {
+		defer func() { <-slots }()
+		done <- fn()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("%w: %v", session.ErrStorageUnavailable, err)
+		}
 		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	g_redis_client.Hset(self.sid, k, v)
-	//更新对应条目的访问时间
-	g_redis_storage.SessionUpdate(self.sid)
-	return nil
 }
 
-func (self *RedisSession) Get(key interface{}) interface{} {
-	var k string
-	var ok bool
-	if k, ok = key.(string); !ok {
-		return nil
+//实现session.LifeTimeAware，由manager告知条目的有效期
+func (self *RedisStorage) SetMaxLifeTime(max_life_time int64) {
+	atomic.StoreInt64(&self.max_life_time, max_life_time)
+}
+
+//实现session.AbsoluteTimeoutAware
+func (self *RedisStorage) SetAbsoluteTimeout(absolute_timeout int64) {
+	atomic.StoreInt64(&self.absolute_timeout, absolute_timeout)
+}
+
+//实现session.EventReporter
+//redis自己删除过期的key时不会通知我们，所以要等GC发现索引中的sid已经不存在了才报告，会有一个GC间隔的延迟
+func (self *RedisStorage) SetEvents(events session.StorageEvents) {
+	self.events = events
+}
+
+//报告过期的sid，在do之外调用
+func (self *RedisStorage) expiredSids(sids ...string) {
+	if self.events.Expired == nil {
+		return
 	}
-	//更新对应条目的访问时间
-	g_redis_storage.SessionUpdate(self.sid)
-	if v, err := g_redis_client.Hget(self.sid, k); err != nil {
-		return v
-	} else {
-		return nil
+	for _, sid := range sids {
+		self.events.Expired(sid)
 	}
-	return nil
 }
 
-func (self *RedisSession) Delete(key interface{}) error {
-	var k string
-	var ok bool
-	if k, ok = key.(string); !ok {
-		return nil
+//设置值的序列化方式，应当在开始使用之前设置
+func (self *RedisStorage) SetCodec(codec session.Codec) {
+	self.codec = codec
+}
+
+//刷新sid的TTL，调用方已经在do中
+//TTL是空闲超时，知道创建时间（created不为0）并且设置了绝对超时时，不超过距离绝对超时的时间
+func (self *RedisStorage) expire(sid string, created int64) error {
+	_, err := self.client.Expire(self.key(sid), self.ttl(created))
+	return err
+}
+
+//创建于created的session的TTL（秒）：空闲超时，但不超过距离绝对超时的时间，至少1秒
+func (self *RedisStorage) ttl(created int64) int64 {
+	ttl := atomic.LoadInt64(&self.max_life_time)
+	if absolute_timeout := atomic.LoadInt64(&self.absolute_timeout); absolute_timeout > 0 && created > 0 {
+		if left := created + absolute_timeout - time.Now().Unix(); left < ttl {
+			ttl = left
+		}
+	}
+	if ttl < 1 {
+		ttl = 1
+	}
+	return ttl
+}
+
+//读出sid的创建时间，调用方已经在do中；没有这个字段时返回0
+func (self *RedisStorage) created(sid string) int64 {
+	v, err := self.client.Hget(self.key(sid), redis_created_field)
+	if err != nil {
+		return 0
+	}
+	created, _ := strconv.ParseInt(string(v), 10, 64)
+	return created
+}
+
+//sid还存在时写入set、删除del并刷新TTL，用redis_write_script原子地完成，调用方已经在do中
+//sid不存在时什么都不做，返回false
+func (self *RedisStorage) write(sid string, set map[string][]byte, del []string) (bool, error) {
+	args := make([]string, 0, 4+2*len(set)+len(del))
+	args = append(args,
+		strconv.FormatInt(time.Now().Unix(), 10),
+		strconv.FormatInt(atomic.LoadInt64(&self.max_life_time), 10),
+		strconv.FormatInt(atomic.LoadInt64(&self.absolute_timeout), 10),
+		strconv.Itoa(len(set)),
+	)
+	for k, v := range set {
+		args = append(args, k, string(v))
+	}
+	args = append(args, del...)
+	reply, err := self.client.Eval(redis_write_script, []string{self.key(sid)}, args...)
+	if err != nil {
+		return false, err
+	}
+	return reply == int64(1), nil
+}
+
+//索引中下标从start到stop的sid，以及每个sid的session是否还存在，调用方已经在do中
+func (self *RedisStorage) indexPage(start, stop int) ([]string, []bool, error) {
+	reply, err := self.client.Eval(redis_page_script, []string{self.prefix + redis_index_key},
+		strconv.Itoa(start), strconv.Itoa(stop), self.key(""))
+	if err != nil {
+		return nil, nil, err
+	}
+	items, ok := reply.([]interface{})
+	if !ok || len(items)%2 != 0 {
+		return nil, nil, fmt.Errorf("redis: unexpected index page reply %v", reply)
+	}
+	sids := make([]string, 0, len(items)/2)
+	alive := make([]bool, 0, len(items)/2)
+	for i := 0; i < len(items); i += 2 {
+		sid, ok := items[i].([]byte)
+		if !ok {
+			return nil, nil, fmt.Errorf("redis: unexpected index page reply %v", reply)
+		}
+		sids = append(sids, string(sid))
+		alive = append(alive, items[i+1] == int64(1))
+	}
+	return sids, alive, nil
+}
+
+//是否已经绝对超时
+func (self *RedisStorage) tooOld(created int64) bool {
+	absolute_timeout := atomic.LoadInt64(&self.absolute_timeout)
+	return absolute_timeout > 0 && created > 0 && created+absolute_timeout < time.Now().Unix()
+}
+
+/*
+ * RedisSession实现SessionV2接口的：Set/Get/Delete/SessionID方法
+ * 每次访问都顺带刷新TTL
+ * key只支持string；value可以是任意类型，经过storage的codec序列化之后存入hash
+ * 和内存存储一样，session已经被销毁或者过期之后，Set/Delete返回ErrSessionNotFound，不会把它重新建出来
+ */
+func (self *RedisSession) Set(ctx context.Context, key, value interface{}) error {
+	k, ok := key.(string)
+	if !ok {
+		return fmt.Errorf("%w: redis session key must be string, got %T", session.ErrInvalidKey, key)
+	}
+	v, err := self.storage.codec.Encode(value)
+	if err != nil {
+		return err
+	}
+	if len(v) > redis_max_value_size {
+		return session.ErrValueTooLarge
+	}
+	return self.write(ctx, map[string][]byte{k: v}, nil)
+}
+
+//值不存在时返回nil, nil
+func (self *RedisSession) Get(ctx context.Context, key interface{}) (interface{}, error) {
+	k, ok := key.(string)
+	if !ok {
+		return nil, fmt.Errorf("%w: redis session key must be string, got %T", session.ErrInvalidKey, key)
+	}
+	var v []byte
+	var exists bool
+	err := self.storage.do(ctx, func() error {
+		var err error
+		if v, err = self.storage.client.Hget(self.storage.key(self.sid), k); err == nil {
+			exists = true
+		} else {
+			//goredis对“字段不存在”和“请求失败”返回同样的错误，用HEXISTS区分
+			if exists, err = self.storage.client.Hexists(self.storage.key(self.sid), k); err != nil {
+				return err
+			}
+			if exists {
+				return fmt.Errorf("hget %s failed", k)
+			}
+		}
+		return self.storage.expire(self.sid, self.created)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, nil
+	}
+	return self.storage.codec.Decode(v)
+}
+
+func (self *RedisSession) Delete(ctx context.Context, key interface{}) error {
+	k, ok := key.(string)
+	if !ok {
+		return fmt.Errorf("%w: redis session key must be string, got %T", session.ErrInvalidKey, key)
+	}
+	return self.write(ctx, nil, []string{k})
+}
+
+func (self *RedisSession) write(ctx context.Context, set map[string][]byte, del []string) error {
+	var exists bool
+	err := self.storage.do(ctx, func() error {
+		var err error
+		exists, err = self.storage.write(self.sid, set, del)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return session.ErrSessionNotFound
 	}
-	//更新对应条目的访问时间
-	g_redis_storage.SessionUpdate(self.sid)
-	g_redis_client.Hdel(self.sid, k)
 	return nil
 }
 
@@ -92,72 +464,371 @@ func (self *RedisSession) SessionID() string {
 	return self.sid
 }
 
+//实现session.CreationAware
+func (self *RedisSession) SessionCreated() int64 {
+	return self.created
+}
+
 /*
- * RedisStorage实现Storage接口的：SessionInit/SessionFetch/SessionDestroy/SessionGC方法
+ * RedisStorage实现StorageV2接口的：SessionInit/SessionFetch/SessionDestroy/SessionGC方法
  */
-//当新来一个用户的时候，新增一个session条目（element），并将之返回
-func (self *RedisStorage) SessionInit(sid string) (session.Session, error) {
-	self.lock.Lock()
-	defer self.lock.Unlock()
-	newsess := &RedisSession{sid: sid, time_accessed: time.Now()}
-	//将新生成的条目压入队列，开始GC轮回
-	element := self.list.PushBack(newsess)
-	//将新生成的条目以element的形式，放入session中去，用于后续读写
-	self.sessions[sid] = element
-	return newsess, nil
-}
-
-//根据sid，从storage中取出整个对应的条目（Element），以RedisSession形式返回
-func (self *RedisStorage) SessionFetch(sid string) (session.Session, error) {
-	if element, ok := self.sessions[sid]; ok {
-		return element.Value.(*RedisSession), nil
-	} else {
-		sess, err := self.SessionInit(sid)
-		return sess, err
-	}
-	return nil, nil
-}
-
-//根据sid，销毁storage中对应的条目，两处，内存中和gc队列中均需要清除
-func (self *RedisStorage) SessionDestroy(sid string) error {
-	if element, ok := self.sessions[sid]; ok {
-		delete(self.sessions, sid)
-		self.list.Remove(element)
-		g_redis_client.Del(sid)
+//当新来一个用户的时候，在redis中创建对应的hash，并设置TTL
+//sid已经存在时先删除，旧数据（包括创建时间和用户关联）不能沿用；全部步骤在redis_init_script中原子地完成
+func (self *RedisStorage) SessionInit(ctx context.Context, sid string) (session.SessionV2, error) {
+	created := time.Now().Unix()
+	err := self.do(ctx, func() error {
+		keys := []string{self.key(sid), self.prefix + redis_index_key, self.prefix + redis_users_key}
+		_, err := self.client.Eval(redis_init_script, keys,
+			sid, strconv.FormatInt(created, 10), strconv.FormatInt(self.ttl(created), 10), self.userKey(""))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &RedisSession{sid: sid, created: created, storage: self}, nil
+}
+
+//根据sid，检查redis中是否存在对应的条目，存在则刷新TTL并返回
+//不存在（从未创建或者已经过期）、或者已经绝对超时（顺便删除）则返回ErrSessionNotFound
+func (self *RedisStorage) SessionFetch(ctx context.Context, sid string) (session.SessionV2, error) {
+	var exists, expired bool
+	var created int64
+	err := self.do(ctx, func() error {
+		var err error
+		if exists, err = self.client.Exists(self.key(sid)); err != nil || !exists {
+			return err
+		}
+		if created = self.created(sid); self.tooOld(created) {
+			exists = false
+			if _, err = self.client.Del(self.key(sid)); err != nil {
+				return err
+			}
+			//从索引中删除失败时不报告，留给GC发现并报告，保证只报告一次
+			expired = self.unindex(sid) == nil
+			return nil
+		}
+		return self.expire(sid, created)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if expired {
+		self.expiredSids(sid)
+	}
+	if !exists {
+		return nil, session.ErrSessionNotFound
+	}
+	return &RedisSession{sid: sid, created: created, storage: self}, nil
+}
+
+//根据sid，销毁redis中对应的条目
+func (self *RedisStorage) SessionDestroy(ctx context.Context, sid string) error {
+	return self.do(ctx, func() error {
+		if _, err := self.client.Del(self.key(sid)); err != nil {
+			return err
+		}
+		return self.unindex(sid)
+	})
+}
+
+//把old_sid对应的条目迁移到new_sid下，redis中的数据用RENAME原子地改名
+func (self *RedisStorage) SessionRegenerate(ctx context.Context, old_sid, new_sid string) (session.SessionV2, error) {
+	//创建时间随数据一起迁移，换sid不会延长绝对超时
+	var exists bool
+	var created int64
+	err := self.do(ctx, func() error {
+		var err error
+		if exists, err = self.client.Exists(self.key(old_sid)); err != nil || !exists {
+			return err
+		}
+		if err = self.client.Rename(self.key(old_sid), self.key(new_sid)); err != nil {
+			return err
+		}
+		created = self.created(new_sid)
+		if err = self.expire(new_sid, created); err != nil {
+			return err
+		}
+		//索引跟着迁移
+		user_id, err := self.boundUser(old_sid)
+		if err != nil {
+			return err
+		}
+		if err = self.unindex(old_sid); err != nil {
+			return err
+		}
+		if _, err = self.client.Zadd(self.prefix+redis_index_key, []byte(new_sid), float64(created)); err != nil {
+			return err
+		}
+		if user_id != "" {
+			return self.bindUser(new_sid, user_id)
+		}
 		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	if !exists {
+		return nil, session.ErrSessionNotFound
+	}
+	return &RedisSession{sid: new_sid, created: created, storage: self}, nil
 }
 
-//GC，从最久未被访问的条目，一直向前遍历。
-//如果条目的访问时间+max_life_time比当前时间还小，则表示过期，则在队列以及内存中均予以删除
-func (self *RedisStorage) SessionGC(max_life_time int64) {
-	self.lock.Lock()
-	defer self.lock.Unlock()
+//过期（包括绝对超时）由redis的EXPIRE负责，这里只需要把已经过期的sid从索引中清理掉
+func (self *RedisStorage) SessionGC(ctx context.Context, max_life_time int64) error {
+	_, err := self.SessionGCCount(ctx, max_life_time)
+	return err
+}
 
-	for {
-		element := self.list.Back()
-		if element == nil {
-			break
+//实现session.GCCounter，返回从索引中清理掉的sid数，也就是上次GC以来过期的session数
+//先遍历完整个zset再删除，删除会让后面条目的下标前移，边遍历边删除会漏掉条目
+func (self *RedisStorage) SessionGCCount(ctx context.Context, max_life_time int64) (int, error) {
+	var expired []string
+	for start := 0; ; start += redis_index_page {
+		var page []string
+		var alive []bool
+		err := self.do(ctx, func() error {
+			var err error
+			page, alive, err = self.indexPage(start, start+redis_index_page-1)
+			return err
+		})
+		if err != nil {
+			return 0, err
 		}
-		if (element.Value.(*RedisSession).time_accessed.Unix() + max_life_time) < time.Now().Unix() {
-			self.list.Remove(element)
-			delete(self.sessions, element.Value.(*RedisSession).sid)
-			g_redis_client.Del(element.Value.(*RedisSession).sid)
-		} else {
+		for i, sid := range page {
+			if !alive[i] {
+				expired = append(expired, sid)
+			}
+		}
+		if len(page) < redis_index_page {
 			break
 		}
 	}
+	for i, sid := range expired {
+		if err := self.do(ctx, func() error { return self.unindex(sid) }); err != nil {
+			return i, err
+		}
+		self.expiredSids(sid)
+	}
+	return len(expired), nil
+}
+
+//刷新sid对应条目的TTL
+func (self *RedisStorage) SessionUpdate(ctx context.Context, sid string) error {
+	return self.do(ctx, func() error {
+		return self.expire(sid, self.created(sid))
+	})
+}
+
+/*
+ * RedisStorage实现session.Enumerator：cursor是zset中的下标，按创建时间的先后分页
+ * 索引里残留的已经过期的sid会被过滤掉，所以一页可能少于limit条
+ */
+func (self *RedisStorage) SessionList(ctx context.Context, cursor string, limit int) ([]string, string, error) {
+	start := 0
+	if cursor != "" {
+		var err error
+		if start, err = strconv.Atoi(cursor); err != nil || start < 0 {
+			return nil, "", fmt.Errorf("session: invalid redis cursor %q", cursor)
+		}
+	}
+	if limit <= 0 {
+		limit = redis_index_page
+	}
+	var page []string
+	var alive []bool
+	err := self.do(ctx, func() error {
+		var err error
+		page, alive, err = self.indexPage(start, start+limit-1)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	var sids []string
+	for i, sid := range page {
+		if alive[i] {
+			sids = append(sids, sid)
+		}
+	}
+	if len(page) < limit {
+		return sids, "", nil
+	}
+	return sids, strconv.Itoa(start + len(page)), nil
+}
+
+//zset的大小，包括上次GC以来已经过期的session，是近似值
+func (self *RedisStorage) SessionCount(ctx context.Context) (int, error) {
+	var count int
+	err := self.do(ctx, func() error {
+		var err error
+		count, err = self.client.Zcard(self.prefix + redis_index_key)
+		return err
+	})
+	return count, err
 }
 
-//跟新session存储中sid对应的条目（element）的更新时间，并且将对应条目前移
-func (self *RedisStorage) SessionUpdate(sid string) error {
-	self.lock.Lock()
-	defer self.lock.Unlock()
-	if element, ok := self.sessions[sid]; ok {
-		element.Value.(*RedisSession).time_accessed = time.Now()
-		self.list.MoveToFront(element)
+/*
+ * RedisStorage实现session.UserIndex
+ * sid -> 用户保存在redis_users_key的hash中，用户 -> sid保存在每个用户一个的set中
+ */
+func (self *RedisStorage) SessionBindUser(ctx context.Context, sid, user_id string) error {
+	var exists bool
+	err := self.do(ctx, func() error {
+		var err error
+		if exists, err = self.client.Exists(self.key(sid)); err != nil || !exists {
+			return err
+		}
+		if err = self.unbindUser(sid); err != nil {
+			return err
+		}
+		if user_id == "" {
+			return nil
+		}
+		return self.bindUser(sid, user_id)
+	})
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return session.ErrSessionNotFound
+	}
+	return nil
+}
+
+//用户存活的sid，顺便把已经过期的sid从索引中清理掉
+func (self *RedisStorage) SessionsOfUser(ctx context.Context, user_id string) ([]string, error) {
+	var sids, expired []string
+	err := self.do(ctx, func() error {
+		members, err := self.client.Smembers(self.userKey(user_id))
+		if err != nil {
+			return err
+		}
+		for _, member := range members {
+			sid := string(member)
+			exists, err := self.client.Exists(self.key(sid))
+			if err != nil {
+				return err
+			}
+			if exists {
+				sids = append(sids, sid)
+				continue
+			}
+			if err = self.unindex(sid); err != nil {
+				return err
+			}
+			expired = append(expired, sid)
+		}
 		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	self.expiredSids(expired...)
+	sort.Strings(sids)
+	return sids, nil
+}
+
+func (self *RedisStorage) userKey(user_id string) string {
+	return self.prefix + redis_user_key_infix + user_id
+}
+
+//sid关联的用户，没有关联时返回""，调用方已经在do中
+func (self *RedisStorage) boundUser(sid string) (string, error) {
+	v, err := self.client.Hget(self.prefix+redis_users_key, sid)
+	if err != nil {
+		//goredis对“字段不存在”和“请求失败”返回同样的错误，用HEXISTS区分
+		exists, err := self.client.Hexists(self.prefix+redis_users_key, sid)
+		if err != nil || !exists {
+			return "", err
+		}
+		return "", fmt.Errorf("hget %s: %v", sid, err)
+	}
+	return string(v), nil
+}
+
+//调用方已经在do中
+func (self *RedisStorage) bindUser(sid, user_id string) error {
+	if _, err := self.client.Hset(self.prefix+redis_users_key, sid, []byte(user_id)); err != nil {
+		return err
+	}
+	_, err := self.client.Sadd(self.userKey(user_id), []byte(sid))
+	return err
+}
+
+//解除sid和用户的关联，调用方已经在do中
+func (self *RedisStorage) unbindUser(sid string) error {
+	user_id, err := self.boundUser(sid)
+	if err != nil || user_id == "" {
+		return err
+	}
+	if _, err := self.client.Srem(self.userKey(user_id), []byte(sid)); err != nil {
+		return err
+	}
+	_, err = self.client.Hdel(self.prefix+redis_users_key, sid)
+	return err
+}
+
+//把sid从所有索引中删除，调用方已经在do中
+func (self *RedisStorage) unindex(sid string) error {
+	if err := self.unbindUser(sid); err != nil {
+		return err
+	}
+	_, err := self.client.Zrem(self.prefix+redis_index_key, []byte(sid))
+	return err
+}
+
+/*
+ * RedisStorage实现session.BatchStorage，用于延迟写回
+ */
+//一次读出sid的全部值；goredis的Hgetall对不存在的key也返回错误，这时再确认一下key是否存在
+func (self *RedisStorage) SessionValues(ctx context.Context, sid string) (map[string][]byte, error) {
+	fields := make(map[string]string)
+	missing := false
+	err := self.do(ctx, func() error {
+		err := self.client.Hgetall(self.key(sid), &fields)
+		if err != nil {
+			if exists, e := self.client.Exists(self.key(sid)); e == nil && !exists {
+				missing = true
+				return nil
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if missing || len(fields) == 0 {
+		return nil, session.ErrSessionNotFound
+	}
+	values := make(map[string][]byte, len(fields))
+	for k, v := range fields {
+		if k != redis_created_field {
+			values[k] = []byte(v)
+		}
+	}
+	return values, nil
+}
+
+//把一个请求攒下的修改一次写回：和Set/Delete一样用redis_write_script，写入、删除和刷新TTL在redis中原子地完成，
+//其他请求看不到写了一半的中间状态；只动这次修改过的字段，并发修改同一个session的其他请求写入的字段不会被覆盖
+//sid已经被销毁或者过期时什么都不写，返回ErrSessionNotFound
+func (self *RedisStorage) SessionCommit(ctx context.Context, sid string, set map[string][]byte, del []string) error {
+	for _, v := range set {
+		if len(v) > redis_max_value_size {
+			return session.ErrValueTooLarge
+		}
+	}
+	var exists bool
+	err := self.do(ctx, func() error {
+		var err error
+		exists, err = self.write(sid, set, del)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return session.ErrSessionNotFound
 	}
 	return nil
 }
@@ -0,0 +1,172 @@
+package storages
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+/*
+ * goredis没有EVAL，每个命令又可能用到连接池里不同的连接，也没法MULTI/EXEC，
+ * 所以需要原子执行的几个命令写成Lua脚本，通过这里自己维护的连接发给redis
+ * 只实现了EVAL用到的那部分RESP协议
+ */
+type redisScripter struct {
+	addr     string
+	password string
+	db       int
+	timeout  time.Duration   //单次调用的读写超时，0表示不限制
+	idle     chan *redisConn //空闲的连接，容量是连接池大小
+}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+//redis返回的错误回复，连接本身没有问题，可以继续使用
+type redisReplyError string
+
+func (self redisReplyError) Error() string {
+	return "redis: " + string(self)
+}
+
+func newRedisScripter(opts RedisOptions) *redisScripter {
+	return &redisScripter{
+		addr:     opts.Addr,
+		password: opts.Password,
+		db:       opts.DB,
+		timeout:  opts.DialTimeout + opts.ReadTimeout,
+		idle:     make(chan *redisConn, opts.PoolSize),
+	}
+}
+
+//执行脚本，keys和args分别是脚本中的KEYS和ARGV
+//回复：状态是string，整数是int64，bulk是[]byte（nil表示不存在），数组是[]interface{}
+func (self *redisScripter) Eval(script string, keys []string, args ...string) (interface{}, error) {
+	conn, err := self.get()
+	if err != nil {
+		return nil, err
+	}
+	cmd := append([]string{"EVAL", script, strconv.Itoa(len(keys))}, keys...)
+	reply, err := conn.do(self.timeout, append(cmd, args...))
+	if _, ok := err.(redisReplyError); err != nil && !ok {
+		//网络错误，连接上可能还有没读完的回复，不能再用
+		conn.conn.Close()
+		return nil, err
+	}
+	self.put(conn)
+	return reply, err
+}
+
+//取一个空闲的连接，没有则新建
+func (self *redisScripter) get() (*redisConn, error) {
+	select {
+	case conn := <-self.idle:
+		return conn, nil
+	default:
+	}
+	c, err := net.DialTimeout("tcp", self.addr, self.timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{conn: c, reader: bufio.NewReader(c)}
+	if self.password != "" {
+		if _, err := conn.do(self.timeout, []string{"AUTH", self.password}); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if self.db != 0 {
+		if _, err := conn.do(self.timeout, []string{"SELECT", strconv.Itoa(self.db)}); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+//用完的连接放回空闲列表，满了就关闭
+func (self *redisScripter) put(conn *redisConn) {
+	select {
+	case self.idle <- conn:
+	default:
+		conn.conn.Close()
+	}
+}
+
+//发送一条命令并读出回复
+func (self *redisConn) do(timeout time.Duration, args []string) (interface{}, error) {
+	if timeout > 0 {
+		self.conn.SetDeadline(time.Now().Add(timeout))
+	} else {
+		self.conn.SetDeadline(time.Time{})
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := self.conn.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return self.read()
+}
+
+//读一个回复；数组中有错误回复时，读完整个数组再返回第一个错误，连接仍然可以继续使用
+func (self *redisConn) read() (interface{}, error) {
+	line, err := self.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	line = line[:len(line)-2]
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisReplyError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed reply %q", line)
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(self.reader, buf); err != nil {
+			return nil, err
+		}
+		return buf[:size], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed reply %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		var first error
+		for i := range items {
+			items[i], err = self.read()
+			if _, ok := err.(redisReplyError); err != nil && !ok {
+				return nil, err
+			}
+			if err != nil && first == nil {
+				first = err
+			}
+		}
+		return items, first
+	}
+	return nil, fmt.Errorf("redis: malformed reply %q", line)
+}
@@ -0,0 +1,1014 @@
+package storages
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hq-cml/GoHttpWeb/practices/session/session"
+)
+
+/*
+ * 进程内的假redis服务器，监听本机的一个端口，说RESP协议
+ * 测试用的是真正的goredis客户端，经过的是和线上一样的代码路径：参数的编码、回复的解析、
+ * HGET不存在的字段和HGETALL不存在的key返回错误等goredis自己的行为都包括在内
+ * 命令的语义按照redis：RENAME不存在的key返回错误，删掉最后一个字段的hash、最后一个成员的set随之消失
+ * 过期是惰性的，访问key时检查；测试用expireKey模拟redis到时删除了key
+ * 假redis不会执行Lua，EVAL只认识storage自己的脚本，用等价的Go代码在锁内执行，和redis一样是原子的
+ */
+type fakeRedis struct {
+	lock   sync.Mutex
+	hashes map[string]map[string][]byte
+	sets   map[string]map[string]struct{}
+	zsets  map[string]map[string]float64
+	ttls   map[string]time.Time
+	down   bool //模拟redis出错，所有命令都返回错误
+
+	listener net.Listener
+	before   func(args []string) //每个命令执行之前调用（不持有锁），用来在两个命令之间插入别的请求
+}
+
+//启动假redis，测试结束时关闭
+func newFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeRedis{
+		hashes:   make(map[string]map[string][]byte),
+		sets:     make(map[string]map[string]struct{}),
+		zsets:    make(map[string]map[string]float64),
+		ttls:     make(map[string]time.Time),
+		listener: listener,
+	}
+	var wg sync.WaitGroup
+	var conns sync.Map
+	t.Cleanup(func() {
+		listener.Close()
+		conns.Range(func(conn, _ interface{}) bool {
+			conn.(net.Conn).Close()
+			return true
+		})
+		wg.Wait()
+	})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns.Store(conn, nil)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer conn.Close()
+				fake.serve(conn)
+			}()
+		}
+	}()
+	return fake
+}
+
+//连接到假redis的存储，多次调用可以模拟挂在负载均衡后面的多个实例
+func newFakeRedisStorage(fake *fakeRedis, opts RedisOptions) *RedisStorage {
+	opts.Addr = fake.listener.Addr().String()
+	return NewRedisStorage(opts)
+}
+
+//假redis的状态回复，比如+OK
+type fakeStatus string
+
+//处理一个连接上的命令，直到连接关闭
+func (self *fakeRedis) serve(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	for {
+		args, err := readFakeCommand(reader)
+		if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if self.before != nil {
+			self.before(args)
+		}
+		writeFakeReply(writer, self.exec(args))
+		if err := writer.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+//读一条命令：RESP数组，或者goredis发AUTH、SELECT时用的inline命令
+func readFakeCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		head, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(head, "$") {
+			return nil, fmt.Errorf("fake redis: bad bulk header %q", head)
+		}
+		size, err := strconv.Atoi(strings.TrimRight(head[1:], "\r\n"))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func writeFakeReply(writer *bufio.Writer, reply interface{}) {
+	switch v := reply.(type) {
+	case nil:
+		writer.WriteString("$-1\r\n")
+	case fakeStatus:
+		fmt.Fprintf(writer, "+%s\r\n", v)
+	case error:
+		fmt.Fprintf(writer, "-ERR %s\r\n", v)
+	case int64:
+		fmt.Fprintf(writer, ":%d\r\n", v)
+	case bool:
+		if v {
+			writer.WriteString(":1\r\n")
+		} else {
+			writer.WriteString(":0\r\n")
+		}
+	case []byte:
+		fmt.Fprintf(writer, "$%d\r\n%s\r\n", len(v), v)
+	case [][]byte:
+		fmt.Fprintf(writer, "*%d\r\n", len(v))
+		for _, item := range v {
+			fmt.Fprintf(writer, "$%d\r\n%s\r\n", len(item), item)
+		}
+	case []interface{}:
+		fmt.Fprintf(writer, "*%d\r\n", len(v))
+		for _, item := range v {
+			writeFakeReply(writer, item)
+		}
+	default:
+		panic(fmt.Sprintf("fake redis: unknown reply %T", reply))
+	}
+}
+
+var errFakeDown = errors.New("fake redis: connection refused")
+
+//参数个数不对时的错误，和redis的一样
+func fakeArity(cmd string) error {
+	return fmt.Errorf("wrong number of arguments for '%s' command", strings.ToLower(cmd))
+}
+
+//执行一条命令，返回回复
+func (self *fakeRedis) exec(args []string) interface{} {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.down {
+		return errFakeDown
+	}
+	cmd, args := strings.ToUpper(args[0]), args[1:]
+	arity := map[string]int{
+		"AUTH": 1, "SELECT": 1, "DEL": 1, "EXISTS": 1, "EXPIRE": 2, "RENAME": 2,
+		"HSET": 3, "HGET": 2, "HDEL": 2, "HEXISTS": 2, "HGETALL": 1,
+		"SADD": 2, "SREM": 2, "SMEMBERS": 1, "ZADD": 3, "ZREM": 2, "ZCARD": 1, "ZRANGE": 3,
+	}
+	if n, ok := arity[cmd]; ok && len(args) != n {
+		return fakeArity(cmd)
+	}
+	if len(args) > 0 {
+		self.check(args[0])
+	}
+	switch cmd {
+	case "AUTH", "SELECT":
+		return fakeStatus("OK")
+	case "DEL":
+		return self.remove(args[0])
+	case "EXISTS":
+		return self.exists(args[0])
+	case "EXPIRE":
+		seconds, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return errors.New("value is not an integer or out of range")
+		}
+		if !self.exists(args[0]) {
+			return false
+		}
+		self.ttls[args[0]] = time.Now().Add(time.Duration(seconds) * time.Second)
+		return true
+	case "RENAME":
+		self.check(args[1])
+		h, ok := self.hashes[args[0]]
+		if !ok {
+			return errors.New("no such key")
+		}
+		deadline, has_ttl := self.ttls[args[0]]
+		self.remove(args[0])
+		self.remove(args[1])
+		self.hashes[args[1]] = h
+		if has_ttl {
+			self.ttls[args[1]] = deadline
+		}
+		return fakeStatus("OK")
+	case "HSET":
+		return self.hset(args[0], args[1], args[2])
+	case "HMSET":
+		if len(args) < 3 || len(args)%2 != 1 {
+			return fakeArity(cmd)
+		}
+		for i := 1; i < len(args); i += 2 {
+			self.hset(args[0], args[i], args[i+1])
+		}
+		return fakeStatus("OK")
+	case "HGET":
+		v, ok := self.hashes[args[0]][args[1]]
+		if !ok {
+			return nil
+		}
+		return v
+	case "HDEL":
+		return self.hdel(args[0], args[1])
+	case "HEXISTS":
+		_, ok := self.hashes[args[0]][args[1]]
+		return ok
+	case "HGETALL":
+		h := self.hashes[args[0]]
+		fields := make([]string, 0, len(h))
+		for k := range h {
+			fields = append(fields, k)
+		}
+		sort.Strings(fields)
+		reply := [][]byte{}
+		for _, k := range fields {
+			reply = append(reply, []byte(k), h[k])
+		}
+		return reply
+	case "SADD":
+		s, ok := self.sets[args[0]]
+		if !ok {
+			s = make(map[string]struct{})
+			self.sets[args[0]] = s
+		}
+		_, existed := s[args[1]]
+		s[args[1]] = struct{}{}
+		return !existed
+	case "SREM":
+		s := self.sets[args[0]]
+		_, existed := s[args[1]]
+		delete(s, args[1])
+		if s != nil && len(s) == 0 {
+			self.remove(args[0])
+		}
+		return existed
+	case "SMEMBERS":
+		members := [][]byte{}
+		for m := range self.sets[args[0]] {
+			members = append(members, []byte(m))
+		}
+		return members
+	case "ZADD":
+		score, err := strconv.ParseFloat(args[1], 64)
+		if err != nil {
+			return errors.New("value is not a valid float")
+		}
+		z, ok := self.zsets[args[0]]
+		if !ok {
+			z = make(map[string]float64)
+			self.zsets[args[0]] = z
+		}
+		_, existed := z[args[2]]
+		z[args[2]] = score
+		return !existed
+	case "ZREM":
+		z := self.zsets[args[0]]
+		_, existed := z[args[1]]
+		delete(z, args[1])
+		if z != nil && len(z) == 0 {
+			self.remove(args[0])
+		}
+		return existed
+	case "ZCARD":
+		return int64(len(self.zsets[args[0]]))
+	case "ZRANGE":
+		start, err1 := strconv.Atoi(args[1])
+		end, err2 := strconv.Atoi(args[2])
+		if err1 != nil || err2 != nil {
+			return errors.New("value is not an integer or out of range")
+		}
+		return self.zrange(args[0], start, end)
+	case "EVAL":
+		if len(args) < 2 {
+			return fakeArity(cmd)
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 0 || 2+n > len(args) {
+			return errors.New("Number of keys can't be greater than number of args")
+		}
+		keys, argv := args[2:2+n], args[2+n:]
+		for _, key := range keys {
+			self.check(key)
+		}
+		switch args[0] {
+		case redis_write_script:
+			return self.evalWrite(keys, argv)
+		case redis_init_script:
+			return self.evalInit(keys, argv)
+		case redis_page_script:
+			return self.evalPage(keys, argv)
+		}
+		return errors.New("fake redis: unknown script")
+	}
+	return fmt.Errorf("unknown command '%s'", cmd)
+}
+
+//redis_init_script
+func (self *fakeRedis) evalInit(keys, argv []string) interface{} {
+	session_key, index_key, users_key := keys[0], keys[1], keys[2]
+	sid := argv[0]
+	self.remove(session_key)
+	if user, ok := self.hashes[users_key][sid]; ok {
+		user_key := argv[3] + string(user)
+		self.check(user_key)
+		delete(self.sets[user_key], sid)
+		if len(self.sets[user_key]) == 0 {
+			self.remove(user_key)
+		}
+		self.hdel(users_key, sid)
+	}
+	self.hset(session_key, redis_created_field, argv[1])
+	created, _ := strconv.ParseFloat(argv[1], 64)
+	if self.zsets[index_key] == nil {
+		self.zsets[index_key] = make(map[string]float64)
+	}
+	self.zsets[index_key][sid] = created
+	ttl, _ := strconv.ParseInt(argv[2], 10, 64)
+	self.ttls[session_key] = time.Now().Add(time.Duration(ttl) * time.Second)
+	return int64(1)
+}
+
+//redis_page_script
+func (self *fakeRedis) evalPage(keys, argv []string) interface{} {
+	start, _ := strconv.Atoi(argv[0])
+	stop, _ := strconv.Atoi(argv[1])
+	result := []interface{}{}
+	for _, member := range self.zrange(keys[0], start, stop) {
+		key := argv[2] + string(member)
+		self.check(key)
+		result = append(result, member, self.exists(key))
+	}
+	return result
+}
+
+//redis_write_script
+func (self *fakeRedis) evalWrite(keys, argv []string) interface{} {
+	key := keys[0]
+	if !self.exists(key) {
+		return int64(0)
+	}
+	now, _ := strconv.ParseInt(argv[0], 10, 64)
+	created, err := strconv.ParseInt(string(self.hashes[key][redis_created_field]), 10, 64)
+	if err != nil {
+		created = now
+		self.hset(key, redis_created_field, argv[0])
+	}
+	n, _ := strconv.Atoi(argv[3])
+	for i := 4; i < 4+2*n; i += 2 {
+		self.hset(key, argv[i], argv[i+1])
+	}
+	for _, field := range argv[4+2*n:] {
+		self.hdel(key, field)
+	}
+	ttl, _ := strconv.ParseInt(argv[1], 10, 64)
+	absolute_timeout, _ := strconv.ParseInt(argv[2], 10, 64)
+	if absolute_timeout > 0 && created+absolute_timeout-now < ttl {
+		ttl = created + absolute_timeout - now
+	}
+	if ttl < 1 {
+		ttl = 1
+	}
+	self.ttls[key] = time.Now().Add(time.Duration(ttl) * time.Second)
+	return int64(1)
+}
+
+//调用方持有锁；清理已经过期的key
+func (self *fakeRedis) check(key string) {
+	if deadline, ok := self.ttls[key]; ok && !time.Now().Before(deadline) {
+		self.remove(key)
+	}
+}
+
+func (self *fakeRedis) remove(key string) bool {
+	_, h := self.hashes[key]
+	_, s := self.sets[key]
+	_, z := self.zsets[key]
+	delete(self.hashes, key)
+	delete(self.sets, key)
+	delete(self.zsets, key)
+	delete(self.ttls, key)
+	return h || s || z
+}
+
+func (self *fakeRedis) exists(key string) bool {
+	_, h := self.hashes[key]
+	_, s := self.sets[key]
+	_, z := self.zsets[key]
+	return h || s || z
+}
+
+func (self *fakeRedis) hset(key, field, value string) bool {
+	h, ok := self.hashes[key]
+	if !ok {
+		h = make(map[string][]byte)
+		self.hashes[key] = h
+	}
+	_, existed := h[field]
+	h[field] = []byte(value)
+	return !existed
+}
+
+func (self *fakeRedis) hdel(key, field string) bool {
+	h, ok := self.hashes[key]
+	if !ok {
+		return false
+	}
+	_, existed := h[field]
+	delete(h, field)
+	if len(h) == 0 {
+		self.remove(key)
+	}
+	return existed
+}
+
+//按score、再按member排序，start和end都包含在内，end为-1表示到最后
+func (self *fakeRedis) zrange(key string, start, end int) [][]byte {
+	z := self.zsets[key]
+	members := make([]string, 0, len(z))
+	for m := range z {
+		members = append(members, m)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if z[members[i]] != z[members[j]] {
+			return z[members[i]] < z[members[j]]
+		}
+		return members[i] < members[j]
+	})
+	if end < 0 || end >= len(members) {
+		end = len(members) - 1
+	}
+	page := [][]byte{}
+	for i := start; i <= end; i++ {
+		page = append(page, []byte(members[i]))
+	}
+	return page
+}
+
+//直接修改hash的一个字段，不经过storage
+func (self *fakeRedis) setField(key, field, value string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.hset(key, field, value)
+}
+
+//模拟key到期被redis删除
+func (self *fakeRedis) expireKey(key string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.remove(key)
+}
+
+//key剩余的TTL，没有设置时返回0
+func (self *fakeRedis) ttl(key string) time.Duration {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if deadline, ok := self.ttls[key]; ok {
+		return time.Until(deadline)
+	}
+	return 0
+}
+
+func (self *fakeRedis) setDown(down bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.down = down
+}
+
+//当前所有的key，排好序
+func (self *fakeRedis) keys() []string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	var keys []string
+	for _, m := range []interface{}{self.hashes, self.sets, self.zsets} {
+		for _, k := range reflect.ValueOf(m).MapKeys() {
+			keys = append(keys, k.String())
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestRedisSharedAcrossInstances(t *testing.T) {
+	fake := newFakeRedis(t)
+	a := newFakeRedisStorage(fake, RedisOptions{KeyPrefix: "app:"})
+	b := newFakeRedisStorage(fake, RedisOptions{KeyPrefix: "app:"})
+	ctx := context.Background()
+
+	sess, err := a.SessionInit(ctx, "sid1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Set(ctx, "username", "tom"); err != nil {
+		t.Fatal(err)
+	}
+	//另一个实例上也能取到同一个session
+	other, err := b.SessionFetch(ctx, "sid1")
+	if err != nil {
+		t.Fatalf("fetch from second instance: %v", err)
+	}
+	if v, err := other.Get(ctx, "username"); err != nil || v != "tom" {
+		t.Errorf("Get = %v, %v, want tom", v, err)
+	}
+	if v, err := other.Get(ctx, "missing"); err != nil || v != nil {
+		t.Errorf("Get missing = %v, %v, want nil, nil", v, err)
+	}
+	if _, err := b.SessionFetch(ctx, "nope"); !errors.Is(err, session.ErrSessionNotFound) {
+		t.Errorf("fetch unknown sid: %v, want ErrSessionNotFound", err)
+	}
+	if err := b.SessionDestroy(ctx, "sid1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.SessionFetch(ctx, "sid1"); !errors.Is(err, session.ErrSessionNotFound) {
+		t.Errorf("fetch destroyed sid: %v, want ErrSessionNotFound", err)
+	}
+}
+
+//session被销毁或者过期之后，手上还拿着它的请求再写入，不能把它重新建出来
+func TestRedisWriteAfterDestroy(t *testing.T) {
+	fake := newFakeRedis(t)
+	storage := newFakeRedisStorage(fake, RedisOptions{})
+	storage.SetAbsoluteTimeout(60)
+	ctx := context.Background()
+	destroyed, _ := storage.SessionInit(ctx, "destroyed")
+	expired, _ := storage.SessionInit(ctx, "expired")
+	destroyed.Set(ctx, "k", "v")
+	expired.Set(ctx, "k", "v")
+	if err := storage.SessionDestroy(ctx, "destroyed"); err != nil {
+		t.Fatal(err)
+	}
+	fake.expireKey(storage.key("expired"))
+	for _, sess := range []session.SessionV2{destroyed, expired} {
+		sid := sess.SessionID()
+		if err := sess.Set(ctx, "k", "again"); !errors.Is(err, session.ErrSessionNotFound) {
+			t.Errorf("%s: Set = %v, want ErrSessionNotFound", sid, err)
+		}
+		if err := sess.Delete(ctx, "k"); !errors.Is(err, session.ErrSessionNotFound) {
+			t.Errorf("%s: Delete = %v, want ErrSessionNotFound", sid, err)
+		}
+		if _, err := storage.SessionFetch(ctx, sid); !errors.Is(err, session.ErrSessionNotFound) {
+			t.Errorf("%s: fetch after write: %v, want ErrSessionNotFound", sid, err)
+		}
+	}
+	if keys := fake.keys(); !reflect.DeepEqual(keys, []string{"_sessions"}) {
+		t.Errorf("keys %v, want only the index", keys)
+	}
+}
+
+//创建时间之前的老条目：写入时补上创建时间，TTL也按它受绝对超时限制
+func TestRedisWriteLegacySession(t *testing.T) {
+	fake := newFakeRedis(t)
+	storage := newFakeRedisStorage(fake, RedisOptions{})
+	storage.SetMaxLifeTime(600)
+	storage.SetAbsoluteTimeout(60)
+	ctx := context.Background()
+	fake.setField(storage.key("legacy"), "k", "v")
+	sess, err := storage.SessionFetch(ctx, "legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Set(ctx, "k", "v2"); err != nil {
+		t.Fatal(err)
+	}
+	if storage.created("legacy") == 0 {
+		t.Error("creation time not recorded")
+	}
+	if ttl := fake.ttl(storage.key("legacy")); ttl > 60*time.Second {
+		t.Errorf("ttl %v, want at most 60s", ttl)
+	}
+}
+
+func TestRedisExpiry(t *testing.T) {
+	fake := newFakeRedis(t)
+	storage := newFakeRedisStorage(fake, RedisOptions{})
+	storage.SetMaxLifeTime(600)
+	var expired []string
+	storage.SetEvents(session.StorageEvents{Expired: func(sid string) { expired = append(expired, sid) }})
+	ctx := context.Background()
+
+	sess, _ := storage.SessionInit(ctx, "sid1")
+	storage.SessionInit(ctx, "sid2")
+	//每次访问都刷新TTL
+	if ttl := fake.ttl(storage.key("sid1")); ttl <= 590*time.Second || ttl > 600*time.Second {
+		t.Errorf("ttl %v, want about 600s", ttl)
+	}
+	if _, err := sess.Get(ctx, "k"); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.expireKey(storage.key("sid1"))
+	if _, err := storage.SessionFetch(ctx, "sid1"); !errors.Is(err, session.ErrSessionNotFound) {
+		t.Errorf("fetch expired sid: %v, want ErrSessionNotFound", err)
+	}
+	if n, _ := storage.SessionCount(ctx); n != 2 {
+		t.Errorf("count before GC %d, want 2 (index still holds the expired sid)", n)
+	}
+	//GC把已经过期的sid从索引里清理掉，并报告过期
+	n, err := storage.SessionGCCount(ctx, 600)
+	if err != nil || n != 1 {
+		t.Errorf("GC = %d, %v, want 1", n, err)
+	}
+	if !reflect.DeepEqual(expired, []string{"sid1"}) {
+		t.Errorf("expired %v, want [sid1]", expired)
+	}
+	sids, next, err := storage.SessionList(ctx, "", 10)
+	if err != nil || next != "" || !reflect.DeepEqual(sids, []string{"sid2"}) {
+		t.Errorf("SessionList = %v, %q, %v, want [sid2]", sids, next, err)
+	}
+}
+
+func TestRedisAbsoluteTimeout(t *testing.T) {
+	fake := newFakeRedis(t)
+	storage := newFakeRedisStorage(fake, RedisOptions{})
+	storage.SetMaxLifeTime(600)
+	storage.SetAbsoluteTimeout(60)
+	ctx := context.Background()
+	storage.SessionInit(ctx, "sid1")
+	//TTL不超过距离绝对超时的时间
+	if ttl := fake.ttl(storage.key("sid1")); ttl > 60*time.Second {
+		t.Errorf("ttl %v, want at most 60s", ttl)
+	}
+	//创建时间改到两分钟之前
+	fake.setField(storage.key("sid1"), redis_created_field, fmt.Sprint(time.Now().Unix()-120))
+	if _, err := storage.SessionFetch(ctx, "sid1"); !errors.Is(err, session.ErrSessionNotFound) {
+		t.Errorf("fetch too old sid: %v, want ErrSessionNotFound", err)
+	}
+}
+
+func TestRedisRegenerate(t *testing.T) {
+	fake := newFakeRedis(t)
+	storage := newFakeRedisStorage(fake, RedisOptions{})
+	ctx := context.Background()
+	sess, _ := storage.SessionInit(ctx, "old")
+	sess.Set(ctx, "k", []string{"a", "b"})
+	if err := storage.SessionBindUser(ctx, "old", "tom"); err != nil {
+		t.Fatal(err)
+	}
+	moved, err := storage.SessionRegenerate(ctx, "old", "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := moved.Get(ctx, "k"); !reflect.DeepEqual(v, []string{"a", "b"}) {
+		t.Errorf("value after regenerate %v", v)
+	}
+	if _, err := storage.SessionFetch(ctx, "old"); !errors.Is(err, session.ErrSessionNotFound) {
+		t.Errorf("old sid still fetchable: %v", err)
+	}
+	if sids, _ := storage.SessionsOfUser(ctx, "tom"); !reflect.DeepEqual(sids, []string{"new"}) {
+		t.Errorf("user sessions %v, want [new]", sids)
+	}
+	if _, err := storage.SessionRegenerate(ctx, "old", "newer"); !errors.Is(err, session.ErrSessionNotFound) {
+		t.Errorf("regenerate missing sid: %v, want ErrSessionNotFound", err)
+	}
+}
+
+type redisTestUser struct {
+	Name string
+	Age  int
+}
+
+func init() {
+	session.RegisterType(redisTestUser{})
+}
+
+//值经过codec存入hash再取出来，类型保持不变
+func TestRedisValueRoundTrip(t *testing.T) {
+	for name, codec := range map[string]session.Codec{"gob": session.GobCodec{}, "json": session.JSONCodec{}, "binary": session.BinaryCodec{}} {
+		storage := newFakeRedisStorage(newFakeRedis(t), RedisOptions{})
+		storage.SetCodec(codec)
+		ctx := context.Background()
+		sess, _ := storage.SessionInit(ctx, "sid1")
+		for _, value := range []interface{}{"tom", []string{"tom", "jerry"}, redisTestUser{Name: "tom", Age: 18}, nil} {
+			if err := sess.Set(ctx, "k", value); err != nil {
+				t.Errorf("%s: Set(%#v): %v", name, value, err)
+				continue
+			}
+			if got, err := sess.Get(ctx, "k"); err != nil || !reflect.DeepEqual(got, value) {
+				t.Errorf("%s: Get = %#v, %v, want %#v", name, got, err, value)
+			}
+		}
+		//不支持的类型在Set时就报错
+		if err := sess.Set(ctx, "k", make(chan int)); err == nil {
+			t.Errorf("%s: Set of a channel succeeded", name)
+		}
+		if err := sess.Set(ctx, 1, "v"); !errors.Is(err, session.ErrInvalidKey) {
+			t.Errorf("%s: Set with int key: %v, want ErrInvalidKey", name, err)
+		}
+	}
+}
+
+func TestRedisUnavailable(t *testing.T) {
+	fake := newFakeRedis(t)
+	storage := newFakeRedisStorage(fake, RedisOptions{})
+	ctx := context.Background()
+	sess, _ := storage.SessionInit(ctx, "sid1")
+	fake.setDown(true)
+	if _, err := storage.SessionFetch(ctx, "sid1"); !errors.Is(err, session.ErrStorageUnavailable) {
+		t.Errorf("fetch: %v, want ErrStorageUnavailable", err)
+	}
+	if err := sess.Set(ctx, "k", "v"); !errors.Is(err, session.ErrStorageUnavailable) {
+		t.Errorf("set: %v, want ErrStorageUnavailable", err)
+	}
+	if _, err := sess.Get(ctx, "k"); !errors.Is(err, session.ErrStorageUnavailable) {
+		t.Errorf("get: %v, want ErrStorageUnavailable", err)
+	}
+	if err := storage.SessionGC(ctx, 600); !errors.Is(err, session.ErrStorageUnavailable) {
+		t.Errorf("gc: %v, want ErrStorageUnavailable", err)
+	}
+}
+
+//redis卡住时，同时执行的调用不超过slots的容量，多出来的调用等到ctx结束就返回，不会再起goroutine
+func TestRedisDoBounded(t *testing.T) {
+	slots := make(chan struct{}, 2)
+	hang := make(chan struct{})
+	var started int32
+	stuck := func() error {
+		atomic.AddInt32(&started, 1)
+		<-hang
+		return nil
+	}
+	for i := 0; i < 10; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		if err := redisDo(ctx, slots, stuck); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("call %d: %v, want DeadlineExceeded", i, err)
+		}
+		cancel()
+	}
+	if n := atomic.LoadInt32(&started); n != 2 {
+		t.Errorf("%d calls started, want 2", n)
+	}
+	//redis恢复之后，被占用的位置释放出来
+	close(hang)
+	if err := redisDo(context.Background(), slots, func() error { return nil }); err != nil {
+		t.Errorf("call after recovery: %v", err)
+	}
+	if err := redisDo(context.Background(), slots, func() error { return errFakeDown }); !errors.Is(err, session.ErrStorageUnavailable) {
+		t.Errorf("redis error: %v, want ErrStorageUnavailable", err)
+	}
+}
+
+func TestRedisUserIndex(t *testing.T) {
+	fake := newFakeRedis(t)
+	storage := newFakeRedisStorage(fake, RedisOptions{})
+	ctx := context.Background()
+	for _, sid := range []string{"s1", "s2", "s3"} {
+		storage.SessionInit(ctx, sid)
+	}
+	storage.SessionBindUser(ctx, "s1", "tom")
+	storage.SessionBindUser(ctx, "s2", "tom")
+	storage.SessionBindUser(ctx, "s3", "jerry")
+	if sids, _ := storage.SessionsOfUser(ctx, "tom"); !reflect.DeepEqual(sids, []string{"s1", "s2"}) {
+		t.Errorf("tom's sessions %v", sids)
+	}
+	//重新关联到别的用户
+	storage.SessionBindUser(ctx, "s2", "jerry")
+	if sids, _ := storage.SessionsOfUser(ctx, "tom"); !reflect.DeepEqual(sids, []string{"s1"}) {
+		t.Errorf("tom's sessions after rebinding %v", sids)
+	}
+	storage.SessionDestroy(ctx, "s3")
+	if sids, _ := storage.SessionsOfUser(ctx, "jerry"); !reflect.DeepEqual(sids, []string{"s2"}) {
+		t.Errorf("jerry's sessions after destroy %v", sids)
+	}
+	if err := storage.SessionBindUser(ctx, "gone", "tom"); !errors.Is(err, session.ErrSessionNotFound) {
+		t.Errorf("bind missing sid: %v, want ErrSessionNotFound", err)
+	}
+}
+
+//SessionInit只发一条EVAL：重新初始化已经存在的sid时清掉旧数据和用户关联，写入创建时间、索引和TTL
+func TestRedisInitAtomic(t *testing.T) {
+	fake := newFakeRedis(t)
+	storage := newFakeRedisStorage(fake, RedisOptions{KeyPrefix: "app:"})
+	storage.SetMaxLifeTime(600)
+	ctx := context.Background()
+	sess, _ := storage.SessionInit(ctx, "s1")
+	sess.Set(ctx, "k", "v")
+	storage.SessionBindUser(ctx, "s1", "tom")
+
+	var lock sync.Mutex
+	var commands []string
+	fake.before = func(args []string) {
+		lock.Lock()
+		defer lock.Unlock()
+		commands = append(commands, args[0])
+	}
+	sess, err := storage.SessionInit(ctx, "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock.Lock()
+	if !reflect.DeepEqual(commands, []string{"EVAL"}) {
+		t.Errorf("init sent %v, want a single EVAL", commands)
+	}
+	lock.Unlock()
+	fake.before = nil
+
+	if v, _ := sess.Get(ctx, "k"); v != nil {
+		t.Errorf("old value %v survived init", v)
+	}
+	if sids, _ := storage.SessionsOfUser(ctx, "tom"); len(sids) != 0 {
+		t.Errorf("tom's sessions %v after init, want none", sids)
+	}
+	if created := storage.created("s1"); created == 0 {
+		t.Error("creation time not recorded")
+	}
+	if ttl := fake.ttl(storage.key("s1")); ttl <= 590*time.Second || ttl > 600*time.Second {
+		t.Errorf("ttl %v, want about 600s", ttl)
+	}
+	want := []string{"app:_sessions", "app:s:s1"}
+	if keys := fake.keys(); !reflect.DeepEqual(keys, want) {
+		t.Errorf("keys %v, want %v", keys, want)
+	}
+	if sids, _, _ := storage.SessionList(ctx, "", 10); !reflect.DeepEqual(sids, []string{"s1"}) {
+		t.Errorf("index %v, want [s1]", sids)
+	}
+}
+
+//sid来自客户端，和索引同名的sid不能读写到索引
+func TestRedisKeySpace(t *testing.T) {
+	fake := newFakeRedis(t)
+	storage := newFakeRedisStorage(fake, RedisOptions{KeyPrefix: "app:"})
+	ctx := context.Background()
+	storage.SessionInit(ctx, "s1")
+	storage.SessionBindUser(ctx, "s1", "tom")
+	for _, sid := range []string{redis_index_key, redis_users_key, redis_user_key_infix + "tom"} {
+		if _, err := storage.SessionFetch(ctx, sid); !errors.Is(err, session.ErrSessionNotFound) {
+			t.Errorf("fetch sid %q: %v, want ErrSessionNotFound", sid, err)
+		}
+		if err := storage.SessionDestroy(ctx, sid); err != nil {
+			t.Errorf("destroy sid %q: %v", sid, err)
+		}
+	}
+	want := []string{"app:_session_users", "app:_sessions", "app:_user:tom", "app:s:s1"}
+	if keys := fake.keys(); !reflect.DeepEqual(keys, want) {
+		t.Errorf("keys %v, want %v", keys, want)
+	}
+	if sids, _ := storage.SessionsOfUser(ctx, "tom"); !reflect.DeepEqual(sids, []string{"s1"}) {
+		t.Errorf("tom's sessions %v", sids)
+	}
+}
+
+func TestRedisBatch(t *testing.T) {
+	fake := newFakeRedis(t)
+	storage := newFakeRedisStorage(fake, RedisOptions{})
+	ctx := context.Background()
+	sess, _ := storage.SessionInit(ctx, "sid1")
+	sess.Set(ctx, "a", 1)
+	sess.Set(ctx, "b", 2)
+	c, _ := storage.codec.Encode(3)
+	if err := storage.SessionCommit(ctx, "sid1", map[string][]byte{"c": c}, []string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	values, err := storage.SessionValues(ctx, "sid1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if !reflect.DeepEqual(keys, []string{"b", "c"}) {
+		t.Errorf("keys after commit %v, want [b c]", keys)
+	}
+	if err := storage.SessionCommit(ctx, "gone", map[string][]byte{"c": c}, nil); !errors.Is(err, session.ErrSessionNotFound) {
+		t.Errorf("commit to missing sid: %v, want ErrSessionNotFound", err)
+	}
+	if _, err := storage.SessionValues(ctx, "gone"); !errors.Is(err, session.ErrSessionNotFound) {
+		t.Errorf("values of missing sid: %v, want ErrSessionNotFound", err)
+	}
+	if keys := fake.keys(); !reflect.DeepEqual(keys, []string{"_sessions", storage.key("sid1")}) {
+		t.Errorf("keys %v, the missing sid was created", keys)
+	}
+}
+
+//一次提交只发一条EVAL，写入、删除和刷新TTL不会被其他请求看到一半
+func TestRedisBatchAtomic(t *testing.T) {
+	fake := newFakeRedis(t)
+	storage := newFakeRedisStorage(fake, RedisOptions{})
+	ctx := context.Background()
+	sess, _ := storage.SessionInit(ctx, "sid1")
+	sess.Set(ctx, "a", 1)
+	var commands []string
+	var lock sync.Mutex
+	fake.before = func(args []string) {
+		lock.Lock()
+		defer lock.Unlock()
+		commands = append(commands, args[0])
+	}
+	c, _ := storage.codec.Encode(3)
+	if err := storage.SessionCommit(ctx, "sid1", map[string][]byte{"b": c, "c": c}, []string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if !reflect.DeepEqual(commands, []string{"EVAL"}) {
+		t.Errorf("commit sent %v, want a single EVAL", commands)
+	}
+}
+
+//没有创建时间的老条目：提交时补上创建时间，TTL按它受绝对超时限制
+func TestRedisBatchLegacySession(t *testing.T) {
+	fake := newFakeRedis(t)
+	storage := newFakeRedisStorage(fake, RedisOptions{})
+	storage.SetMaxLifeTime(600)
+	storage.SetAbsoluteTimeout(60)
+	ctx := context.Background()
+	fake.setField(storage.key("legacy"), "k", "v")
+	c, _ := storage.codec.Encode(3)
+	if err := storage.SessionCommit(ctx, "legacy", map[string][]byte{"c": c}, []string{"k"}); err != nil {
+		t.Fatal(err)
+	}
+	if created := storage.created("legacy"); created == 0 {
+		t.Error("creation time not recorded")
+	}
+	if ttl := fake.ttl(storage.key("legacy")); ttl <= 0 || ttl > 60*time.Second {
+		t.Errorf("ttl %v, want capped by the 60s absolute timeout", ttl)
+	}
+}
+
+//有删除的提交只能动自己修改过的字段，不能覆盖别的请求同时写入的字段
+func TestRedisBatchConcurrentWrite(t *testing.T) {
+	fake := newFakeRedis(t)
+	storage := newFakeRedisStorage(fake, RedisOptions{})
+	ctx := context.Background()
+	sess, _ := storage.SessionInit(ctx, "sid1")
+	sess.Set(ctx, "a", 1)
+	//SessionCommit的脚本执行之前，插入另一个请求对同一个session的写入
+	other, _ := storage.codec.Encode("other")
+	var once sync.Once
+	fake.before = func(args []string) {
+		if args[0] == "EVAL" {
+			once.Do(func() { fake.setField(storage.key("sid1"), "other", string(other)) })
+		}
+	}
+	c, _ := storage.codec.Encode(3)
+	if err := storage.SessionCommit(ctx, "sid1", map[string][]byte{"c": c}, []string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	values, err := storage.SessionValues(ctx, "sid1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"c", "other"} {
+		if _, ok := values[k]; !ok {
+			t.Errorf("field %s missing after commit", k)
+		}
+	}
+	if _, ok := values["a"]; ok {
+		t.Error("deleted field a still present")
+	}
+	//一次提交删掉了所有用户的字段，session本身仍然存在
+	if err := storage.SessionCommit(ctx, "sid1", nil, []string{"c", "other"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.SessionFetch(ctx, "sid1"); err != nil {
+		t.Errorf("fetch after deleting every value: %v", err)
+	}
+}
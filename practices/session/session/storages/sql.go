@@ -0,0 +1,525 @@
+package storages
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/hq-cml/GoHttpWeb/practices/session/session"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * SQL Session实现，实现Session接口
+ * 本身不缓存数据，每次读写都直接操作数据库中sid对应的行
+ */
+type SQLSession struct {
+	sid     string      //session id唯一标示
+	created int64       //创建时间（unix秒）
+	storage *SQLStorage //所属的storage
+}
+
+/*
+ * SQL存储实现，这个结构实现Storage接口
+ * 基于database/sql，和practices/mysql中的用法一样，驱动由调用方import并sql.Open
+ *
+ * 1. 每个sid是表中的一行：sid、data（gob编码的map[string][]byte，value由codec序列化）、expires（过期的unix时间）、created（创建的unix时间）
+ *    mysql下sid是VARBINARY，按字节比较，大小写不同的sid不会被当成同一行；data是MEDIUMBLOB，编码之后超过16MB时Set返回ErrValueTooLarge
+ *    sid和file存储一样只接受base64url字符，最长128字节，不合法的sid不会发到数据库：不能让超长的sid被截断之后和别的sid落到同一行
+ * 2. 写入用upsert，读改写放在一个事务中（mysql下用SELECT ... FOR UPDATE锁住这一行）
+ *    行是否存在也在事务中查询，不看UPDATE的RowsAffected：mysql返回的是值真正改变了的行数，
+ *    同一秒内的第二次访问expires没有变化，会被当成行不存在
+ * 3. 每次访问都把expires往后推，但不超过created+绝对超时，SessionGC删除expires已经过去的行
+ * 4. 所有语句只prepare一次，之后的请求复用
+ *
+ * 需要数据库连接，所以不在init中注册，用法：
+ *   db, _ := sql.Open("mysql", "...")
+ *   storage, _ := storages.NewSQLStorage(db, storages.SQLOptions{})
+ *   storage.Migrate(ctx)
+ *   session.RegisterV2("sql", storage)
+ */
+type SQLStorage struct {
+	db               *sql.DB
+	table            string
+	dialect          SQLDialect
+	max_life_time    int64                 //空闲超时（秒），原子操作
+	absolute_timeout int64                 //绝对超时（秒），0表示不限制，原子操作
+	codec            session.Codec         //值的序列化方式，默认gob
+	events           session.StorageEvents //manager设置的事件回调，报告过期的条目
+
+	lock     sync.Mutex //保护下面的prepared statements
+	prepared bool
+	stmts    sqlStmts
+}
+
+//SQL方言，目前支持mysql和sqlite（sqlite主要用于测试）
+type SQLDialect int
+
+const (
+	DialectMySQL SQLDialect = iota
+	DialectSQLite
+)
+
+//SQL存储的配置
+type SQLOptions struct {
+	Table   string     //表名，默认sessions，只能包含字母、数字和下划线
+	Dialect SQLDialect //SQL方言，默认mysql
+}
+
+type sqlStmts struct {
+	selectLock *sql.Stmt //在事务中读一行并加锁
+	upsert     *sql.Stmt //插入或者更新一行
+	touch      *sql.Stmt //推迟过期时间
+	remove     *sql.Stmt //删除一行
+	rename     *sql.Stmt //修改sid
+	gc         *sql.Stmt //删除过期的行
+	gcSelect   *sql.Stmt //查出过期的行，需要报告过期的sid时使用
+	gcRemove   *sql.Stmt //删除一个过期的行
+}
+
+const (
+	sql_default_table = "sessions"
+	sql_max_data_size = 16<<20 - 1 //mysql的MEDIUMBLOB最多能存的字节数，超过时严格模式下报错，否则被截断
+)
+
+//创建SQL存储，不会访问数据库；表需要事先建好，或者调用Migrate创建
+func NewSQLStorage(db *sql.DB, opts SQLOptions) (*SQLStorage, error) {
+	if opts.Table == "" {
+		opts.Table = sql_default_table
+	}
+	if !validTableName(opts.Table) {
+		return nil, fmt.Errorf("session: invalid sql table name %q", opts.Table)
+	}
+	if opts.Dialect != DialectMySQL && opts.Dialect != DialectSQLite {
+		return nil, fmt.Errorf("session: unknown sql dialect %d", opts.Dialect)
+	}
+	return &SQLStorage{db: db, table: opts.Table, dialect: opts.Dialect, max_life_time: default_life_time, codec: session.GobCodec{}}, nil
+}
+
+//表名会被拼进SQL语句，只允许字母、数字和下划线
+func validTableName(name string) bool {
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_':
+		default:
+			return false
+		}
+	}
+	return name != ""
+}
+
+//建表语句，表已经存在时什么都不做
+func (self *SQLStorage) schema() []string {
+	if self.dialect == DialectSQLite {
+		return []string{
+			"CREATE TABLE IF NOT EXISTS " + self.table + " (sid TEXT NOT NULL PRIMARY KEY, data BLOB NOT NULL, expires INTEGER NOT NULL, created INTEGER NOT NULL)",
+			"CREATE INDEX IF NOT EXISTS " + self.table + "_expires ON " + self.table + " (expires)",
+		}
+	}
+	return []string{
+		"CREATE TABLE IF NOT EXISTS `" + self.table + "` (" +
+			"`sid` VARBINARY(128) NOT NULL, " +
+			"`data` MEDIUMBLOB NOT NULL, " +
+			"`expires` BIGINT NOT NULL, " +
+			"`created` BIGINT NOT NULL, " +
+			"PRIMARY KEY (`sid`), " +
+			"KEY `idx_expires` (`expires`)" +
+			") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+	}
+}
+
+//建表（migration），可以重复调用
+func (self *SQLStorage) Migrate(ctx context.Context) error {
+	for _, query := range self.schema() {
+		if _, err := self.db.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("%w: migrate: %v", session.ErrStorageUnavailable, err)
+		}
+	}
+	return nil
+}
+
+//各个语句，按方言生成
+func (self *SQLStorage) queries() map[**sql.Stmt]string {
+	t := self.table
+	upsert := "INSERT INTO " + t + " (sid, data, expires, created) VALUES (?, ?, ?, ?) " +
+		"ON DUPLICATE KEY UPDATE data = VALUES(data), expires = VALUES(expires), created = VALUES(created)"
+	lock := "SELECT data, expires, created FROM " + t + " WHERE sid = ? FOR UPDATE"
+	if self.dialect == DialectSQLite {
+		upsert = "INSERT INTO " + t + " (sid, data, expires, created) VALUES (?, ?, ?, ?) " +
+			"ON CONFLICT(sid) DO UPDATE SET data = excluded.data, expires = excluded.expires, created = excluded.created"
+		//sqlite的写事务本身就是串行的，不需要也不支持FOR UPDATE
+		lock = "SELECT data, expires, created FROM " + t + " WHERE sid = ?"
+	}
+	//touch和rename都在锁住这一行的事务中执行，新的过期时间由expires()算好
+	return map[**sql.Stmt]string{
+		&self.stmts.selectLock: lock,
+		&self.stmts.upsert:     upsert,
+		&self.stmts.touch:      "UPDATE " + t + " SET expires = ? WHERE sid = ?",
+		&self.stmts.remove:     "DELETE FROM " + t + " WHERE sid = ?",
+		&self.stmts.rename:     "UPDATE " + t + " SET sid = ?, expires = ? WHERE sid = ?",
+		&self.stmts.gc:         "DELETE FROM " + t + " WHERE expires < ?",
+		&self.stmts.gcSelect:   "SELECT sid FROM " + t + " WHERE expires < ?",
+		&self.stmts.gcRemove:   "DELETE FROM " + t + " WHERE sid = ? AND expires < ?",
+	}
+}
+
+//第一次使用时prepare全部语句，之后复用；失败（比如表还没建）时下次再试
+func (self *SQLStorage) prepare(ctx context.Context) (*sqlStmts, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.prepared {
+		return &self.stmts, nil
+	}
+	for ptr, query := range self.queries() {
+		stmt, err := self.db.PrepareContext(ctx, query)
+		if err != nil {
+			self.closeStmts()
+			return nil, fmt.Errorf("%w: prepare: %v", session.ErrStorageUnavailable, err)
+		}
+		*ptr = stmt
+	}
+	self.prepared = true
+	return &self.stmts, nil
+}
+
+func (self *SQLStorage) closeStmts() {
+	for ptr := range self.queries() {
+		if *ptr != nil {
+			(*ptr).Close()
+			*ptr = nil
+		}
+	}
+	self.prepared = false
+}
+
+//关闭prepared statements，db由调用方自己关闭
+func (self *SQLStorage) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.closeStmts()
+	return nil
+}
+
+//实现session.LifeTimeAware
+func (self *SQLStorage) SetMaxLifeTime(max_life_time int64) {
+	atomic.StoreInt64(&self.max_life_time, max_life_time)
+}
+
+//实现session.CodecAware，应当在开始使用之前设置
+func (self *SQLStorage) SetCodec(codec session.Codec) {
+	self.codec = codec
+}
+
+//实现session.AbsoluteTimeoutAware
+func (self *SQLStorage) SetAbsoluteTimeout(absolute_timeout int64) {
+	atomic.StoreInt64(&self.absolute_timeout, absolute_timeout)
+}
+
+//实现session.EventReporter
+//过期的行在访问时不会被删除，只由GC删除并报告
+func (self *SQLStorage) SetEvents(events session.StorageEvents) {
+	self.events = events
+}
+
+//从现在开始算的过期时间，不超过created+绝对超时
+func (self *SQLStorage) expires(created int64) int64 {
+	expires := time.Now().Unix() + atomic.LoadInt64(&self.max_life_time)
+	if absolute_timeout := atomic.LoadInt64(&self.absolute_timeout); absolute_timeout > 0 && created+absolute_timeout < expires {
+		expires = created + absolute_timeout
+	}
+	return expires
+}
+
+//编码之后超过data列的容量时返回ErrValueTooLarge，不能让数据库截断
+func sqlEncode(values map[string][]byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(values); err != nil {
+		return nil, err
+	}
+	if buf.Len() > sql_max_data_size {
+		return nil, fmt.Errorf("%w: session data is %d bytes, limit is %d", session.ErrValueTooLarge, buf.Len(), sql_max_data_size)
+	}
+	return buf.Bytes(), nil
+}
+
+func sqlDecode(sid string, data []byte) (map[string][]byte, error) {
+	values := make(map[string][]byte)
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&values); err != nil {
+		return nil, fmt.Errorf("session: corrupt session row %s: %w", sid, err)
+	}
+	return values, nil
+}
+
+//数据库错误包装成ErrStorageUnavailable，ctx的错误原样返回
+func sqlError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return fmt.Errorf("%w: %v", session.ErrStorageUnavailable, err)
+}
+
+//开启事务，锁住sid对应的行，行存在并且没有过期时把它的数据和创建时间交给fn，fn返回nil时提交
+//行不存在或者已经过期时返回ErrSessionNotFound；fn返回的错误原样返回，数据库错误由fn自己用sqlError包装
+func (self *SQLStorage) locked(ctx context.Context, stmts *sqlStmts, sid string, fn func(tx *sql.Tx, data []byte, created int64) error) (err error) {
+	tx, err := self.db.BeginTx(ctx, nil)
+	if err != nil {
+		return sqlError(ctx, err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var data []byte
+	var expires, created int64
+	now := time.Now().Unix()
+	err = tx.StmtContext(ctx, stmts.selectLock).QueryRowContext(ctx, sid).Scan(&data, &expires, &created)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && expires < now) {
+		return session.ErrSessionNotFound
+	}
+	if err != nil {
+		return sqlError(ctx, err)
+	}
+	if err = fn(tx, data, created); err != nil {
+		return err
+	}
+	return sqlError(ctx, tx.Commit())
+}
+
+//在事务中读出sid对应的数据，交给fn修改，fn返回true时写回，同时推迟过期时间
+func (self *SQLStorage) update(ctx context.Context, sid string, fn func(values map[string][]byte) bool) error {
+	stmts, err := self.prepare(ctx)
+	if err != nil {
+		return err
+	}
+	return self.locked(ctx, stmts, sid, func(tx *sql.Tx, data []byte, created int64) error {
+		values, err := sqlDecode(sid, data)
+		if err != nil {
+			return err
+		}
+		if fn(values) {
+			if data, err = sqlEncode(values); err != nil {
+				return err
+			}
+			_, err = tx.StmtContext(ctx, stmts.upsert).ExecContext(ctx, sid, data, self.expires(created), created)
+		} else {
+			_, err = tx.StmtContext(ctx, stmts.touch).ExecContext(ctx, self.expires(created), sid)
+		}
+		return sqlError(ctx, err)
+	})
+}
+
+/*
+ * SQLSession实现SessionV2接口的：Set/Get/Delete/SessionID方法
+ * key只支持string；value经过storage的codec序列化之后保存
+ */
+func (self *SQLSession) Set(ctx context.Context, key, value interface{}) error {
+	k, ok := key.(string)
+	if !ok {
+		return fmt.Errorf("%w: sql session key must be string, got %T", session.ErrInvalidKey, key)
+	}
+	v, err := self.storage.codec.Encode(value)
+	if err != nil {
+		return err
+	}
+	return self.storage.update(ctx, self.sid, func(values map[string][]byte) bool {
+		values[k] = v
+		return true
+	})
+}
+
+//值不存在时返回nil, nil
+func (self *SQLSession) Get(ctx context.Context, key interface{}) (interface{}, error) {
+	k, ok := key.(string)
+	if !ok {
+		return nil, fmt.Errorf("%w: sql session key must be string, got %T", session.ErrInvalidKey, key)
+	}
+	var v []byte
+	var exists bool
+	err := self.storage.update(ctx, self.sid, func(values map[string][]byte) bool {
+		v, exists = values[k]
+		return false
+	})
+	if err != nil || !exists {
+		return nil, err
+	}
+	return self.storage.codec.Decode(v)
+}
+
+func (self *SQLSession) Delete(ctx context.Context, key interface{}) error {
+	k, ok := key.(string)
+	if !ok {
+		return fmt.Errorf("%w: sql session key must be string, got %T", session.ErrInvalidKey, key)
+	}
+	return self.storage.update(ctx, self.sid, func(values map[string][]byte) bool {
+		if _, exists := values[k]; !exists {
+			return false
+		}
+		delete(values, k)
+		return true
+	})
+}
+
+func (self *SQLSession) SessionID() string {
+	return self.sid
+}
+
+//实现session.CreationAware
+func (self *SQLSession) SessionCreated() int64 {
+	return self.created
+}
+
+/*
+ * SQLStorage实现StorageV2接口的：SessionInit/SessionFetch/SessionDestroy/SessionGC方法
+ */
+//当新来一个用户的时候，插入一个空的行（sid已经存在时覆盖）
+func (self *SQLStorage) SessionInit(ctx context.Context, sid string) (session.SessionV2, error) {
+	if !validSid(sid) {
+		return nil, errInvalidSid
+	}
+	stmts, err := self.prepare(ctx)
+	if err != nil {
+		return nil, err
+	}
+	data, err := sqlEncode(map[string][]byte{})
+	if err != nil {
+		return nil, err
+	}
+	created := time.Now().Unix()
+	if _, err := stmts.upsert.ExecContext(ctx, sid, data, self.expires(created), created); err != nil {
+		return nil, sqlError(ctx, err)
+	}
+	return &SQLSession{sid: sid, created: created, storage: self}, nil
+}
+
+//sid对应的行存在且没有过期时推迟过期时间并返回，否则返回ErrSessionNotFound
+//expires不会超过created+绝对超时，所以绝对超时的行也会因为expires已经过去而找不到
+func (self *SQLStorage) SessionFetch(ctx context.Context, sid string) (session.SessionV2, error) {
+	if !validSid(sid) {
+		return nil, session.ErrSessionNotFound
+	}
+	stmts, err := self.prepare(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var created int64
+	err = self.locked(ctx, stmts, sid, func(tx *sql.Tx, data []byte, c int64) error {
+		created = c
+		_, err := tx.StmtContext(ctx, stmts.touch).ExecContext(ctx, self.expires(created), sid)
+		return sqlError(ctx, err)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &SQLSession{sid: sid, created: created, storage: self}, nil
+}
+
+//删除sid对应的行
+func (self *SQLStorage) SessionDestroy(ctx context.Context, sid string) error {
+	if !validSid(sid) {
+		return nil
+	}
+	stmts, err := self.prepare(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = stmts.remove.ExecContext(ctx, sid)
+	return sqlError(ctx, err)
+}
+
+//把old_sid对应的行改成new_sid，在锁住这一行的事务中执行
+func (self *SQLStorage) SessionRegenerate(ctx context.Context, old_sid, new_sid string) (session.SessionV2, error) {
+	if !validSid(old_sid) {
+		return nil, session.ErrSessionNotFound
+	}
+	if !validSid(new_sid) {
+		return nil, errInvalidSid
+	}
+	stmts, err := self.prepare(ctx)
+	if err != nil {
+		return nil, err
+	}
+	//created随行一起迁移，换sid不会延长绝对超时
+	var created int64
+	err = self.locked(ctx, stmts, old_sid, func(tx *sql.Tx, data []byte, c int64) error {
+		created = c
+		_, err := tx.StmtContext(ctx, stmts.rename).ExecContext(ctx, new_sid, self.expires(created), old_sid)
+		return sqlError(ctx, err)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &SQLSession{sid: new_sid, created: created, storage: self}, nil
+}
+
+//GC，删除expires已经过去的行
+//过期时间在每次访问时已经按max_life_time算好存在expires列中了，这里的参数不再使用
+func (self *SQLStorage) SessionGC(ctx context.Context, max_life_time int64) error {
+	_, err := self.SessionGCCount(ctx, max_life_time)
+	return err
+}
+
+//实现session.GCCounter，返回删除的行数
+//需要报告过期的sid时，先查出过期的行再逐行删除，否则一条DELETE删除全部
+func (self *SQLStorage) SessionGCCount(ctx context.Context, max_life_time int64) (int, error) {
+	stmts, err := self.prepare(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if self.events.Expired != nil {
+		return self.gcReport(ctx, stmts)
+	}
+	res, err := stmts.gc.ExecContext(ctx, time.Now().Unix())
+	if err != nil {
+		return 0, sqlError(ctx, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, sqlError(ctx, err)
+	}
+	return int(n), nil
+}
+
+//逐行删除过期的行并报告；删除时再检查一遍expires，查询之后又被访问（续期）的行不会被删除
+func (self *SQLStorage) gcReport(ctx context.Context, stmts *sqlStmts) (int, error) {
+	now := time.Now().Unix()
+	rows, err := stmts.gcSelect.QueryContext(ctx, now)
+	if err != nil {
+		return 0, sqlError(ctx, err)
+	}
+	var sids []string
+	for rows.Next() {
+		var sid string
+		if err := rows.Scan(&sid); err != nil {
+			rows.Close()
+			return 0, sqlError(ctx, err)
+		}
+		sids = append(sids, sid)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, sqlError(ctx, err)
+	}
+	count := 0
+	for _, sid := range sids {
+		res, err := stmts.gcRemove.ExecContext(ctx, sid, now)
+		if err != nil {
+			return count, sqlError(ctx, err)
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return count, sqlError(ctx, err)
+		} else if n > 0 {
+			self.events.Expired(sid)
+			count++
+		}
+	}
+	return count, nil
+}
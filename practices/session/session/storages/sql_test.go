@@ -0,0 +1,293 @@
+package storages
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hq-cml/GoHttpWeb/practices/session/session"
+	"github.com/mattn/go-sqlite3"
+)
+
+/*
+ * 用sqlite测试SQL存储
+ * mysql的UPDATE返回的RowsAffected是值真正改变了的行数，而sqlite返回匹配的行数；
+ * sqlite_unchanged驱动让所有UPDATE的RowsAffected都是0，模拟“同一秒内再次访问，expires没有变化”的mysql，
+ * 存储不能依赖这个值判断行是否存在
+ */
+func init() {
+	sql.Register("sqlite_unchanged", unchangedDriver{&sqlite3.SQLiteDriver{}})
+}
+
+type unchangedDriver struct{ driver.Driver }
+
+func (self unchangedDriver) Open(name string) (driver.Conn, error) {
+	conn, err := self.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return unchangedConn{conn}, nil
+}
+
+//只暴露driver.Conn的方法，database/sql会退回到Prepare/Exec
+type unchangedConn struct{ driver.Conn }
+
+func (self unchangedConn) Prepare(query string) (driver.Stmt, error) {
+	stmt, err := self.Conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return unchangedStmt{stmt, strings.HasPrefix(query, "UPDATE")}, nil
+}
+
+type unchangedStmt struct {
+	driver.Stmt
+	update bool
+}
+
+func (self unchangedStmt) Exec(args []driver.Value) (driver.Result, error) {
+	res, err := self.Stmt.Exec(args)
+	if err != nil || !self.update {
+		return res, err
+	}
+	return unchangedResult{res}, nil
+}
+
+type unchangedResult struct{ driver.Result }
+
+func (unchangedResult) RowsAffected() (int64, error) {
+	return 0, nil
+}
+
+func newSQLiteStorage(t *testing.T, driver_name string) *SQLStorage {
+	t.Helper()
+	db, err := sql.Open(driver_name, filepath.Join(t.TempDir(), "sessions.db")+"?_busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	storage, err := NewSQLStorage(db, SQLOptions{Dialect: DialectSQLite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	//可以重复调用
+	if err := storage.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { storage.Close() })
+	return storage
+}
+
+var sql_drivers = []string{"sqlite3", "sqlite_unchanged"}
+
+func TestSQLStorageRoundTrip(t *testing.T) {
+	for _, driver_name := range sql_drivers {
+		storage := newSQLiteStorage(t, driver_name)
+		ctx := context.Background()
+		sess, err := storage.SessionInit(ctx, "sid1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sess.Set(ctx, "name", "tom"); err != nil {
+			t.Fatal(err)
+		}
+		sess.Set(ctx, "roles", []string{"admin"})
+		sess.Set(ctx, "gone", 1)
+		sess.Delete(ctx, "gone")
+		//同一秒内连续访问多次，都能找到
+		for i := 0; i < 3; i++ {
+			fetched, err := storage.SessionFetch(ctx, "sid1")
+			if err != nil {
+				t.Fatalf("%s: fetch #%d: %v", driver_name, i, err)
+			}
+			if v, _ := fetched.Get(ctx, "name"); v != "tom" {
+				t.Errorf("%s: name = %v", driver_name, v)
+			}
+			if v, _ := fetched.Get(ctx, "roles"); !reflect.DeepEqual(v, []string{"admin"}) {
+				t.Errorf("%s: roles = %v", driver_name, v)
+			}
+			if v, err := fetched.Get(ctx, "gone"); v != nil || err != nil {
+				t.Errorf("%s: deleted value = %v, %v", driver_name, v, err)
+			}
+		}
+		if _, err := storage.SessionFetch(ctx, "nope"); !errors.Is(err, session.ErrSessionNotFound) {
+			t.Errorf("%s: fetch unknown sid: %v", driver_name, err)
+		}
+		if err := storage.SessionDestroy(ctx, "sid1"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := storage.SessionFetch(ctx, "sid1"); !errors.Is(err, session.ErrSessionNotFound) {
+			t.Errorf("%s: fetch destroyed sid: %v", driver_name, err)
+		}
+		if err := sess.Set(ctx, "name", "jerry"); !errors.Is(err, session.ErrSessionNotFound) {
+			t.Errorf("%s: set on destroyed session: %v", driver_name, err)
+		}
+	}
+}
+
+func TestSQLStorageRegenerate(t *testing.T) {
+	for _, driver_name := range sql_drivers {
+		storage := newSQLiteStorage(t, driver_name)
+		ctx := context.Background()
+		sess, _ := storage.SessionInit(ctx, "old")
+		sess.Set(ctx, "k", "v")
+		//刚刚访问过，expires不会变
+		moved, err := storage.SessionRegenerate(ctx, "old", "new")
+		if err != nil {
+			t.Fatalf("%s: %v", driver_name, err)
+		}
+		if v, _ := moved.Get(ctx, "k"); v != "v" {
+			t.Errorf("%s: value after regenerate = %v", driver_name, v)
+		}
+		if moved.(session.CreationAware).SessionCreated() != sess.(session.CreationAware).SessionCreated() {
+			t.Errorf("%s: creation time changed by regenerate", driver_name)
+		}
+		if _, err := storage.SessionFetch(ctx, "old"); !errors.Is(err, session.ErrSessionNotFound) {
+			t.Errorf("%s: old sid still fetchable: %v", driver_name, err)
+		}
+		if _, err := storage.SessionRegenerate(ctx, "old", "newer"); !errors.Is(err, session.ErrSessionNotFound) {
+			t.Errorf("%s: regenerate missing sid: %v", driver_name, err)
+		}
+	}
+}
+
+func TestSQLStorageExpiry(t *testing.T) {
+	storage := newSQLiteStorage(t, "sqlite3")
+	ctx := context.Background()
+	var expired []string
+	storage.SetEvents(session.StorageEvents{Expired: func(sid string) { expired = append(expired, sid) }})
+	storage.SessionInit(ctx, "live")
+	storage.SessionInit(ctx, "stale")
+	//stale的过期时间改到过去
+	if _, err := storage.db.Exec("UPDATE sessions SET expires = ? WHERE sid = ?", time.Now().Unix()-10, "stale"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.SessionFetch(ctx, "stale"); !errors.Is(err, session.ErrSessionNotFound) {
+		t.Errorf("fetch expired sid: %v", err)
+	}
+	if _, err := storage.SessionRegenerate(ctx, "stale", "revived"); !errors.Is(err, session.ErrSessionNotFound) {
+		t.Errorf("regenerate expired sid: %v", err)
+	}
+	n, err := storage.SessionGCCount(ctx, 0)
+	if err != nil || n != 1 {
+		t.Errorf("GC = %d, %v, want 1", n, err)
+	}
+	if !reflect.DeepEqual(expired, []string{"stale"}) {
+		t.Errorf("expired %v, want [stale]", expired)
+	}
+	if _, err := storage.SessionFetch(ctx, "live"); err != nil {
+		t.Errorf("fetch live sid after GC: %v", err)
+	}
+}
+
+//到了绝对超时的上限之后expires不再变化，之后的每次访问都不能被当成行不存在
+func TestSQLStorageCappedExpires(t *testing.T) {
+	for _, driver_name := range sql_drivers {
+		storage := newSQLiteStorage(t, driver_name)
+		storage.SetAbsoluteTimeout(120)
+		ctx := context.Background()
+		storage.SessionInit(ctx, "sid1")
+		//创建于一分钟之前，expires的上限比now+max_life_time早
+		if _, err := storage.db.Exec("UPDATE sessions SET created = ? WHERE sid = ?", time.Now().Unix()-60, "sid1"); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			sess, err := storage.SessionFetch(ctx, "sid1")
+			if err != nil {
+				t.Fatalf("%s: fetch #%d: %v", driver_name, i, err)
+			}
+			if err := sess.Set(ctx, "k", i); err != nil {
+				t.Fatalf("%s: set #%d: %v", driver_name, i, err)
+			}
+		}
+		var expires, created int64
+		storage.db.QueryRow("SELECT expires, created FROM sessions WHERE sid = ?", "sid1").Scan(&expires, &created)
+		if expires != created+120 {
+			t.Errorf("%s: expires %d, want created+120 = %d", driver_name, expires, created+120)
+		}
+	}
+}
+
+//超过MEDIUMBLOB容量的数据不能写进去被截断，原来的数据保持不变
+func TestSQLStorageValueTooLarge(t *testing.T) {
+	storage := newSQLiteStorage(t, sql_drivers[0])
+	ctx := context.Background()
+	sess, err := storage.SessionInit(ctx, "sid1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.Set(ctx, "name", "tom")
+	if err := sess.Set(ctx, "big", strings.Repeat("x", sql_max_data_size)); !errors.Is(err, session.ErrValueTooLarge) {
+		t.Errorf("set oversized value: %v, want ErrValueTooLarge", err)
+	}
+	fetched, err := storage.SessionFetch(ctx, "sid1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := fetched.Get(ctx, "name"); v != "tom" {
+		t.Errorf("name after failed set = %v", v)
+	}
+	if v, _ := fetched.Get(ctx, "big"); v != nil {
+		t.Error("oversized value was stored")
+	}
+}
+
+//客户端带来的sid太长或者含有非法字符时不发到数据库：mysql会截断超长的sid，两个不同的sid可能落到同一行
+func TestSQLStorageInvalidSid(t *testing.T) {
+	storage := newSQLiteStorage(t, "sqlite3")
+	ctx := context.Background()
+	prefix := strings.Repeat("a", max_sid_len)
+	if _, err := storage.SessionInit(ctx, prefix); err != nil {
+		t.Fatal(err)
+	}
+	for _, sid := range []string{prefix + "b", "a!b", "x/y", ""} {
+		if _, err := storage.SessionInit(ctx, sid); !errors.Is(err, session.ErrInvalidKey) {
+			t.Errorf("init %q: %v, want ErrInvalidKey", sid, err)
+		}
+		if _, err := storage.SessionFetch(ctx, sid); !errors.Is(err, session.ErrSessionNotFound) {
+			t.Errorf("fetch %q: %v, want ErrSessionNotFound", sid, err)
+		}
+		if _, err := storage.SessionRegenerate(ctx, prefix, sid); !errors.Is(err, session.ErrInvalidKey) {
+			t.Errorf("regenerate to %q: %v, want ErrInvalidKey", sid, err)
+		}
+		if err := storage.SessionDestroy(ctx, sid); err != nil {
+			t.Errorf("destroy %q: %v", sid, err)
+		}
+	}
+	var count int
+	if err := storage.db.QueryRow("SELECT COUNT(*) FROM sessions").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.SessionFetch(ctx, prefix); count != 1 || err != nil {
+		t.Errorf("%d rows, fetch valid sid: %v; want only the valid sid", count, err)
+	}
+}
+
+//mysql的建表语句：sid按字节比较，data能放下大于64KB的session
+func TestSQLStorageMySQLSchema(t *testing.T) {
+	storage, err := NewSQLStorage(nil, SQLOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := strings.Join(storage.schema(), "\n")
+	for _, want := range []string{"`sid` VARBINARY(128)", "`data` MEDIUMBLOB", "utf8mb4"} {
+		if !strings.Contains(schema, want) {
+			t.Errorf("schema %q does not contain %q", schema, want)
+		}
+	}
+}
+
+func TestSQLStorageInvalidTable(t *testing.T) {
+	if _, err := NewSQLStorage(nil, SQLOptions{Table: "sessions; DROP TABLE users"}); err == nil {
+		t.Error("table name with SQL accepted")
+	}
+}
@@ -0,0 +1,494 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * sid的传递方式
+ * ReadSid从请求中取出sid，没有则返回空串
+ * IssueSid在新建或者更换sid时调用，把sid告诉客户端；max_age是有效期（秒）
+ * ClearSid在销毁session时调用，让客户端忘掉sid
+ * name是manager的cookie_name，各个实现用它作为cookie名或者参数名
+ *
+ * 内置的实现：
+ * CookieTransport：默认，通过Set-Cookie下发
+ * HeaderTransport：通过请求/响应头传递，适合API客户端
+ * QueryTransport：通过URL参数传递，客户端自己负责在每个请求上带上sid
+ * URLRewriteTransport：URL参数，再加上RewriteURLs自动给HTML页面中的链接和表单追加sid，适合禁用了cookie的浏览器
+ */
+type SidTransport interface {
+	ReadSid(r *http.Request, name string) string
+	IssueSid(w http.ResponseWriter, r *http.Request, name, sid string, max_age int)
+	ClearSid(w http.ResponseWriter, r *http.Request, name string)
+}
+
+/*
+ * 可选接口：下发的sid会过期、需要随着session的访问而续期的传递方式
+ * SidIssued返回请求带来的sid是什么时候下发的（unix秒），manager据此决定是否重新下发；返回0表示不需要续期
+ */
+type SidRefresher interface {
+	SidIssued(r *http.Request, name string) int64
+}
+
+/*
+ * 通过cookie传递sid，cookie的属性由Options决定
+ * NewManager默认使用的CookieTransport带着传给NewManager的CookieOptions；自己传入CookieTransport{}时同样使用manager的cookie属性
+ * cookie的值是sid.下发时间，浏览器不会把cookie的过期时间发回来，只能自己记下什么时候下发的，用于续期
+ */
+type CookieTransport struct {
+	Options CookieOptions
+}
+
+//把cookie的值拆成sid和下发时间，老格式的cookie（只有sid）下发时间为0
+func splitCookieValue(value string) (string, int64) {
+	i := strings.LastIndexByte(value, '.')
+	if i < 0 {
+		return value, 0
+	}
+	issued, err := strconv.ParseInt(value[i+1:], 10, 64)
+	if err != nil || issued <= 0 {
+		return value, 0
+	}
+	return value[:i], issued
+}
+
+func (CookieTransport) ReadSid(r *http.Request, name string) string {
+	cookie, err := r.Cookie(name)
+	if err != nil || cookie.Value == "" {
+		return ""
+	}
+	value, _ := splitCookieValue(cookie.Value)
+	sid, _ := url.QueryUnescape(value)
+	return sid
+}
+
+func (self CookieTransport) IssueSid(w http.ResponseWriter, r *http.Request, name, sid string, max_age int) {
+	value := url.QueryEscape(sid) + "." + strconv.FormatInt(time.Now().Unix(), 10)
+	http.SetCookie(w, self.Options.Cookie(name, value, max_age))
+}
+
+//实现SidRefresher；只在浏览器会话内有效的cookie不会过期，不需要续期
+//老格式的cookie不知道下发时间，当做很久以前下发的，下次访问时就会续期并换成新格式
+func (self CookieTransport) SidIssued(r *http.Request, name string) int64 {
+	if self.Options.SessionOnly {
+		return 0
+	}
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return 0
+	}
+	if _, issued := splitCookieValue(cookie.Value); issued > 0 {
+		return issued
+	}
+	return 1
+}
+
+func (self CookieTransport) ClearSid(w http.ResponseWriter, r *http.Request, name string) {
+	http.SetCookie(w, self.Options.Cookie(name, "", -1))
+}
+
+/*
+ * 通过头传递sid：请求头中带上sid，新的sid通过同名的响应头下发，销毁时响应头为空
+ * 客户端需要自己保存响应头中的sid
+ */
+type HeaderTransport struct {
+	Header string //头的名字，默认X-Session-Id
+}
+
+const default_sid_header = "X-Session-Id"
+
+func (self HeaderTransport) header() string {
+	if self.Header == "" {
+		return default_sid_header
+	}
+	return self.Header
+}
+
+func (self HeaderTransport) ReadSid(r *http.Request, name string) string {
+	return r.Header.Get(self.header())
+}
+
+func (self HeaderTransport) IssueSid(w http.ResponseWriter, r *http.Request, name, sid string, max_age int) {
+	w.Header().Set(self.header(), sid)
+}
+
+func (self HeaderTransport) ClearSid(w http.ResponseWriter, r *http.Request, name string) {
+	w.Header().Set(self.header(), "")
+}
+
+/*
+ * 通过URL参数传递sid，参数名是manager的cookie_name
+ * 服务端没法主动下发，handler通过Session.SessionID()拿到sid，自己拼进返回给客户端的链接里
+ */
+type QueryTransport struct{}
+
+func (QueryTransport) ReadSid(r *http.Request, name string) string {
+	return r.URL.Query().Get(name)
+}
+
+func (QueryTransport) IssueSid(w http.ResponseWriter, r *http.Request, name, sid string, max_age int) {
+}
+
+func (QueryTransport) ClearSid(w http.ResponseWriter, r *http.Request, name string) {
+}
+
+/*
+ * URL重写：sid通过URL参数传递，并且由RewriteURLs包装的handler自动把sid追加到HTML页面中
+ * 同站的<a href>、<area href>、<form action>上，GET表单还会插入一个隐藏的input
+ * 没有action的POST表单、脚本里拼出来的URL不会被处理
+ */
+type URLRewriteTransport struct {
+	QueryTransport
+}
+
+func (URLRewriteTransport) IssueSid(w http.ResponseWriter, r *http.Request, name, sid string, max_age int) {
+	if rw := findRewriteWriter(w, r); rw != nil {
+		rw.sid, rw.issued = sid, true
+	}
+}
+
+func (URLRewriteTransport) ClearSid(w http.ResponseWriter, r *http.Request, name string) {
+	if rw := findRewriteWriter(w, r); rw != nil {
+		rw.sid, rw.issued = "", true
+	}
+}
+
+type rewriteKey struct{}
+
+/*
+ * 找到RewriteURLs的ResponseWriter：
+ * 1. RewriteURLs在外层：沿着w的Unwrap找，中间可能隔着Middleware等其他包装
+ * 2. 请求的context中登记的，handler换了ResponseWriter时也能找到
+ * 3. Middleware在外层：懒加载用的是Middleware收到的w和r，两者都看不到里层的RewriteURLs，由它登记在lazySession上
+ */
+func findRewriteWriter(w http.ResponseWriter, r *http.Request) *rewriteWriter {
+	for w != nil {
+		switch v := w.(type) {
+		case *rewriteWriter:
+			return v
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = v.Unwrap()
+		default:
+			w = nil
+		}
+	}
+	if rw, ok := r.Context().Value(rewriteKey{}).(*rewriteWriter); ok {
+		return rw
+	}
+	if lazy := lazyFromContext(r.Context()); lazy != nil {
+		return lazy.rw.Load()
+	}
+	return nil
+}
+
+//包装handler，对HTML响应做URL重写，需要配合URLRewriteTransport使用
+//和Middleware的先后顺序都可以：Middleware(RewriteURLs(h))和RewriteURLs(Middleware(h))
+func (manager *SessionManager) RewriteURLs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &rewriteWriter{ResponseWriter: w, status: http.StatusOK}
+		if lazy := lazyFromContext(r.Context()); lazy != nil {
+			lazy.rw.Store(rw)
+		}
+		r = r.WithContext(context.WithValue(r.Context(), rewriteKey{}, rw))
+		next.ServeHTTP(rw, r)
+		sid := rw.sid
+		if !rw.issued {
+			//本次请求没有换过sid，沿用请求带来的
+			sid = manager.transport.ReadSid(r, manager.cookie_name)
+		}
+		rw.finish(r, manager.cookie_name, sid)
+	})
+}
+
+/*
+ * 缓冲HTML响应的ResponseWriter
+ * 第一次Write时根据Content-Type（没有则嗅探）判断是不是HTML，不是的话直接透传，是的话缓冲到handler结束再重写
+ */
+type rewriteWriter struct {
+	http.ResponseWriter
+	status    int
+	buf       bytes.Buffer
+	buffering bool //正在缓冲HTML
+	passing   bool //不是HTML，已经透传
+	sid       string
+	issued    bool //本次请求中下发或者清除过sid
+}
+
+func (self *rewriteWriter) WriteHeader(status int) {
+	if !self.buffering && !self.passing {
+		self.status = status
+	}
+}
+
+func (self *rewriteWriter) Write(b []byte) (int, error) {
+	if !self.buffering && !self.passing {
+		content_type := self.Header().Get("Content-Type")
+		if content_type == "" {
+			content_type = http.DetectContentType(b)
+			self.Header().Set("Content-Type", content_type)
+		}
+		if strings.HasPrefix(content_type, "text/html") {
+			self.buffering = true
+		} else {
+			self.passing = true
+			self.ResponseWriter.WriteHeader(self.status)
+		}
+	}
+	if self.buffering {
+		return self.buf.Write(b)
+	}
+	return self.ResponseWriter.Write(b)
+}
+
+//handler结束后输出缓冲的内容
+func (self *rewriteWriter) finish(r *http.Request, name, sid string) {
+	if self.passing {
+		return
+	}
+	body := self.buf.Bytes()
+	if sid != "" {
+		param := url.QueryEscape(name) + "=" + url.QueryEscape(sid)
+		//重定向（比如登录之后）也要带上sid
+		if location := self.Header().Get("Location"); location != "" && sameSite(location, r.Host) && !hasParam(location, name) {
+			self.Header().Set("Location", appendParam(location, param, "&"))
+		}
+		if self.buffering {
+			body = rewriteHTML(body, r.Host, name, sid)
+		}
+	}
+	self.Header().Del("Content-Length")
+	self.ResponseWriter.WriteHeader(self.status)
+	self.ResponseWriter.Write(body)
+}
+
+/*
+ * 给HTML中的链接和表单追加sid
+ * 不用正则匹配，而是按HTML的词法逐个扫描标签和属性：
+ * 属性值里、注释里、<script>/<style>等原始文本里出现的“<a href=”都不是真的链接，不能改
+ */
+func rewriteHTML(body []byte, host, name, sid string) []byte {
+	param := url.QueryEscape(name) + "=" + url.QueryEscape(sid)
+	var out bytes.Buffer
+	for len(body) > 0 {
+		i := bytes.IndexByte(body, '<')
+		if i < 0 {
+			break
+		}
+		out.Write(body[:i])
+		body = body[i:]
+		if bytes.HasPrefix(body, []byte("<!--")) {
+			end := bytes.Index(body[4:], []byte("-->"))
+			if end < 0 {
+				break
+			}
+			out.Write(body[:4+end+3])
+			body = body[4+end+3:]
+			continue
+		}
+		tag, ok := scanTag(body)
+		if !ok {
+			//不是开始标签（结束标签、<!DOCTYPE>、文本中的<等），原样输出
+			out.WriteByte('<')
+			body = body[1:]
+			continue
+		}
+		if tag.end < 0 {
+			//没有结束的标签，后面的内容都不处理
+			break
+		}
+		out.Write(rewriteTag(body[:tag.end], tag, host, name, sid, param))
+		body = body[tag.end:]
+		if g_raw_text[tag.name] {
+			//原始文本元素的内容不是HTML，直接跳到它的结束标签
+			end := indexFold(body, "</"+tag.name)
+			if end < 0 {
+				break
+			}
+			out.Write(body[:end])
+			body = body[end:]
+		}
+	}
+	out.Write(body)
+	return out.Bytes()
+}
+
+//内容按原始文本处理的元素，其中的<不是标签
+var g_raw_text = map[string]bool{
+	"script": true, "style": true, "textarea": true, "title": true,
+	"xmp": true, "iframe": true, "noembed": true, "noframes": true, "plaintext": true,
+}
+
+//扫描出来的开始标签
+type htmlTag struct {
+	name  string     //小写的标签名
+	attrs []htmlAttr //属性，按出现的顺序
+	end   int        //标签结束（>之后）的位置，-1表示直到末尾都没有结束
+}
+
+//属性的值是tag[start:stop]，不含引号
+type htmlAttr struct {
+	name        string //小写的属性名
+	start, stop int
+	quote       byte //引号，没有引号时为0
+}
+
+func isHTMLSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+func isASCIILetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+//从b的开头（<）扫描一个开始标签，不是开始标签时返回false
+func scanTag(b []byte) (htmlTag, bool) {
+	if len(b) < 2 || !isASCIILetter(b[1]) {
+		return htmlTag{}, false
+	}
+	i := 1
+	for i < len(b) && !isHTMLSpace(b[i]) && b[i] != '/' && b[i] != '>' {
+		i++
+	}
+	tag := htmlTag{name: strings.ToLower(string(b[1:i])), end: -1}
+	for i < len(b) {
+		for i < len(b) && (isHTMLSpace(b[i]) || b[i] == '/') {
+			i++
+		}
+		if i >= len(b) {
+			break
+		}
+		if b[i] == '>' {
+			tag.end = i + 1
+			break
+		}
+		//属性名，第一个字符可以是=
+		start := i
+		i++
+		for i < len(b) && !isHTMLSpace(b[i]) && b[i] != '/' && b[i] != '>' && b[i] != '=' {
+			i++
+		}
+		attr := htmlAttr{name: strings.ToLower(string(b[start:i])), start: i, stop: i}
+		j := i
+		for j < len(b) && isHTMLSpace(b[j]) {
+			j++
+		}
+		if j < len(b) && b[j] == '=' {
+			i = j + 1
+			for i < len(b) && isHTMLSpace(b[i]) {
+				i++
+			}
+			if i < len(b) && (b[i] == '"' || b[i] == '\'') {
+				attr.quote = b[i]
+				end := bytes.IndexByte(b[i+1:], attr.quote)
+				if end < 0 {
+					return tag, true
+				}
+				attr.start, attr.stop = i+1, i+1+end
+				i = attr.stop + 1
+			} else {
+				attr.start = i
+				for i < len(b) && !isHTMLSpace(b[i]) && b[i] != '>' {
+					i++
+				}
+				attr.stop = i
+			}
+		}
+		tag.attrs = append(tag.attrs, attr)
+	}
+	return tag, true
+}
+
+//改写一个标签：同站的href/action追加sid，GET表单后面插入隐藏的input
+func rewriteTag(b []byte, tag htmlTag, host, name, sid, param string) []byte {
+	if tag.name != "a" && tag.name != "area" && tag.name != "form" {
+		return b
+	}
+	local, post := true, false
+	var edits []htmlAttr
+	for _, attr := range tag.attrs {
+		value := string(b[attr.start:attr.stop])
+		switch attr.name {
+		case "method":
+			post = strings.EqualFold(strings.TrimSpace(html.UnescapeString(value)), "post")
+		case "href", "action":
+			raw := html.UnescapeString(value)
+			if !sameSite(raw, host) {
+				local = false
+			} else if raw != "" && raw[0] != '#' && !hasParam(raw, name) {
+				edits = append(edits, attr)
+			}
+		}
+	}
+	out := make([]byte, 0, len(b)+len(edits)*len(param))
+	last := 0
+	for _, attr := range edits {
+		value := string(b[attr.start:attr.stop])
+		out = append(out, b[last:attr.start]...)
+		out = append(out, appendParam(value, param, "&amp;")...)
+		last = attr.stop
+	}
+	out = append(out, b[last:]...)
+	if tag.name == "form" && local && !post {
+		//GET表单提交时浏览器会丢掉action上的参数，用隐藏的input带上sid
+		out = append(out, `<input type="hidden" name="`+html.EscapeString(name)+`" value="`+html.EscapeString(sid)+`">`...)
+	}
+	return out
+}
+
+//不区分大小写查找ASCII的子串
+//sub以<开头，先找<再比较后面的部分
+func indexFold(b []byte, sub string) int {
+	for i := 0; i+len(sub) <= len(b); i++ {
+		j := bytes.IndexByte(b[i:], sub[0])
+		if j < 0 || i+j+len(sub) > len(b) {
+			return -1
+		}
+		i += j
+		if bytes.EqualFold(b[i:i+len(sub)], []byte(sub)) {
+			return i
+		}
+	}
+	return -1
+}
+
+//URL是否指向本站（相对地址，或者host相同的http/https地址）
+func sameSite(raw, host string) bool {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return false
+	}
+	if u.Scheme != "" && u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+	return u.Host == "" || u.Host == host
+}
+
+//URL上是否已经有这个参数，避免重复追加
+func hasParam(raw, name string) bool {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return false
+	}
+	_, exists := u.Query()[name]
+	return exists
+}
+
+//在fragment之前追加参数，HTML属性里的分隔符是&amp;，头里是&
+func appendParam(value, param, sep string) string {
+	fragment := ""
+	if i := strings.IndexByte(value, '#'); i >= 0 {
+		value, fragment = value[:i], value[i:]
+	}
+	if strings.Contains(value, "?") {
+		return value + sep + param + fragment
+	}
+	return value + "?" + param + fragment
+}
@@ -0,0 +1,171 @@
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRewriteHTML(t *testing.T) {
+	const hidden = `<input type="hidden" name="sid" value="abc">`
+	cases := []struct {
+		desc string
+		in   string
+		want string
+	}{
+		{"relative link", `<a href="/p">x</a>`, `<a href="/p?sid=abc">x</a>`},
+		{"query and fragment", `<a href='/p?x=1#top'>`, `<a href='/p?x=1&amp;sid=abc#top'>`},
+		{"unquoted, upper case", `<A HREF=/p>`, `<A HREF=/p?sid=abc>`},
+		{"same host", `<a href="https://example.com/x">`, `<a href="https://example.com/x?sid=abc">`},
+		{"area", `<area shape="rect" href="/map">`, `<area shape="rect" href="/map?sid=abc">`},
+		{"other host", `<a href="http://other.com/">`, `<a href="http://other.com/">`},
+		{"mailto", `<a href="mailto:a@example.com">`, `<a href="mailto:a@example.com">`},
+		{"fragment only", `<a href="#x">`, `<a href="#x">`},
+		{"already has sid", `<a href="/p?sid=zzz">`, `<a href="/p?sid=zzz">`},
+		{"no href", `<a name="top">`, `<a name="top">`},
+		{"href in another attribute", `<a title="see href=/evil" href="/p">`, `<a title="see href=/evil" href="/p?sid=abc">`},
+		{"quoted href in another attribute", `<a title='x href="/y"'>`, `<a title='x href="/y"'>`},
+		{"data-href", `<a data-href="/x">`, `<a data-href="/x">`},
+		{"other tags", `<link href="/style.css"><img src="/a.png" alt="<a href=/x>">`, `<link href="/style.css"><img src="/a.png" alt="<a href=/x>">`},
+		{"script", `<script>var s = '<a href="/x">';</script><a href="/p">`, `<script>var s = '<a href="/x">';</script><a href="/p?sid=abc">`},
+		{"script end tag case", `<SCRIPT>"<a href=/x>"</Script><a href=/p>`, `<SCRIPT>"<a href=/x>"</Script><a href=/p?sid=abc>`},
+		{"comment", `<!-- <a href="/x"> --><a href="/p">`, `<!-- <a href="/x"> --><a href="/p?sid=abc">`},
+		{"textarea", `<textarea><a href="/x"></textarea>`, `<textarea><a href="/x"></textarea>`},
+		{"text with <", `a < b <a href="/p">`, `a < b <a href="/p?sid=abc">`},
+		{"unterminated tag", `<a href="/p"`, `<a href="/p"`},
+		{"get form", `<form action="/search">`, `<form action="/search?sid=abc">` + hidden},
+		{"form without action", `<form>`, `<form>` + hidden},
+		{"post form", `<form method="POST" action="/login">`, `<form method="POST" action="/login?sid=abc">`},
+		{"method in another attribute", `<form data-x="method=post" action="/s">`, `<form data-x="method=post" action="/s?sid=abc">` + hidden},
+		{"form to other host", `<form action="http://other.com/">`, `<form action="http://other.com/">`},
+	}
+	for _, c := range cases {
+		if got := string(rewriteHTML([]byte(c.in), "example.com", "sid", "abc")); got != c.want {
+			t.Errorf("%s:\n got %s\nwant %s", c.desc, got, c.want)
+		}
+	}
+}
+
+//包在rewriteWriter外面的ResponseWriter，URLRewriteTransport要能透过它找到rewriteWriter
+type wrappedWriter struct{ http.ResponseWriter }
+
+func (self wrappedWriter) Unwrap() http.ResponseWriter { return self.ResponseWriter }
+
+func TestSidTransports(t *testing.T) {
+	request := func() *http.Request {
+		r := httptest.NewRequest("GET", "/p?GOSESSID=q1", nil)
+		r.Header.Set("X-Session-Id", "h1")
+		r.Header.Set("X-Token", "h2")
+		return r
+	}
+	cases := []struct {
+		desc      string
+		transport SidTransport
+		read      string //请求中读出的sid
+		header    string //下发时写到哪个响应头，空表示不写响应头
+	}{
+		{"header", HeaderTransport{}, "h1", "X-Session-Id"},
+		{"custom header", HeaderTransport{Header: "X-Token"}, "h2", "X-Token"},
+		{"query", QueryTransport{}, "q1", ""},
+		{"url rewrite", URLRewriteTransport{}, "q1", ""},
+	}
+	for _, c := range cases {
+		if sid := c.transport.ReadSid(request(), "GOSESSID"); sid != c.read {
+			t.Errorf("%s: ReadSid = %q, want %q", c.desc, sid, c.read)
+		}
+		if sid := c.transport.ReadSid(httptest.NewRequest("GET", "/", nil), "GOSESSID"); sid != "" {
+			t.Errorf("%s: ReadSid without sid = %q", c.desc, sid)
+		}
+		w := httptest.NewRecorder()
+		c.transport.IssueSid(w, request(), "GOSESSID", "new", 3600)
+		if c.header != "" && w.Header().Get(c.header) != "new" {
+			t.Errorf("%s: issued header %q = %q, want new", c.desc, c.header, w.Header().Get(c.header))
+		}
+		if c.header == "" && len(w.Header()) != 0 {
+			t.Errorf("%s: issue wrote headers %v", c.desc, w.Header())
+		}
+		c.transport.ClearSid(w, request(), "GOSESSID")
+		if values, ok := w.Header()[c.header]; c.header != "" && (!ok || len(values) != 1 || values[0] != "") {
+			t.Errorf("%s: cleared header %q = %v, want one empty value", c.desc, c.header, values)
+		}
+	}
+
+	//URL重写：下发和清除都记在RewriteURLs的writer上，中间隔着别的包装也能找到
+	rw := &rewriteWriter{ResponseWriter: httptest.NewRecorder(), status: http.StatusOK}
+	URLRewriteTransport{}.IssueSid(wrappedWriter{rw}, request(), "GOSESSID", "new", 3600)
+	if rw.sid != "new" || !rw.issued {
+		t.Errorf("url rewrite issue: sid %q, issued %v", rw.sid, rw.issued)
+	}
+	URLRewriteTransport{}.ClearSid(wrappedWriter{rw}, request(), "GOSESSID")
+	if rw.sid != "" || !rw.issued {
+		t.Errorf("url rewrite clear: sid %q, issued %v", rw.sid, rw.issued)
+	}
+}
+
+//cookie的值按最后一个'.'拆成sid和下发时间；生成的sid带'.'时SessionStart直接报错，不会下发拆不准的cookie
+func TestCookieSidSeparator(t *testing.T) {
+	cases := []struct {
+		value  string
+		sid    string
+		issued int64
+	}{
+		{"abc.1700000000", "abc", 1700000000},
+		{"a.b.1700000000", "a.b", 1700000000},
+		{"abc", "abc", 0},
+		{"a.b", "a.b", 0},
+		{"abc.0", "abc.0", 0},
+	}
+	for _, c := range cases {
+		if sid, issued := splitCookieValue(c.value); sid != c.sid || issued != c.issued {
+			t.Errorf("split %q = %q, %d, want %q, %d", c.value, sid, issued, c.sid, c.issued)
+		}
+	}
+
+	storage := &legacyStorage{sessions: make(map[string]*legacySession)}
+	manager, err := New(AdaptStorage(storage), WithSidGenerator(func() (string, error) { return "a.b", nil }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+	w := httptest.NewRecorder()
+	if _, err := manager.SessionStart(w, httptest.NewRequest("GET", "/", nil)); err == nil || !strings.Contains(err.Error(), "'.'") {
+		t.Errorf("SessionStart with a dotted sid: %v", err)
+	}
+	if h := w.Header().Get("Set-Cookie"); h != "" {
+		t.Errorf("dotted sid issued a cookie %q", h)
+	}
+	if len(storage.sessions) != 0 {
+		t.Errorf("dotted sid created %v", storage.sessions)
+	}
+}
+
+//重定向的Location也要带上sid，非HTML的响应原样透传
+func TestRewriteWriterFinish(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://example.com/login", nil)
+	w := httptest.NewRecorder()
+	rw := &rewriteWriter{ResponseWriter: w, status: http.StatusOK}
+	rw.Header().Set("Location", "/home#top")
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.WriteHeader(http.StatusFound)
+	rw.Write([]byte(`<a href="/home">home</a>`))
+	rw.finish(r, "sid", "abc")
+	if w.Code != http.StatusFound {
+		t.Errorf("status %d, want 302", w.Code)
+	}
+	if location := w.Header().Get("Location"); location != "/home?sid=abc#top" {
+		t.Errorf("Location = %s", location)
+	}
+	if body := w.Body.String(); body != `<a href="/home?sid=abc">home</a>` {
+		t.Errorf("body = %s", body)
+	}
+
+	w = httptest.NewRecorder()
+	rw = &rewriteWriter{ResponseWriter: w, status: http.StatusOK}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write([]byte(`{"href": "<a href=\"/x\">"}`))
+	rw.finish(r, "sid", "abc")
+	if body := w.Body.String(); body != `{"href": "<a href=\"/x\">"}` {
+		t.Errorf("json body rewritten: %s", body)
+	}
+}
@@ -0,0 +1,112 @@
+package session
+
+import (
+	"fmt"
+	"reflect"
+)
+
+/*
+ * 带类型的取值，不用再到处写类型断言：
+ *   name, ok, err := session.GetAs[string](sess, "name")
+ * 值不存在时返回零值和false；值的类型不对时返回ErrTypeMismatch，而不是像手写的断言那样panic
+ *
+ * 更进一步，可以把key的名字和类型一起声明成Key，用错类型在编译期就能发现：
+ *   var UserName = session.NewKey[string]("username")
+ *   UserName.Set(sess, "tom")
+ *   name, ok, err := UserName.Get(sess)
+ */
+
+//取出key对应的值并转换成T
+func GetAs[T any](sess Session, key interface{}) (T, bool, error) {
+	var zero T
+	v, err := getValue(sess, key)
+	if err != nil || v == nil {
+		return zero, false, err
+	}
+	t, ok := v.(T)
+	if !ok {
+		return zero, true, fmt.Errorf("%w: key %v holds %T, want %s", ErrTypeMismatch, key, v, reflect.TypeOf(&zero).Elem())
+	}
+	return t, true, nil
+}
+
+//老接口的Get吞掉了错误，能拿到SessionV2时直接用它，存储出错不会被当成值不存在
+func getValue(sess Session, key interface{}) (interface{}, error) {
+	if bound, ok := sess.(*boundSession); ok {
+		return bound.session.Get(bound.ctx, key)
+	}
+	return sess.Get(key), nil
+}
+
+/*
+ * 绑定了名字、类型和序列化方式的key
+ * codec为nil时，值原样交给session，由storage用manager的Codec序列化，T必须是注册过的类型（NewKey会自动注册）
+ * 指定codec时，值先用这个codec编码成[]byte再存入session，适合需要和其他程序共享格式的值
+ */
+type Key[T any] struct {
+	name  string
+	codec Codec
+}
+
+//声明一个key，值由manager的Codec序列化；T会被注册（见RegisterType）
+func NewKey[T any](name string) Key[T] {
+	var zero T
+	if reflect.TypeOf(zero) != nil {
+		RegisterType(zero)
+	}
+	return Key[T]{name: name}
+}
+
+//声明一个key，值用codec单独编码成[]byte之后再存入session
+func NewKeyWithCodec[T any](name string, codec Codec) Key[T] {
+	if codec == nil {
+		panic("session: NewKeyWithCodec with nil codec")
+	}
+	key := NewKey[T](name)
+	key.codec = codec
+	return key
+}
+
+//key的名字
+func (self Key[T]) Name() string {
+	return self.name
+}
+
+func (self Key[T]) Set(sess Session, value T) error {
+	if self.codec == nil {
+		return sess.Set(self.name, value)
+	}
+	data, err := self.codec.Encode(value)
+	if err != nil {
+		return err
+	}
+	return sess.Set(self.name, data)
+}
+
+//取出值，不存在时返回零值和false
+func (self Key[T]) Get(sess Session) (T, bool, error) {
+	if self.codec == nil {
+		return GetAs[T](sess, self.name)
+	}
+	var zero T
+	data, ok, err := GetAs[[]byte](sess, self.name)
+	if err != nil || !ok {
+		return zero, ok, err
+	}
+	v, err := self.codec.Decode(data)
+	if err != nil {
+		return zero, true, err
+	}
+	if v == nil {
+		return zero, true, nil
+	}
+	t, ok := v.(T)
+	if !ok {
+		return zero, true, fmt.Errorf("%w: key %q decoded to %T, want %s", ErrTypeMismatch, self.name, v, reflect.TypeOf(&zero).Elem())
+	}
+	return t, true, nil
+}
+
+func (self Key[T]) Delete(sess Session) error {
+	return sess.Delete(self.name)
+}
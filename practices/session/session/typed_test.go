@@ -0,0 +1,88 @@
+package session_test
+
+import (
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hq-cml/GoHttpWeb/practices/session/session"
+	"github.com/hq-cml/GoHttpWeb/practices/session/session/storages"
+)
+
+type typedUser struct {
+	Name  string
+	Roles []string
+}
+
+var (
+	g_typed_user      = session.NewKey[typedUser]("user")
+	g_typed_json_user = session.NewKeyWithCodec[typedUser]("json_user", session.JSONCodec{})
+)
+
+func newTypedSession(t *testing.T) session.Session {
+	t.Helper()
+	manager, err := session.New(storages.NewMemStorage(storages.MemOptions{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(manager.Close)
+	sess, err := manager.SessionStart(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sess
+}
+
+func TestGetAs(t *testing.T) {
+	sess := newTypedSession(t)
+	sess.Set("name", "tom")
+	if name, ok, err := session.GetAs[string](sess, "name"); name != "tom" || !ok || err != nil {
+		t.Errorf("GetAs[string] = %q, %v, %v", name, ok, err)
+	}
+	if n, ok, err := session.GetAs[int](sess, "missing"); n != 0 || ok || err != nil {
+		t.Errorf("GetAs missing key = %d, %v, %v", n, ok, err)
+	}
+	//类型不对时返回错误而不是panic，ok表示值存在
+	n, ok, err := session.GetAs[int](sess, "name")
+	if !errors.Is(err, session.ErrTypeMismatch) || !ok || n != 0 {
+		t.Errorf("GetAs[int] on a string = %d, %v, %v; want ErrTypeMismatch", n, ok, err)
+	}
+	if err != nil && !strings.Contains(err.Error(), "string") {
+		t.Errorf("error %q does not name the stored type", err)
+	}
+}
+
+func TestKeyRoundTrip(t *testing.T) {
+	sess := newTypedSession(t)
+	want := typedUser{Name: "tom", Roles: []string{"admin"}}
+	for _, key := range []session.Key[typedUser]{g_typed_user, g_typed_json_user} {
+		if _, ok, err := key.Get(sess); ok || err != nil {
+			t.Errorf("%s before Set: %v, %v", key.Name(), ok, err)
+		}
+		if err := key.Set(sess, want); err != nil {
+			t.Fatalf("%s: %v", key.Name(), err)
+		}
+		if got, ok, err := key.Get(sess); !reflect.DeepEqual(got, want) || !ok || err != nil {
+			t.Errorf("%s: Get = %+v, %v, %v", key.Name(), got, ok, err)
+		}
+	}
+	//带codec的key在session里存的是编码之后的[]byte
+	if raw, ok := sess.Get("json_user").([]byte); !ok || !strings.Contains(string(raw), `"tom"`) {
+		t.Errorf("json_user stored as %T %q", sess.Get("json_user"), sess.Get("json_user"))
+	}
+	//同一个名字用错了类型
+	if _, ok, err := session.NewKey[int]("user").Get(sess); !ok || !errors.Is(err, session.ErrTypeMismatch) {
+		t.Errorf("Key[int] on a typedUser: %v, %v; want ErrTypeMismatch", ok, err)
+	}
+	if _, _, err := session.NewKeyWithCodec[int]("json_user", session.JSONCodec{}).Get(sess); !errors.Is(err, session.ErrTypeMismatch) {
+		t.Errorf("codec Key[int] on a typedUser: %v; want ErrTypeMismatch", err)
+	}
+	if err := g_typed_user.Delete(sess); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := g_typed_user.Get(sess); ok || err != nil {
+		t.Errorf("after Delete: %v, %v", ok, err)
+	}
+}